@@ -3,22 +3,22 @@ package client
 import (
 	"GitHub/Messenger-to-learn-golang/protocol"
 	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
-	"crypto/md5"
-
 	"golang.org/x/crypto/ssh/terminal"
 )
 
-// Debug - for debugging
-var Debug = false //true
-
 //
 // Client - TCP client
 //
@@ -33,8 +33,24 @@ type Client struct {
 	// feedback from readLoop go-routine
 	responseChannel chan string
 
+	// nickname of login by client certificate (from readLoop go-routine)
+	loginChannel chan string
+
+	// TLS settings for "tls://" server address
+	tlsConfig *tls.Config
+
+	// API token to log in with at start ("" - none)
+	apiToken string
+
+	// directory of end-to-end encryption keys and keys by nickname
+	keyDir    string
+	keyrings  map[string]*e2eKeys
+	keysMutex sync.Mutex
+
 	// server address + port number (i.e. "localhost:1111")
 	serverAddr string
+
+	logger *slog.Logger
 }
 
 // NewClient - Client constructor
@@ -42,17 +58,67 @@ func NewClient(serverAddr string) *Client {
 	cl := new(Client)
 	cl.serverAddr = serverAddr
 	cl.responseChannel = make(chan string)
+	cl.loginChannel = make(chan string, 1)
+	cl.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	cl.keyDir = defaultKeyDir()
+	cl.keyrings = make(map[string]*e2eKeys)
+	cl.logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
 	return cl
 }
 
+// SetLogger - replace default logger (warnings and errors to stderr)
+func (cl *Client) SetLogger(logger *slog.Logger) {
+	cl.logger = logger
+}
+
+// SetTLSFiles - client certificate and key (login without password if server maps it)
+// and CA file to verify server certificate; empty names are ignored
+func (cl *Client) SetTLSFiles(certFile, keyFile, caFile string) error {
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		cl.tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		cl.tlsConfig.RootCAs = x509.NewCertPool()
+		if !cl.tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return errors.New("No certificates in '" + caFile + "'")
+		}
+	}
+
+	return nil
+}
+
+// SetAPIToken - log in with API token after connect (for bots and scripts)
+func (cl *Client) SetAPIToken(token string) {
+	cl.apiToken = token
+}
+
+// SetKeyDir - directory of end-to-end encryption keys
+func (cl *Client) SetKeyDir(dir string) {
+	cl.keyDir = dir
+}
+
 // connectToServer
 func (cl *Client) connectToServer() error {
 
 	fmt.Println("Connecting to '" + cl.serverAddr + "' ...")
 
-	// Connect to server
+	// Connect to server ("tls://host:port" for TLS)
 	var err error
-	cl.conn, err = net.Dial("tcp", cl.serverAddr)
+	if addr := strings.TrimPrefix(cl.serverAddr, constTLSPrefix); addr != cl.serverAddr {
+		cl.conn, err = tls.Dial("tcp", addr, cl.tlsConfig)
+	} else {
+		cl.conn, err = net.Dial("tcp", cl.serverAddr)
+	}
 	if err != nil {
 		fmt.Println(err)
 		return err
@@ -76,7 +142,12 @@ func (cl *Client) Run(serverAddr string) {
 	defer cl.conn.Close()
 
 	// Print greeting
-	fmt.Println(txtGREETING)
+	fmt.Print(txtGREETING)
+
+	// nickname comes with LOGGED_IN notice
+	if cl.apiToken != "" {
+		cl.sendRequest(protocol.ScmdTokenLogin, cl.apiToken, "")
+	}
 
 	var commandMap = map[string]func(){
 		cmdEXIT:     cl.handleExit,
@@ -87,18 +158,36 @@ func (cl *Client) Run(serverAddr string) {
 		cmdLIST:     cl.handleList,
 		cmdMESSAGE:  cl.handleSendMessage,
 		cmdPASSWORD: cl.handlePassword,
+		cmdROLE:     cl.handleRole,
+		cmdMODERATE: cl.handleModerate,
+		cmdBLOCK:    cl.handleBlock,
+		cmdUNBLOCK:  cl.handleUnblock,
+		cmdCONTACT:  cl.handleContact,
+		cmdPRIVACY:  cl.handlePrivacy,
+		cmdROSTER:   cl.handleRoster,
+		cmdPROFILE:  cl.handleProfile,
+		cmdNICKNAME: cl.handleNickname,
+		cmdDELETE:   cl.handleDeleteAccount,
+		cmd2FA:      cl.handle2FA,
+		cmdTOKEN:    cl.handleToken,
+		cmdKEYS:     cl.handleKeys,
 	}
 
 	//
 	// Command line read loop
 	//
 	for {
+		// logged in by client certificate?
+		select {
+		case nickName := <-cl.loginChannel:
+			cl.userNickName = nickName
+		default:
+		}
+
 		// Read user command from stdin
 		fmt.Print(cl.userNickName + "# ")
 		command := readLine()
-		if Debug {
-			log.Println("command:" + command)
-		}
+		cl.logger.Debug("command", "command", command)
 
 		if handleFunc := commandMap[command]; handleFunc != nil {
 			handleFunc()
@@ -125,9 +214,7 @@ func (cl *Client) handleRegister() {
 	//
 	fmt.Print(" Enter your nickname:")
 	nickName := readLine()
-	if Debug {
-		log.Println("nickName: '" + nickName + "'")
-	}
+	cl.logger.Debug("nickname", "nickname", nickName)
 
 	// check unique nickname
 	responseStr := cl.sendRequest(protocol.ScmdCheckUniqueNickName, nickName, "")
@@ -142,20 +229,14 @@ func (cl *Client) handleRegister() {
 	fmt.Print(" Enter password: ")
 	bytePassword, err := terminal.ReadPassword(int(os.Stdin.Fd()))
 	if err != nil {
-		log.Fatal(err)
-		return
+		cl.logger.Error("can't read password", "err", err)
+		os.Exit(1)
 	}
 	fmt.Println("")
 
-	// get md5 of password
-	md5Hex := fmt.Sprintf("md5:%x", md5.Sum(bytePassword))
-	if Debug {
-		log.Print("md5:" + md5Hex)
-	}
-
-	// send request to server
+	// send request to server (password is hashed by server)
 
-	cl.sendRequest(protocol.ScmdRegisterUser, nickName, md5Hex)
+	cl.sendRequest(protocol.ScmdRegisterUser, nickName, string(bytePassword))
 }
 
 // handleLogin
@@ -171,9 +252,7 @@ func (cl *Client) handleLogin() {
 	//
 	fmt.Print(" Enter your nickname:")
 	nickName := readLine()
-	if Debug {
-		log.Println("nickName: '" + nickName + "'")
-	}
+	cl.logger.Debug("nickname", "nickname", nickName)
 
 	//
 	// obtain password
@@ -181,20 +260,20 @@ func (cl *Client) handleLogin() {
 	fmt.Print(" Enter password: ")
 	bytePassword, err := terminal.ReadPassword(int(os.Stdin.Fd()))
 	if err != nil {
-		log.Fatal(err)
-		return
+		cl.logger.Error("can't read password", "err", err)
+		os.Exit(1)
 	}
 	fmt.Println("")
 
-	// get md5 of password
-	md5Hex := fmt.Sprintf("md5:%x", md5.Sum(bytePassword))
-	if Debug {
-		log.Print("md5:" + md5Hex)
-	}
-
 	// send request to server
 
-	responseStr := cl.sendRequest(protocol.ScmdLogin, nickName, md5Hex)
+	responseStr := cl.sendRequest(protocol.ScmdLogin, nickName, string(bytePassword))
+
+	// two-factor authentication
+	if responseStr == protocol.ReplyTOTPRequired {
+		fmt.Print(" Enter code from authenticator app (or recovery code): ")
+		responseStr = cl.sendRequest(protocol.ScmdLoginTOTP, readLine(), "")
+	}
 
 	if responseStr != "ok" {
 		fmt.Println(responseStr)
@@ -255,6 +334,16 @@ func (cl *Client) handleSendMessage() {
 	fmt.Print("enter message text: ")
 	msgText := readLine()
 
+	// encrypt if both users have keys
+	if keys := cl.keys(cl.userNickName); keys != nil && keys.publicKey() != "" {
+		sealed, err := cl.sealMessage(keys, recipientNickName, msgText)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		msgText = sealed
+	}
+
 	// send request to server
 
 	cl.sendRequest(protocol.ScmdMessageTo, recipientNickName, msgText)
@@ -270,52 +359,495 @@ func (cl *Client) handlePassword() {
 	}
 
 	//
-	// obtain new password
+	// obtain current and new password
 	//
+	fmt.Print("Enter current password: ")
+	currentPassword, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		cl.logger.Error("can't read password", "err", err)
+		os.Exit(1)
+	}
+	fmt.Println("")
+
 	fmt.Print("Enter new password: ")
 	bytePassword, err := terminal.ReadPassword(int(os.Stdin.Fd()))
 	if err != nil {
-		log.Fatal(err)
+		cl.logger.Error("can't read password", "err", err)
+		os.Exit(1)
+	}
+	fmt.Println("")
+
+	// send request to server
+
+	responseStr := cl.sendRequest(protocol.ScmdChangePassword, string(bytePassword), string(currentPassword))
+
+	if responseStr != "ok" {
+		fmt.Println(responseStr)
 		return
 	}
+}
 
-	// get md5 of password
-	md5Hex := fmt.Sprintf("md5:%x", md5.Sum(bytePassword))
-	if Debug {
-		log.Print("md5:" + md5Hex)
+// handleRole
+func (cl *Client) handleRole() {
+
+	// check authorization
+	if cl.userNickName == "" {
+		fmt.Println("You are not logged.")
+		return
 	}
 
+	// get user name
+	fmt.Print("user: ")
+	nickName := readLine()
+
+	// get role
+	fmt.Print("role (" + protocol.RoleUser + ", " + protocol.RoleModerator + ", " + protocol.RoleAdmin + "): ")
+	role := readLine()
+
 	// send request to server
 
-	responseStr := cl.sendRequest(protocol.ScmdChangePassword, md5Hex, "")
+	cl.sendRequest(protocol.ScmdSetRole, nickName, role)
+}
 
-	if responseStr != "ok" {
-		fmt.Println(responseStr)
+// handleBlock
+func (cl *Client) handleBlock() {
+	cl.sendUserRequest(protocol.ScmdBlock)
+}
+
+// handleUnblock
+func (cl *Client) handleUnblock() {
+	cl.sendUserRequest(protocol.ScmdUnblock)
+}
+
+// handleContact
+func (cl *Client) handleContact() {
+
+	// check authorization
+	if cl.userNickName == "" {
+		fmt.Println("You are not logged.")
+		return
+	}
+
+	fmt.Print("action (add, accept, decline, remove): ")
+	switch readLine() {
+	case "add":
+		cl.sendUserRequest(protocol.ScmdAddContact)
+	case "accept":
+		cl.sendUserRequest(protocol.ScmdAcceptContact)
+	case "decline":
+		cl.sendUserRequest(protocol.ScmdDeclineContact)
+	case "remove":
+		cl.sendUserRequest(protocol.ScmdRemoveContact)
+	default:
+		fmt.Println("Invalid action.")
+	}
+}
+
+// handle2FA
+func (cl *Client) handle2FA() {
+
+	// check authorization
+	if cl.userNickName == "" {
+		fmt.Println("You are not logged.")
+		return
+	}
+
+	fmt.Print("action (setup, disable): ")
+	switch readLine() {
+	case "setup":
+		// otpauth URI and recovery codes are printed by sendRequest
+		if !strings.Contains(cl.sendRequest(protocol.ScmdSetupTOTP, "", ""), "otpauth://") {
+			return
+		}
+		fmt.Print("code from authenticator app: ")
+		if cl.sendRequest(protocol.ScmdConfirmTOTP, readLine(), "") == "ok" {
+			fmt.Println("Two-factor authentication is on.")
+		}
+	case "disable":
+		fmt.Print("code from authenticator app (or recovery code): ")
+		if cl.sendRequest(protocol.ScmdDisableTOTP, readLine(), "") == "ok" {
+			fmt.Println("Two-factor authentication is off.")
+		}
+	default:
+		fmt.Println("Invalid action.")
+	}
+}
+
+// handleToken
+func (cl *Client) handleToken() {
+
+	// check authorization
+	if cl.userNickName == "" {
+		fmt.Println("You are not logged.")
+		return
+	}
+
+	fmt.Print("action (create, list, revoke): ")
+	switch readLine() {
+	case "create":
+		fmt.Print("token name: ")
+		name := readLine()
+		fmt.Print("scopes (" + protocol.TokenScopeSend + ", " + protocol.TokenScopeRead + ", " + protocol.TokenScopeAdmin + "; comma separated): ")
+		// token is printed by sendRequest
+		cl.sendRequest(protocol.ScmdCreateToken, name, readLine())
+	case "list":
+		cl.sendRequest(protocol.ScmdListTokens, "", "")
+	case "revoke":
+		fmt.Print("token ID or name: ")
+		if cl.sendRequest(protocol.ScmdRevokeToken, readLine(), "") == "ok" {
+			fmt.Println("Token is revoked.")
+		}
+	default:
+		fmt.Println("Invalid action.")
+	}
+}
+
+// handleKeys
+func (cl *Client) handleKeys() {
+
+	// check authorization
+	if cl.userNickName == "" {
+		fmt.Println("You are not logged.")
+		return
+	}
+	keys := cl.keys(cl.userNickName)
+	if keys == nil {
+		return
+	}
+
+	fmt.Print("action (generate, show, verify): ")
+	switch readLine() {
+	case "generate":
+		if keys.publicKey() != "" {
+			fmt.Print("You have a key, contacts will see a key change. Replace it? (y/n): ")
+			if readLine() != "y" {
+				return
+			}
+		}
+		if err := keys.generate(); err != nil {
+			fmt.Println(err)
+			return
+		}
+		if cl.sendRequest(protocol.ScmdSetPublicKey, keys.publicKey(), "") == "ok" {
+			fmt.Println("Your key fingerprint: " + fingerprint(keys.publicKey()))
+		}
+	case "show":
+		if keys.publicKey() == "" {
+			fmt.Println("No key, use 'keys' -> 'generate'.")
+			return
+		}
+		fmt.Println("Your key fingerprint: " + fingerprint(keys.publicKey()))
+	case "verify":
+		fmt.Print("user: ")
+		name := readLine()
+		key := cl.request(protocol.ScmdGetPublicKey, name, "")
+		if !validPublicKey(key) {
+			fmt.Println(key)
+			return
+		}
+		// compare with fingerprint the user sees with 'keys' -> 'show'
+		fmt.Println("Key fingerprint of '" + name + "': " + fingerprint(key))
+		if same, _ := keys.pin(name, key, false); same {
+			return
+		}
+		fmt.Print("The key has changed since you saw it last. Trust the new key? (y/n): ")
+		if readLine() == "y" {
+			if _, err := keys.pin(name, key, true); err != nil {
+				fmt.Println(err)
+			}
+		}
+	default:
+		fmt.Println("Invalid action.")
+	}
+}
+
+// sealMessage - encrypt message if recipient has a key (the key is pinned on first use)
+func (cl *Client) sealMessage(keys *e2eKeys, to, text string) (string, error) {
+
+	key := cl.request(protocol.ScmdGetPublicKey, to, "")
+	if !validPublicKey(key) {
+		fmt.Println("Not encrypted: " + key)
+		return text, nil
+	}
+
+	same, err := keys.pin(to, key, false)
+	if err != nil {
+		return "", err
+	}
+	if !same {
+		return "", errors.New("Key of '" + to + "' has changed, check it with 'keys' -> 'verify'. Message is not sent.")
+	}
+
+	return keys.seal(to, key, text)
+}
+
+// keys - encryption keys of user (nil if they can't be read)
+func (cl *Client) keys(name string) *e2eKeys {
+
+	cl.keysMutex.Lock()
+	defer cl.keysMutex.Unlock()
+
+	if keys, ok := cl.keyrings[name]; ok {
+		return keys
+	}
+	keys, err := loadE2EKeys(cl.keyDir, name)
+	if err != nil {
+		fmt.Println("Can't read encryption keys: " + err.Error())
+		return nil
+	}
+	cl.keyrings[name] = keys
+
+	return keys
+}
+
+// messageText - text of received message (encrypted one is decrypted)
+func (cl *Client) messageText(from, text string) string {
+
+	if !strings.HasPrefix(text, protocol.EncryptedPrefix) {
+		return text
+	}
+
+	keys := cl.keys(cl.userNickName)
+	if keys == nil {
+		return "[encrypted message]"
+	}
+	plain, err := keys.open(from, text)
+	if err != nil {
+		return "[encrypted message: " + err.Error() + "]"
+	}
+
+	return "[encrypted] " + plain
+}
+
+// handleRoster
+func (cl *Client) handleRoster() {
+
+	// check authorization
+	if cl.userNickName == "" {
+		fmt.Println("You are not logged.")
+		return
+	}
+
+	// contacts are printed by sendRequest
+	cl.sendRequest(protocol.ScmdGetRoster, "", "")
+}
+
+// sendUserRequest - ask user name and send request about the user
+func (cl *Client) sendUserRequest(command protocol.CommandToServer) {
+
+	// check authorization
+	if cl.userNickName == "" {
+		fmt.Println("You are not logged.")
+		return
+	}
+
+	// get user name
+	fmt.Print("user: ")
+	nickName := readLine()
+
+	// send request to server
+
+	cl.sendRequest(command, nickName, "")
+}
+
+// handlePrivacy
+func (cl *Client) handlePrivacy() {
+
+	// check authorization
+	if cl.userNickName == "" {
+		fmt.Println("You are not logged.")
+		return
+	}
+
+	// show current settings (printed by sendRequest)
+	cl.sendRequest(protocol.ScmdGetPrivacy, "", "")
+
+	// get option
+	fmt.Print("option to change (" + protocol.PrivacyHidePresence + ", " + protocol.PrivacyContactsOnly + ", " +
+		protocol.PrivacyBlockReply + "; empty - none): ")
+	option := readLine()
+	if option == "" {
 		return
 	}
+
+	fmt.Print("value (on, off; text for " + protocol.PrivacyBlockReply + "): ")
+	value := readLine()
+
+	// send request to server
+
+	cl.sendRequest(protocol.ScmdSetPrivacy, option, value)
+}
+
+// handleProfile
+func (cl *Client) handleProfile() {
+
+	// check authorization
+	if cl.userNickName == "" {
+		fmt.Println("You are not logged.")
+		return
+	}
+
+	// show profile (printed by sendRequest)
+	fmt.Print("user (empty - you): ")
+	nickName := readLine()
+	cl.sendRequest(protocol.ScmdGetProfile, nickName, "")
+	if nickName != "" && nickName != cl.userNickName {
+		return
+	}
+
+	// get field
+	fmt.Print("field to change (" + protocol.ProfileDisplayName + ", " + protocol.ProfileStatus + ", " +
+		protocol.ProfileBio + ", " + protocol.ProfileTimezone + ", " + protocol.ProfileAvatar + "; empty - none): ")
+	field := readLine()
+	if field == "" {
+		return
+	}
+
+	value := ""
+	if field == protocol.ProfileAvatar {
+		// avatar is sent as base64 of image file
+		fmt.Print("image file (empty - remove avatar): ")
+		if fileName := readLine(); fileName != "" {
+			data, err := os.ReadFile(fileName)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			value = base64.StdEncoding.EncodeToString(data)
+		}
+	} else {
+		fmt.Print("value: ")
+		value = readLine()
+	}
+
+	// send request to server
+
+	cl.sendRequest(protocol.ScmdSetProfile, field, value)
+}
+
+// moderationCommands - 'moderate' actions
+var moderationCommands = map[string]protocol.CommandToServer{
+	"kick":    protocol.ScmdKick,
+	"ban":     protocol.ScmdBan,
+	"unban":   protocol.ScmdUnban,
+	"banip":   protocol.ScmdBanIP,
+	"unbanip": protocol.ScmdUnbanIP,
+	"mute":    protocol.ScmdMute,
+	"unmute":  protocol.ScmdUnmute,
+}
+
+// handleModerate
+func (cl *Client) handleModerate() {
+
+	// check authorization
+	if cl.userNickName == "" {
+		fmt.Println("You are not logged.")
+		return
+	}
+
+	// get action
+	fmt.Print("action (kick, ban, unban, banip, unbanip, mute, unmute): ")
+	action := readLine()
+	command, ok := moderationCommands[action]
+	if !ok {
+		fmt.Println("Invalid action.")
+		return
+	}
+
+	// get user name or address
+	fmt.Print("user (or IP address): ")
+	target := readLine()
+
+	data2 := ""
+	switch command {
+	case protocol.ScmdBan, protocol.ScmdBanIP, protocol.ScmdMute:
+		fmt.Print("duration (i.e. 30m, 24h; 0 - forever): ")
+		duration := readLine()
+		fmt.Print("reason: ")
+		data2 = duration + " " + readLine()
+	case protocol.ScmdKick:
+		fmt.Print("reason: ")
+		data2 = readLine()
+	}
+
+	// send request to server
+
+	cl.sendRequest(command, target, data2)
+}
+
+// handleNickname
+func (cl *Client) handleNickname() {
+
+	// check authorization
+	if cl.userNickName == "" {
+		fmt.Println("You are not logged.")
+		return
+	}
+
+	// get new nickname
+	fmt.Print("new nickname: ")
+	nickName := readLine()
+
+	// send request to server
+
+	if cl.sendRequest(protocol.ScmdChangeNickname, nickName, "") == "ok" {
+		cl.userNickName = nickName
+	}
+}
+
+// handleDeleteAccount
+func (cl *Client) handleDeleteAccount() {
+
+	// check authorization
+	if cl.userNickName == "" {
+		fmt.Println("You are not logged.")
+		return
+	}
+
+	//
+	// confirm with password
+	//
+	fmt.Print("Delete account '" + cl.userNickName + "'? Enter password to confirm: ")
+	bytePassword, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		cl.logger.Error("can't read password", "err", err)
+		os.Exit(1)
+	}
+
+	// send request to server
+
+	if cl.sendRequest(protocol.ScmdDeleteAccount, string(bytePassword), "") == "ok" {
+		fmt.Println("Account '" + cl.userNickName + "' is deleted.")
+		cl.userNickName = ""
+	}
 }
 
 // sendRequest
 func (cl *Client) sendRequest(command protocol.CommandToServer, data1, data2 string) string {
 
+	responseStr := cl.request(command, data1, data2)
+
+	if responseStr != "ok" {
+		fmt.Println(responseStr)
+	}
+
+	return responseStr
+}
+
+// request - send request and wait response (response is not printed)
+func (cl *Client) request(command protocol.CommandToServer, data1, data2 string) string {
+
 	// make requests json string
 	requestData := protocol.Request{Command: command, Data1: data1, Data2: data2}
 	requestStr := requestData.Encode()
 
 	// send to server
 	fmt.Fprintln(cl.conn, requestStr)
-	if Debug {
-		log.Println("requestJson: " + requestStr)
-	}
+	cl.logger.Debug("request", "request", requestData)
 
 	// wait response
-	responseStr := <-cl.responseChannel
-
-	if responseStr != "ok" {
-		fmt.Println(responseStr)
-	}
-
-	return responseStr
+	return <-cl.responseChannel
 }
 
 // readLine from stdin
@@ -351,13 +883,11 @@ func (cl *Client) readRoutine() {
 				time.Sleep(10000000) // 0.01 sec
 				continue
 			}
-			log.Println("read err: " + err.Error())
+			cl.logger.Error("read failed", "err", err)
 			return
 		}
 
-		if Debug {
-			log.Print("   responseStr: " + responseStr)
-		}
+		cl.logger.Debug("response", "response", strings.TrimSpace(responseStr))
 
 		msg := protocol.MessageFromServer{}
 		if err := msg.Decode(responseStr); err != nil {
@@ -368,11 +898,28 @@ func (cl *Client) readRoutine() {
 		switch msg.Type {
 
 		case protocol.Reply:
+			if msg.ServerReply() == protocol.ReplyRateLimited {
+				(cl.responseChannel) <- "Too many requests. Try again in " + msg.RetryAfter() + " sec."
+				continue
+			}
 			(cl.responseChannel) <- msg.ServerReply()
 
 		case protocol.MessageFrom:
-			// print message to stdout
-			fmt.Println("\n\nMessage from '" + msg.SenderNickname() + "':\n" + msg.MessageText())
+			// print message to stdout (nickname identifies sender, display name is optional)
+			sender := "'" + msg.SenderNickname() + "'"
+			if name := msg.SenderDisplayName(); name != "" && name != msg.SenderNickname() {
+				sender = name + " (" + sender + ")"
+			}
+			fmt.Println("\n\nMessage from " + sender + ":\n" + cl.messageText(msg.SenderNickname(), msg.MessageText()))
+
+			// print new line
+			fmt.Print(cl.userNickName + "#")
+
+		case protocol.Notice:
+			fmt.Println("\n\nServer: " + msg.NoticeText())
+			if msg.NoticeCode() == protocol.NoticeLoggedIn {
+				cl.loginChannel <- msg.NoticeNickname()
+			}
 
 			// print new line
 			fmt.Print(cl.userNickName + "#")
@@ -380,6 +927,9 @@ func (cl *Client) readRoutine() {
 	}
 }
 
+// Server address prefix to connect with TLS
+const constTLSPrefix = "tls://"
+
 // Commands
 const (
 	cmdEXIT     = "exit"
@@ -390,6 +940,19 @@ const (
 	cmdLIST     = "list"
 	cmdMESSAGE  = "send"
 	cmdPASSWORD = "password"
+	cmdROLE     = "role"
+	cmdMODERATE = "moderate"
+	cmdBLOCK    = "block"
+	cmdUNBLOCK  = "unblock"
+	cmdCONTACT  = "contact"
+	cmdPRIVACY  = "privacy"
+	cmdROSTER   = "roster"
+	cmdPROFILE  = "profile"
+	cmdNICKNAME = "nickname"
+	cmdDELETE   = "delete"
+	cmd2FA      = "2fa"
+	cmdTOKEN    = "token"
+	cmdKEYS     = "keys"
 )
 
 // Text constants
@@ -401,5 +964,18 @@ const txtHELP = "" +
 	"  '" + cmdLIST + "' - get a list of online users\n" +
 	"  '" + cmdMESSAGE + "' - send a message to some user\n" +
 	"  '" + cmdPASSWORD + "' - change password\n" +
+	"  '" + cmdBLOCK + "' - block messages from some user\n" +
+	"  '" + cmdUNBLOCK + "' - unblock some user\n" +
+	"  '" + cmdCONTACT + "' - send, accept or decline contact request, remove contact\n" +
+	"  '" + cmdROSTER + "' - show contacts and requests\n" +
+	"  '" + cmdPROFILE + "' - show user profile or change yours\n" +
+	"  '" + cmdNICKNAME + "' - change your nickname\n" +
+	"  '" + cmdDELETE + "' - delete your account\n" +
+	"  '" + cmd2FA + "' - set up or disable two-factor authentication\n" +
+	"  '" + cmdTOKEN + "' - create, list or revoke API tokens for bots and scripts\n" +
+	"  '" + cmdKEYS + "' - end-to-end encryption keys: generate, show, verify\n" +
+	"  '" + cmdPRIVACY + "' - show and change privacy options\n" +
+	"  '" + cmdROLE + "' - promote/demote user (admins only)\n" +
+	"  '" + cmdMODERATE + "' - kick, ban, mute user or ban address (moderators only)\n" +
 	"  '" + cmdEXIT + "' - quit from this messager\n" +
 	"  '" + cmdHELP + "' - display this help text\n"
@@ -0,0 +1,264 @@
+package client
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// info string of message key derivation
+const constE2EInfo = "messenger e2e v1"
+
+// e2eKeys - end-to-end encryption keys of one user: own X25519 key pair and
+// public keys of other users pinned on first use (trust on first use)
+type e2eKeys struct {
+	// '<name>.key' - own private key, '<name>.known' - pinned keys
+	dir  string
+	name string
+
+	private *ecdh.PrivateKey
+	// nickname -> base64 public key
+	known map[string]string
+	mutex sync.Mutex
+}
+
+// loadE2EKeys - read keys of user (private key is nil if it's not generated yet)
+func loadE2EKeys(dir, name string) (*e2eKeys, error) {
+
+	k := &e2eKeys{dir: dir, name: name, known: make(map[string]string)}
+
+	data, err := os.ReadFile(k.file(".key"))
+	if err == nil {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, errors.New("Invalid key file '" + k.file(".key") + "'")
+		}
+		if k.private, err = ecdh.X25519().NewPrivateKey(raw); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	data, err = os.ReadFile(k.file(".known"))
+	if err == nil {
+		if err := json.Unmarshal(data, &k.known); err != nil {
+			return nil, errors.New("Invalid known keys file '" + k.file(".known") + "'")
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// file - key file name
+func (k *e2eKeys) file(ext string) string {
+	return filepath.Join(k.dir, k.name+ext)
+}
+
+// generate - new key pair (the old one is replaced)
+func (k *e2eKeys) generate() error {
+
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(k.dir, 0700); err != nil {
+		return err
+	}
+	data := base64.StdEncoding.EncodeToString(private.Bytes()) + "\n"
+	if err := os.WriteFile(k.file(".key"), []byte(data), 0600); err != nil {
+		return err
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.private = private
+
+	return nil
+}
+
+// publicKey - own public key (base64; "" - no key)
+func (k *e2eKeys) publicKey() string {
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.private == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(k.private.PublicKey().Bytes())
+}
+
+// pin - remember public key of user; returns false if another key is pinned
+// ('replace' - accept changed key after verification)
+func (k *e2eKeys) pin(name, key string, replace bool) (bool, error) {
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if known, ok := k.known[name]; ok && (known == key || !replace) {
+		return known == key, nil
+	}
+	k.known[name] = key
+
+	data, _ := json.MarshalIndent(k.known, "", "  ")
+	if err := os.MkdirAll(k.dir, 0700); err != nil {
+		return true, err
+	}
+
+	return true, os.WriteFile(k.file(".known"), data, 0600)
+}
+
+// defaultKeyDir - user config directory ("messenger" in it)
+func defaultKeyDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "messenger-keys"
+	}
+	return filepath.Join(dir, "messenger")
+}
+
+// validPublicKey - reply to GetPublicKey is a key (not an error)
+func validPublicKey(key string) bool {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(raw) == 32
+}
+
+// fingerprint - public key fingerprint to compare out of band
+// (first 20 bytes of SHA-256 in groups of 4 hex digits)
+func fingerprint(key string) string {
+
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "invalid key"
+	}
+	sum := sha256.Sum256(raw)
+	digits := hex.EncodeToString(sum[:20])
+
+	groups := []string{}
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+
+	return strings.Join(groups, " ")
+}
+
+// messageAEAD - cipher of messages between the key pair (the key is bound to
+// both public keys, the names are authenticated as additional data)
+func messageAEAD(private *ecdh.PrivateKey, peer []byte, senderKey, recipientKey []byte) (cipher.AEAD, error) {
+
+	public, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := private.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+
+	info := append([]byte(constE2EInfo), senderKey...)
+	info = append(info, recipientKey...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, nil, info), key); err != nil {
+		return nil, err
+	}
+
+	return chacha20poly1305.NewX(key)
+}
+
+// additionalData - sender and recipient names
+func additionalData(from, to string) []byte {
+	return []byte(from + "\x00" + to)
+}
+
+// seal - encrypt message from this user to 'to' with recipient's public key
+func (k *e2eKeys) seal(to, recipientKey, text string) (string, error) {
+
+	k.mutex.Lock()
+	private := k.private
+	k.mutex.Unlock()
+	if private == nil {
+		return "", errors.New("No key, use 'keys' -> 'generate'")
+	}
+
+	peer, err := base64.StdEncoding.DecodeString(recipientKey)
+	if err != nil {
+		return "", err
+	}
+	own := private.PublicKey().Bytes()
+	aead, err := messageAEAD(private, peer, own, peer)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(text), additionalData(k.name, to))
+
+	return protocol.EncryptedPrefix + base64.StdEncoding.EncodeToString(own) + ":" +
+		base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open - decrypt message from 'from'; the sender key in the message must be
+// the pinned one (it's pinned if the sender is new)
+func (k *e2eKeys) open(from, message string) (string, error) {
+
+	k.mutex.Lock()
+	private := k.private
+	k.mutex.Unlock()
+	if private == nil {
+		return "", errors.New("no key to decrypt")
+	}
+
+	senderKey, sealed, ok := strings.Cut(strings.TrimPrefix(message, protocol.EncryptedPrefix), ":")
+	if !ok {
+		return "", errors.New("invalid encrypted message")
+	}
+	peer, err1 := base64.StdEncoding.DecodeString(senderKey)
+	data, err2 := base64.StdEncoding.DecodeString(sealed)
+	if err1 != nil || err2 != nil {
+		return "", errors.New("invalid encrypted message")
+	}
+
+	aead, err := messageAEAD(private, peer, peer, private.PublicKey().Bytes())
+	if err != nil {
+		return "", err
+	}
+	if len(data) < aead.NonceSize() {
+		return "", errors.New("invalid encrypted message")
+	}
+	text, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], additionalData(from, k.name))
+	if err != nil {
+		return "", errors.New("message can't be decrypted")
+	}
+
+	// only a message that decrypts pins the sender key
+	same, err := k.pin(from, senderKey, false)
+	if err != nil {
+		return "", err
+	}
+	if !same {
+		return "", errors.New("key of '" + from + "' has changed (fingerprint " + fingerprint(senderKey) + "), check it with 'keys' -> 'verify'")
+	}
+
+	return string(text), nil
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestE2EEncryption(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "messenger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := map[string]*e2eKeys{}
+	for _, name := range []string{"alice", "bob", "mallory"} {
+		if keys[name], err = loadE2EKeys(dir, name); err != nil {
+			t.Fatal(err)
+		}
+		if err := keys[name].generate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sealed, err := keys["alice"].seal("bob", keys["bob"].publicKey(), "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, protocol.EncryptedPrefix) || strings.Contains(sealed, "hello") {
+		t.Fatal("Invalid sealed message: ", sealed)
+	}
+
+	// the key is read back from file
+	bob, err := loadE2EKeys(dir, "bob")
+	if err != nil || bob.publicKey() != keys["bob"].publicKey() {
+		t.Fatal("Key is not saved: ", err)
+	}
+	if text, err := bob.open("alice", sealed); err != nil || text != "hello" {
+		t.Fatal(text, err)
+	}
+
+	// other recipient, other claimed sender, modified ciphertext
+	if _, err := keys["mallory"].open("alice", sealed); err == nil {
+		t.Error("Decrypted by another user")
+	}
+	if _, err := bob.open("carol", sealed); err == nil {
+		t.Error("Decrypted with wrong sender")
+	}
+	tampered := sealed[:len(sealed)-4] + "AAA="
+	if _, err := bob.open("alice", tampered); err == nil {
+		t.Error("Decrypted modified message")
+	}
+
+	// a new key of known sender is reported
+	if err := keys["alice"].generate(); err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ = keys["alice"].seal("bob", bob.publicKey(), "new key")
+	if _, err := bob.open("alice", sealed); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Error("Expected key change error: ", err)
+	}
+	if _, err := bob.pin("alice", keys["alice"].publicKey(), true); err != nil {
+		t.Fatal(err)
+	}
+	if text, err := bob.open("alice", sealed); err != nil || text != "new key" {
+		t.Error(text, err)
+	}
+
+	if fp := fingerprint(bob.publicKey()); len(strings.Fields(fp)) != 10 || fp != fingerprint(keys["bob"].publicKey()) {
+		t.Error("Invalid fingerprint: ", fp)
+	}
+}
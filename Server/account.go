@@ -0,0 +1,67 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"errors"
+)
+
+// renameSessions - update sessions of renamed user and notify online contacts
+func (srv *Server) renameSessions(name, newName string) {
+
+	for _, s := range srv.sessionList() {
+		if s.user() == name {
+			s.setUser(newName)
+		}
+	}
+
+	p, _ := srv.localDb.GetPrivacy(newName)
+	for _, contact := range p.Contacts {
+		srv.notifyUser(contact, protocol.NoticeNicknameChanged, "User '"+name+"' is '"+newName+"' now")
+	}
+}
+
+// handleChangeNickname - ChangeNickname
+func (srv *Server) handleChangeNickname(s *session, rqst protocol.Request) (string, error) {
+
+	name, newName := s.userName, normalizeNickname(rqst.Data1)
+	if err := srv.nicknamePolicy().check(newName); err != nil {
+		return "", err
+	}
+	// external backends know the user by the old name
+	if source, ok := srv.localDb.GetAuthSource(name); ok && source != AuthLocal {
+		return "", errors.New("Nickname is managed by " + source + " authentication")
+	}
+
+	if err := srv.localDb.RenameUser(name, newName); err != nil {
+		return "", err
+	}
+	s.setUser(newName)
+	srv.renameSessions(name, newName)
+
+	s.logger.Info("nickname changed", "name", name, "new_name", newName)
+	return "ok", nil
+}
+
+// handleDeleteAccount - DeleteAccount
+func (srv *Server) handleDeleteAccount(s *session, rqst protocol.Request) (string, error) {
+
+	name := s.userName
+
+	// password guessing is limited like login
+	if locked, retryAfter := srv.limiter.lockedOut(name, s.ip); locked {
+		return "", &rateLimitedError{retryAfter}
+	}
+	if _, err := srv.authenticate(name, rqst.Data1); err != nil {
+		srv.limiter.loginFailed(name, s.ip)
+		return "", err
+	}
+
+	// the user stays logged in if the account can't be deleted
+	if err := srv.localDb.DeleteLoggedInUser(name); err != nil {
+		return "", err
+	}
+	s.logout()
+
+	s.logger.Info("account deleted", "name", name)
+	return "ok", nil
+}
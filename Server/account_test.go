@@ -0,0 +1,74 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"testing"
+)
+
+func TestAccount(t *testing.T) {
+
+	srv := newTestServer(t, "a", "b", "c")
+	clients := map[string]*testClient{}
+	for _, name := range []string{"a", "b", "c"} {
+		clients[name] = newTestClient(t, srv, name)
+	}
+	request := func(user string, command protocol.CommandToServer, data1 string) string {
+		return clients[user].request(command, data1, "")
+	}
+
+	request("a", protocol.ScmdAddContact, "b")
+	request("b", protocol.ScmdAcceptContact, "a")
+	request("c", protocol.ScmdBlock, "a")
+
+	// rename
+	for _, bad := range []string{"", "b", "with space"} {
+		if reply := request("a", protocol.ScmdChangeNickname, bad); reply == "ok" {
+			t.Errorf("Expected error for nickname %q", bad)
+		}
+	}
+	if reply := request("a", protocol.ScmdChangeNickname, "z"); reply != "ok" {
+		t.Fatal(reply)
+	}
+	if clients["a"].user() != "z" || srv.localDb.DoesUserExist("a") || !srv.localDb.DoesUserExist("z") {
+		t.Error("User is not renamed")
+	}
+	if p, _ := srv.localDb.GetPrivacy("b"); len(p.Contacts) != 1 || p.Contacts[0] != "z" {
+		t.Error("Contacts are not updated: ", p.Contacts)
+	}
+	if p, _ := srv.localDb.GetPrivacy("c"); len(p.Blocked) != 1 || p.Blocked[0] != "z" {
+		t.Error("Block list is not updated: ", p.Blocked)
+	}
+
+	// external user keeps the name of its backend
+	srv.localDb.ProvisionUser("d", AuthHtpasswd)
+	if reply := newTestClient(t, srv, "d").request(protocol.ScmdChangeNickname, "e", ""); reply != "Nickname is managed by htpasswd authentication" {
+		t.Error("Expected external user error: ", reply)
+	}
+	if !srv.localDb.DoesUserExist("d") || srv.localDb.DoesUserExist("e") {
+		t.Error("External user is renamed")
+	}
+
+	// delete (online user gets the reply)
+	if err := srv.localDb.GoOnline("b", clients["b"].conn); err != nil {
+		t.Fatal(err)
+	}
+	if reply := request("b", protocol.ScmdDeleteAccount, "wrong-password"); reply == "ok" {
+		t.Error("Expected password error")
+	}
+	if !srv.localDb.DoesUserExist("b") || clients["b"].user() != "b" {
+		t.Error("User is logged out by failed deletion")
+	}
+	clients["b"].pendingLogin = "b"
+	if reply := request("b", protocol.ScmdDeleteAccount, constTestPassword); reply != "ok" {
+		t.Fatal(reply)
+	}
+	if srv.localDb.DoesUserExist("b") || clients["b"].user() != "" {
+		t.Error("User is not deleted")
+	}
+	if id, scopes := clients["b"].token(); id != "" || scopes != nil || clients["b"].pendingLogin != "" {
+		t.Error("Session state of deleted user is kept: ", id, scopes, clients["b"].pendingLogin)
+	}
+	if p, _ := srv.localDb.GetPrivacy("z"); len(p.Contacts) != 0 {
+		t.Error("Deleted user is still in contacts: ", p.Contacts)
+	}
+}
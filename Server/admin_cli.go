@@ -0,0 +1,445 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// adminCommand - admin CLI command working on the storage
+// (directly or through admin socket of running server)
+type adminCommand struct {
+	// arguments (for usage)
+	args  string
+	nArgs int
+	help  string
+	// password is asked before running command and passed as the last argument
+	passwordPrompt string
+	run            func(cli *adminCLI, args []string) error
+}
+
+// nSecrets - number of arguments added by password prompt
+func (c *adminCommand) nSecrets() int {
+	if c.passwordPrompt != "" {
+		return 1
+	}
+	return 0
+}
+
+// adminCommands - admin CLI commands by "<group> <command>"
+var adminCommands = map[string]adminCommand{
+	"user add":          {"<name>", 1, "register new user (asks for password)", "Enter password: ", (*adminCLI).userAdd},
+	"user del":          {"<name>", 1, "delete user", "", (*adminCLI).userDel},
+	"user passwd":       {"<name>", 1, "set user password (asks for password)", "Enter new password: ", (*adminCLI).userPasswd},
+	"user list":         {"", 0, "list registered users", "", (*adminCLI).userList},
+	"user role":         {"<name> <role>", 2, "set user role (user, moderator, admin)", "", (*adminCLI).userRole},
+	"user rename":       {"<name> <new name>", 2, "change user nickname", "", (*adminCLI).userRename},
+	"user 2fa-off":      {"<name>", 1, "turn off two-factor authentication (lost device)", "", (*adminCLI).user2FAOff},
+	"user tokens":       {"<name>", 1, "list API tokens of user", "", (*adminCLI).userTokens},
+	"user token-revoke": {"<name> <token ID or name>", 2, "revoke API token of user", "", (*adminCLI).userTokenRevoke},
+	"db check":          {"", 0, "check database consistency", "", (*adminCLI).dbCheck},
+	"db rekey":          {"<new key file|none>", 1, "re-encrypt database with new storage key", "", (*adminCLI).dbRekey},
+	"db backup":         {"<file>", 1, "write snapshot of database (encrypted with storage key)", "", (*adminCLI).dbBackup},
+	"db restore":        {"<file>", 1, "restore backup or export into empty database", "", (*adminCLI).dbRestore},
+	"db export":         {"<file>", 1, "write database in portable JSON format", "", (*adminCLI).dbExport},
+	"db import":         {"<file>", 1, "add users from backup or export", "", (*adminCLI).dbImport},
+	"ban list":          {"", 0, "list active bans and mutes", "", (*adminCLI).banList},
+}
+
+// adminFileCommands - commands with file argument (it's made absolute:
+// running server may have another working directory)
+var adminFileCommands = map[string]bool{
+	"db rekey":   true,
+	"db backup":  true,
+	"db restore": true,
+	"db export":  true,
+	"db import":  true,
+}
+
+// adminCLI - admin CLI state
+type adminCLI struct {
+	db     LocalDbInterface
+	stdin  io.Reader
+	reader *bufio.Reader
+	stdout io.Writer
+
+	// nickname policy (reserved names are allowed for admin)
+	nicknames NicknamePolicy
+	passwords *passwordChecker
+}
+
+// IsAdminCommand - check that 'group' is admin command group ("user", "db")
+func IsAdminCommand(group string) bool {
+	for name := range adminCommands {
+		if strings.HasPrefix(name, group+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// RunAdminCommand - run admin command, i.e. ["user", "add", "-storage-file", "db.json", "alice"].
+// Config flags go between command and its arguments. Returns process exit code.
+func RunAdminCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+
+	if len(args) < 2 {
+		AdminUsage(stderr)
+		return 2
+	}
+
+	name := args[0] + " " + args[1]
+	command, ok := adminCommands[name]
+	if !ok {
+		fmt.Fprintln(stderr, "Unknown command '"+name+"'")
+		AdminUsage(stderr)
+		return 2
+	}
+
+	cfg, commandArgs, _, err := parseConfig(args[2:])
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if len(commandArgs) != command.nArgs {
+		fmt.Fprintln(stderr, "Usage: "+name+" [flags] "+command.args)
+		return 2
+	}
+	if adminFileCommands[name] && !(name == "db rekey" && commandArgs[0] == "none") {
+		if abs, err := filepath.Abs(commandArgs[0]); err == nil {
+			commandArgs[0] = abs
+		}
+	}
+
+	if cfg.Storage.Backend != StorageFile {
+		fmt.Fprintln(stderr, "Admin commands need '"+StorageFile+"' storage backend")
+		return 2
+	}
+
+	cli := &adminCLI{stdin: stdin, reader: bufio.NewReader(stdin), stdout: stdout, nicknames: adminNicknamePolicy(cfg.Nickname),
+		passwords: newPasswordChecker(cfg.Password)}
+
+	if command.passwordPrompt != "" {
+		password, err := cli.readPassword(command.passwordPrompt)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		commandArgs = append(commandArgs, string(password))
+	}
+
+	// open storage (fails while the server is running)
+	logger := slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	db := NewLocalDb(cfg.Storage.File, logger)
+	key, err := readStorageKey(cfg.Storage)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	db.SetKey(key)
+	if err := db.Init(); err != nil {
+		var locked *DbLockedError
+		if !errors.As(err, &locked) {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+
+		// let running server do it
+		if cfg.Admin.Socket == "" {
+			fmt.Fprintln(stderr, err.Error()+". Stop the server or enable its admin socket.")
+			return 1
+		}
+		reply, err := sendAdminRequest(cfg.Admin.Socket, AdminRequest{Command: name, Args: commandArgs})
+		if err != nil {
+			fmt.Fprintln(stderr, locked.Error()+" and its admin socket failed: "+err.Error())
+			return 1
+		}
+		return printAdminReply(reply, stdout, stderr)
+	}
+	defer db.Close()
+
+	cli.db = db
+	err = cli.passwords.load()
+	if err == nil {
+		err = command.run(cli, commandArgs)
+	}
+
+	if !readOnlyAdminCommands[name] {
+		audit := newAuditLog(cfg.Audit)
+		if err := audit.write(adminAuditEvent("admin-cli", name, commandArgs, err)); err != nil {
+			fmt.Fprintln(stderr, "Audit log: "+err.Error())
+		}
+		audit.close()
+	}
+
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+// AdminUsage - print admin commands
+func AdminUsage(w io.Writer) {
+
+	names := []string{}
+	for name := range adminCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "Admin commands (config flags go before arguments):")
+	for _, name := range names {
+		c := adminCommands[name]
+		fmt.Fprintf(w, "  %-28s %s\n", name+" [flags] "+c.args, c.help)
+	}
+}
+
+// readPassword - read password from terminal without echo (or a line from non-terminal stdin)
+func (cli *adminCLI) readPassword(prompt string) ([]byte, error) {
+
+	if f, ok := cli.stdin.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
+		fmt.Fprint(cli.stdout, prompt)
+		password, err := terminal.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(cli.stdout, "")
+		return password, err
+	}
+
+	line, err := cli.reader.ReadString('\n')
+	if err != nil && line == "" {
+		return nil, errors.New("No password")
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+// adminNicknamePolicy - nickname policy for admin commands
+func adminNicknamePolicy(policy NicknamePolicy) NicknamePolicy {
+	policy.Reserved = nil
+	return policy
+}
+
+// userAdd - user add <name> <password>
+func (cli *adminCLI) userAdd(args []string) error {
+
+	name := normalizeNickname(args[0])
+	if err := cli.nicknames.check(name); err != nil {
+		return err
+	}
+	if err := cli.passwords.addUser(cli.db, name, args[1]); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cli.stdout, "User '"+name+"' added")
+	return nil
+}
+
+// userDel - user del <name>
+func (cli *adminCLI) userDel(args []string) error {
+
+	if err := cli.db.DeleteUser(args[0]); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cli.stdout, "User '"+args[0]+"' deleted")
+	return nil
+}
+
+// userPasswd - user passwd <name> <password>
+func (cli *adminCLI) userPasswd(args []string) error {
+
+	if err := cli.passwords.setPassword(cli.db, args[0], args[1]); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cli.stdout, "Password of '"+args[0]+"' changed")
+	return nil
+}
+
+// userList - user list
+func (cli *adminCLI) userList(args []string) error {
+	for _, name := range cli.db.GetUserList() {
+		if role := cli.db.GetRole(name); role != protocol.RoleUser {
+			name += " (" + role + ")"
+		}
+		fmt.Fprintln(cli.stdout, name)
+	}
+	return nil
+}
+
+// userRole - user role <name> <role>
+func (cli *adminCLI) userRole(args []string) error {
+
+	if !validRole(args[1]) {
+		return errors.New("Invalid role '" + args[1] + "'")
+	}
+
+	if err := cli.db.SetRole(args[0], args[1]); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cli.stdout, "User '"+args[0]+"' is "+args[1]+" now")
+	return nil
+}
+
+// banList - ban list
+func (cli *adminCLI) banList(args []string) error {
+	for _, e := range cli.db.GetRestrictionList() {
+		fmt.Fprintln(cli.stdout, e.Kind+" "+e.Target+" "+e.describe()+" (by "+e.By+")")
+	}
+	return nil
+}
+
+// userRename - user rename <name> <new name>
+func (cli *adminCLI) userRename(args []string) error {
+
+	newName := normalizeNickname(args[1])
+	if err := cli.nicknames.check(newName); err != nil {
+		return err
+	}
+	// external backends know the user by the old name
+	if source, ok := cli.db.GetAuthSource(args[0]); ok && source != AuthLocal {
+		return errors.New("Nickname is managed by " + source + " authentication")
+	}
+	if err := cli.db.RenameUser(args[0], newName); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cli.stdout, "User '"+args[0]+"' is '"+newName+"' now")
+	return nil
+}
+
+// user2FAOff - user 2fa-off <name>
+func (cli *adminCLI) user2FAOff(args []string) error {
+
+	if err := cli.db.UpdateTOTP(args[0], func(t *TOTP) (*TOTP, error) { return nil, nil }); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cli.stdout, "Two-factor authentication of '"+args[0]+"' is off")
+	return nil
+}
+
+// userTokens - user tokens <name>
+func (cli *adminCLI) userTokens(args []string) error {
+
+	if !cli.db.DoesUserExist(args[0]) {
+		return errors.New("User '" + args[0] + "' does not exist")
+	}
+
+	for _, t := range cli.db.GetTokens(args[0]) {
+		fmt.Fprintln(cli.stdout, t.describe())
+	}
+	return nil
+}
+
+// userTokenRevoke - user token-revoke <name> <token ID or name>
+func (cli *adminCLI) userTokenRevoke(args []string) error {
+
+	id, err := revokeToken(cli.db, args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cli.stdout, "Token '"+id+"' of '"+args[0]+"' is revoked")
+	return nil
+}
+
+// dbRekey - db rekey <new key file|none>
+func (cli *adminCLI) dbRekey(args []string) error {
+
+	var key []byte
+	if args[0] != "none" {
+		var err error
+		if key, err = readStorageKey(StorageConfig{KeyFile: args[0]}); err != nil {
+			return err
+		}
+	}
+
+	if err := cli.db.Rekey(key); err != nil {
+		return err
+	}
+
+	if key == nil {
+		fmt.Fprintln(cli.stdout, "Database is not encrypted now")
+	} else {
+		fmt.Fprintln(cli.stdout, "Database is encrypted with key "+storageKeyID(key))
+	}
+	return nil
+}
+
+// dbBackup - db backup <file>
+func (cli *adminCLI) dbBackup(args []string) error {
+
+	n, err := cli.db.Backup(args[0], true)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cli.stdout, "Backup of "+strconv.Itoa(n)+" users is written to '"+args[0]+"'")
+	return nil
+}
+
+// dbExport - db export <file>
+func (cli *adminCLI) dbExport(args []string) error {
+
+	n, err := cli.db.Backup(args[0], false)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cli.stdout, strconv.Itoa(n)+" users are exported to '"+args[0]+"' (not encrypted, keep it safe)")
+	return nil
+}
+
+// dbRestore - db restore <file>
+func (cli *adminCLI) dbRestore(args []string) error {
+
+	n, err := cli.db.Restore(args[0], false)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cli.stdout, strconv.Itoa(n)+" users are restored from '"+args[0]+"'")
+	return nil
+}
+
+// dbImport - db import <file>
+func (cli *adminCLI) dbImport(args []string) error {
+
+	n, err := cli.db.Restore(args[0], true)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(cli.stdout, strconv.Itoa(n)+" users are imported from '"+args[0]+"'")
+	return nil
+}
+
+// dbCheck - db check
+func (cli *adminCLI) dbCheck(args []string) error {
+
+	problems := cli.db.Check()
+	if err := cli.db.CheckWritable(); err != nil {
+		problems = append(problems, "Database is not writable: "+err.Error())
+	}
+
+	for _, p := range problems {
+		fmt.Fprintln(cli.stdout, p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problem(s) found", len(problems))
+	}
+
+	fmt.Fprintf(cli.stdout, "ok (%d users)\n", len(cli.db.GetUserList()))
+	return nil
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminCommands(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "messenger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "db.json")
+	audit := filepath.Join(dir, "audit.log")
+
+	run := func(stdin string, args ...string) (int, string) {
+		var out bytes.Buffer
+		code := RunAdminCommand(args, strings.NewReader(stdin), &out, &out)
+		return code, out.String()
+	}
+
+	if code, out := run("secret-password\n", "user", "add", "-storage-file", fn, "-audit-file", audit, "a"); code != 0 {
+		t.Error("user add: ", out)
+		return
+	}
+	if code, out := run("secret-password\n", "user", "add", "-storage-file", fn, "-audit-file", audit, "b"); code != 0 {
+		t.Error("user add: ", out)
+		return
+	}
+	if code, out := run("", "user", "del", "-storage-file", fn, "-audit-file", audit, "b"); code != 0 {
+		t.Error("user del: ", out)
+		return
+	}
+	if code, out := run("", "user", "list", "-storage-file", fn); code != 0 || out != "a\n" {
+		t.Error("user list: ", out)
+		return
+	}
+	if code, out := run("", "db", "check", "-storage-file", fn); code != 0 {
+		t.Error("db check: ", out)
+		return
+	}
+
+	// changes are recorded, password is not
+	var query bytes.Buffer
+	if code := RunAuditCommand([]string{"query", "-audit-file", audit, "-user", "b"}, &query, &query); code != 0 {
+		t.Error("audit query: ", query.String())
+		return
+	}
+	if lines := splitLines(query.String()); len(lines) != 2 || !strings.Contains(lines[1], `"Event":"account_delete"`) ||
+		strings.Contains(query.String(), "secret") {
+		t.Error("audit query: ", query.String())
+		return
+	}
+
+	// external user can't be renamed
+	db := NewLocalDb(fn, slog.Default())
+	if err := db.Init(); err != nil {
+		t.Error("Init: ", err)
+		return
+	}
+	db.ProvisionUser("carol", AuthLDAP)
+	db.Close()
+	if code, out := run("", "user", "rename", "-storage-file", fn, "-audit-file", audit, "carol", "dave"); code == 0 ||
+		!strings.Contains(out, "managed by ldap") {
+		t.Error("Expected external user error: ", out)
+		return
+	}
+
+	// storage is locked by running server
+	db = NewLocalDb(fn, slog.Default())
+	if err := db.Init(); err != nil {
+		t.Error("Init: ", err)
+		return
+	}
+	code, out := run("", "user", "list", "-storage-file", fn)
+	db.Close()
+	if code == 0 || !strings.Contains(out, "in use") {
+		t.Error("Expected lock error: ", out)
+		return
+	}
+}
@@ -0,0 +1,364 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Default admin socket path
+const constAdminSocket = "messenger_admin.sock"
+
+// AdminRequest - request to admin socket (one JSON line)
+type AdminRequest struct {
+	Command string
+	Args    []string
+}
+
+// AdminReply - reply from admin socket (one JSON line)
+type AdminReply struct {
+	Lines []string
+	Error string
+}
+
+// liveAdminCommand - command of running server
+type liveAdminCommand struct {
+	// arguments (for usage)
+	args  string
+	nArgs int // -1 - one or more
+	help  string
+	run   func(srv *Server, args []string) ([]string, error)
+}
+
+// liveAdminCommands - admin socket commands (storage commands from adminCommands are available too)
+var liveAdminCommands = map[string]liveAdminCommand{
+	"sessions": {"", 0, "list connected clients", (*Server).adminSessions},
+	"kick":     {"<user>", 1, "force logout and disconnect user", (*Server).adminKick},
+	"announce": {"<text>", -1, "send announcement to all connected clients", (*Server).adminAnnounce},
+	"reload":   {"", 0, "reload config (limits and log level)", (*Server).adminReload},
+	"loglevel": {"<level>", 1, "change log level (debug, info, warn, error)", (*Server).adminLogLevel},
+}
+
+// startAdminSocket - listen on Unix domain socket
+func (srv *Server) startAdminSocket(path string) error {
+
+	// socket of another running server?
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return errors.New("Admin socket '" + path + "' is used by another server")
+	}
+	os.Remove(path)
+
+	// owner only
+	listener, err := listenPrivate(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+
+	srv.mutex.Lock()
+	srv.adminListener = listener
+	srv.mutex.Unlock()
+
+	srv.logger.Info("admin socket listening", "path", path)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !srv.isStopping() {
+					srv.logger.Error("admin accept failed", "err", err)
+				}
+				return
+			}
+			go srv.handleAdminConnection(conn)
+		}
+	}()
+
+	return nil
+}
+
+// handleAdminConnection - process admin requests
+func (srv *Server) handleAdminConnection(conn net.Conn) {
+
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		var rqst AdminRequest
+		var reply AdminReply
+		if err := json.Unmarshal([]byte(line), &rqst); err != nil {
+			reply.Error = "Invalid request"
+		} else {
+			lines, err := srv.runAdminRequest(rqst)
+			reply.Lines = lines
+			if err != nil {
+				reply.Error = err.Error()
+			}
+			if !readOnlyAdminCommands[rqst.Command] {
+				srv.audit(adminAuditEvent("admin-socket", rqst.Command, rqst.Args, err))
+			}
+			srv.logger.Info("admin command", "command", rqst.Command, "err", reply.Error)
+		}
+
+		data, _ := json.Marshal(reply)
+		if _, err := conn.Write(append(data, '\n')); err != nil {
+			return
+		}
+	}
+}
+
+// runAdminRequest - run live or storage admin command
+func (srv *Server) runAdminRequest(rqst AdminRequest) ([]string, error) {
+
+	if command, ok := liveAdminCommands[rqst.Command]; ok {
+		if (command.nArgs >= 0 && len(rqst.Args) != command.nArgs) || (command.nArgs < 0 && len(rqst.Args) == 0) {
+			return nil, errors.New("Usage: " + rqst.Command + " " + command.args)
+		}
+		return command.run(srv, rqst.Args)
+	}
+
+	if command, ok := adminCommands[rqst.Command]; ok {
+		var out bytes.Buffer
+		cli := &adminCLI{db: srv.localDb, stdout: &out, nicknames: adminNicknamePolicy(srv.cfg.Nickname), passwords: srv.passwords}
+		if len(rqst.Args) != command.nArgs+command.nSecrets() {
+			return nil, errors.New("Usage: " + rqst.Command + " " + command.args)
+		}
+		err := command.run(cli, rqst.Args)
+		if err == nil && rqst.Command == "user rename" {
+			srv.renameSessions(rqst.Args[0], normalizeNickname(rqst.Args[1]))
+		}
+		if err == nil && rqst.Command == "user passwd" {
+			srv.kickUser(rqst.Args[0], protocol.NoticeSessionRevoked, "Password is changed, log in again")
+		}
+		if err == nil && rqst.Command == "user token-revoke" {
+			srv.closeRevokedTokenSessions(rqst.Args[0])
+		}
+		return splitLines(out.String()), err
+	}
+
+	return nil, errors.New("Unknown command '" + rqst.Command + "'")
+}
+
+// adminSessions - sessions
+func (srv *Server) adminSessions(args []string) ([]string, error) {
+
+	lines := []string{}
+	for _, s := range srv.sessionList() {
+		user := s.user()
+		if user == "" {
+			user = "-"
+		}
+		lines = append(lines, fmt.Sprintf("%-22s %-16s %s", s.key, user, s.started.Format(time.RFC3339)))
+	}
+	sort.Strings(lines)
+
+	return append([]string{fmt.Sprintf("%-22s %-16s %s", "REMOTE", "USER", "CONNECTED")}, lines...), nil
+}
+
+// adminKick - kick <user>
+func (srv *Server) adminKick(args []string) ([]string, error) {
+
+	count := srv.kickUser(args[0], protocol.NoticeKicked, "You have been logged out by administrator")
+	if count == 0 {
+		return nil, errors.New("User '" + args[0] + "' is not connected")
+	}
+
+	return []string{fmt.Sprintf("%d session(s) closed", count)}, nil
+}
+
+// kickUser - send notice and close all sessions of the user; returns number of sessions
+func (srv *Server) kickUser(name, code, reason string) int {
+	return srv.closeSessions(func(s *session) bool { return s.user() == name }, code, reason)
+}
+
+// closeSessions - send notice and close matching sessions; returns number of sessions
+func (srv *Server) closeSessions(match func(s *session) bool, code, reason string) int {
+
+	count := 0
+	for _, s := range srv.sessionList() {
+		if match(s) {
+			s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			sendNotice(s.conn, code, reason)
+			// closed connection makes the session log out
+			s.conn.Close()
+			count++
+		}
+	}
+
+	return count
+}
+
+// adminAnnounce - announce <text>
+func (srv *Server) adminAnnounce(args []string) ([]string, error) {
+
+	text := strings.Join(args, " ")
+
+	count := 0
+	for _, s := range srv.sessionList() {
+		if sendNoticeTo(s.conn, protocol.NoticeAnnouncement, text) == nil {
+			count++
+		}
+	}
+
+	return []string{fmt.Sprintf("Sent to %d client(s)", count)}, nil
+}
+
+// adminReload - reload
+func (srv *Server) adminReload(args []string) ([]string, error) {
+
+	if err := srv.Reload(); err != nil {
+		return nil, err
+	}
+
+	return []string{"Config reloaded (listen, storage, TLS, HTTP and admin settings need restart)"}, nil
+}
+
+// Reload - reload config and apply settings that can change at runtime
+func (srv *Server) Reload() error {
+
+	if srv.reloadConfig == nil {
+		return errors.New("Reload is not supported")
+	}
+
+	cfg, err := srv.reloadConfig()
+	if err != nil {
+		srv.logger.Error("config reload failed", "err", err)
+		return err
+	}
+
+	srv.applyConfig(cfg)
+	return nil
+}
+
+// applyConfig - apply settings that can change at runtime
+func (srv *Server) applyConfig(cfg Config) {
+
+	srv.limiter.setLimits(cfg.RateLimits)
+	srv.conns.setLimits(cfg.ConnectionLimits)
+	srv.logLevel.Set(cfg.Log.Level)
+
+	srv.logger.Info("config reloaded")
+}
+
+// adminLogLevel - loglevel <level>
+func (srv *Server) adminLogLevel(args []string) ([]string, error) {
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(args[0])); err != nil {
+		return nil, err
+	}
+
+	srv.logLevel.Set(level)
+
+	return []string{"Log level: " + level.String()}, nil
+}
+
+// sendAdminRequest - send request to admin socket of running server
+func sendAdminRequest(path string, rqst AdminRequest) (AdminReply, error) {
+
+	var reply AdminReply
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return reply, err
+	}
+	defer conn.Close()
+
+	data, _ := json.Marshal(rqst)
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return reply, err
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return reply, err
+	}
+	err = json.Unmarshal([]byte(line), &reply)
+
+	return reply, err
+}
+
+// printAdminReply - print reply lines; returns exit code
+func printAdminReply(reply AdminReply, stdout, stderr io.Writer) int {
+
+	for _, line := range reply.Lines {
+		fmt.Fprintln(stdout, line)
+	}
+	if reply.Error != "" {
+		fmt.Fprintln(stderr, reply.Error)
+		return 1
+	}
+
+	return 0
+}
+
+// RunAdminSocketCommand - send command to running server, i.e. ["-admin-socket", "x.sock", "kick", "alice"].
+// Returns process exit code.
+func RunAdminSocketCommand(args []string, stdout, stderr io.Writer) int {
+
+	cfg, commandArgs, _, err := parseConfig(args)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if len(commandArgs) == 0 {
+		AdminSocketUsage(stderr)
+		return 2
+	}
+	if cfg.Admin.Socket == "" {
+		fmt.Fprintln(stderr, "Admin socket is off")
+		return 2
+	}
+
+	reply, err := sendAdminRequest(cfg.Admin.Socket, AdminRequest{Command: commandArgs[0], Args: commandArgs[1:]})
+	if err != nil {
+		fmt.Fprintln(stderr, "Server is not running? "+err.Error())
+		return 1
+	}
+
+	return printAdminReply(reply, stdout, stderr)
+}
+
+// AdminSocketUsage - print admin socket commands
+func AdminSocketUsage(w io.Writer) {
+
+	names := []string{}
+	for name := range liveAdminCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "Running server commands ('admin [flags] <command> <args>'):")
+	for _, name := range names {
+		c := liveAdminCommands[name]
+		fmt.Fprintf(w, "  admin %-22s %s\n", name+" "+c.args, c.help)
+	}
+}
+
+// splitLines - split output to lines
+func splitLines(s string) []string {
+	s = strings.TrimRight(s, "\n")
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, "\n")
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminSocket(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "messenger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := DefaultConfig()
+	cfg.Storage.Backend = StorageMemory
+	cfg.Admin.Socket = filepath.Join(dir, "admin.sock")
+	cfg.Audit.File = filepath.Join(dir, "audit.log")
+
+	srv := NewServerWithConfig(cfg)
+	if err := srv.localDb.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.startAdminSocket(cfg.Admin.Socket); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	if info, err := os.Stat(cfg.Admin.Socket); err != nil || info.Mode().Perm()&0077 != 0 {
+		t.Error("Socket is not owner only: ", info.Mode(), err)
+	}
+
+	run := func(args ...string) (int, string) {
+		var out bytes.Buffer
+		code := RunAdminSocketCommand(append([]string{"-admin-socket", cfg.Admin.Socket}, args...), &out, &out)
+		return code, out.String()
+	}
+
+	if code, out := run("sessions"); code != 0 || !strings.HasPrefix(out, "REMOTE") {
+		t.Error("sessions: ", out)
+	}
+	if code, out := run("loglevel", "debug"); code != 0 || out != "Log level: DEBUG\n" {
+		t.Error("loglevel: ", out)
+	}
+	if code, out := run("kick", "nobody"); code == 0 || !strings.Contains(out, "not connected") {
+		t.Error("kick: ", out)
+	}
+	if code, out := run("user list"); code != 0 || out != "" {
+		t.Error("user list: ", out)
+	}
+	if code, out := run("bogus"); code == 0 || !strings.Contains(out, "Unknown command") {
+		t.Error("Expected unknown command: ", out)
+	}
+
+	// second server can't take the socket
+	if err := NewServerWithConfig(cfg).startAdminSocket(cfg.Admin.Socket); err == nil {
+		t.Error("Expected socket in use error")
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenPrivate - listen on Unix domain socket created with owner-only
+// permissions (umask is set around Listen: chmod after it leaves a window
+// when anybody can connect)
+func listenPrivate(path string) (net.Listener, error) {
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package server
+
+import "net"
+
+// listenPrivate - listen on Unix domain socket (access is limited by the
+// directory ACL on Windows)
+func listenPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,425 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default audit log file
+const constAuditFile = "messenger_audit.log"
+
+// Audit events
+const (
+	AuditRegister       = "register"
+	AuditLogin          = "login"
+	AuditLogout         = "logout"
+	AuditPasswordChange = "password_change"
+	AuditRoleChange     = "role_change"
+	AuditAccountDelete  = "account_delete"
+	AuditNicknameChange = "nickname_change"
+	AuditTOTPSetup      = "2fa_setup"
+	AuditTOTPEnable     = "2fa_enable"
+	AuditTOTPDisable    = "2fa_disable"
+	AuditTokenCreate    = "token_create"
+	AuditTokenRevoke    = "token_revoke"
+	AuditKeyChange      = "e2e_key_change"
+	AuditAdminCommand   = "admin_command"
+	AuditDenied         = "permission_denied"
+)
+
+// Audit outcomes
+const (
+	AuditSuccess     = "success"
+	AuditFailure     = "failure"
+	AuditRateLimited = "rate_limited"
+)
+
+// AuditEvent - audit log record (one JSON line)
+type AuditEvent struct {
+	Time  time.Time
+	Event string
+	// user the event is about
+	User string `json:",omitempty"`
+	// who did it if it's not the user (moderator, admin socket, admin CLI)
+	Actor   string `json:",omitempty"`
+	Remote  string `json:",omitempty"`
+	Outcome string
+	Detail  string `json:",omitempty"`
+}
+
+// auditedCommand - how client command is recorded in audit log
+type auditedCommand struct {
+	event string
+	// the event is about user in Data1 (otherwise about session user)
+	userInData1 bool
+	// Data1/Data2 is recorded as detail (never set for commands with passwords)
+	data1Detail bool
+	data2Detail bool
+}
+
+// auditedCommands - client commands recorded in audit log
+var auditedCommands = map[protocol.CommandToServer]auditedCommand{
+	protocol.ScmdRegisterUser:   {AuditRegister, true, false, false},
+	protocol.ScmdLogin:          {AuditLogin, true, false, false},
+	protocol.ScmdLoginTOTP:      {AuditLogin, false, false, false},
+	protocol.ScmdLogout:         {AuditLogout, false, false, false},
+	protocol.ScmdChangePassword: {AuditPasswordChange, false, false, false},
+	protocol.ScmdSetRole:        {AuditRoleChange, true, false, true},
+	protocol.ScmdKick:           {"kick", true, false, true},
+	protocol.ScmdBan:            {"ban", true, false, true},
+	protocol.ScmdUnban:          {"unban", true, false, false},
+	protocol.ScmdBanIP:          {"banip", true, false, true},
+	protocol.ScmdUnbanIP:        {"unbanip", true, false, false},
+	protocol.ScmdMute:           {"mute", true, false, true},
+	protocol.ScmdUnmute:         {"unmute", true, false, false},
+	protocol.ScmdClear:          {"clear", false, false, false},
+	protocol.ScmdChangeNickname: {AuditNicknameChange, false, true, false},
+	protocol.ScmdDeleteAccount:  {AuditAccountDelete, false, false, false},
+	protocol.ScmdSetupTOTP:      {AuditTOTPSetup, false, false, false},
+	protocol.ScmdConfirmTOTP:    {AuditTOTPEnable, false, false, false},
+	protocol.ScmdDisableTOTP:    {AuditTOTPDisable, false, false, false},
+	protocol.ScmdCreateToken:    {AuditTokenCreate, false, true, false},
+	protocol.ScmdRevokeToken:    {AuditTokenRevoke, false, true, false},
+	protocol.ScmdTokenLogin:     {AuditLogin, false, false, false},
+	protocol.ScmdSetPublicKey:   {AuditKeyChange, false, false, false},
+}
+
+// adminAuditEvents - admin commands with their own audit event (others are AuditAdminCommand)
+var adminAuditEvents = map[string]string{
+	"user add":          AuditRegister,
+	"user del":          AuditAccountDelete,
+	"user passwd":       AuditPasswordChange,
+	"user role":         AuditRoleChange,
+	"user rename":       AuditNicknameChange,
+	"user 2fa-off":      AuditTOTPDisable,
+	"user token-revoke": AuditTokenRevoke,
+}
+
+// readOnlyAdminCommands - admin commands not recorded in audit log
+var readOnlyAdminCommands = map[string]bool{
+	"sessions":    true,
+	"user list":   true,
+	"user tokens": true,
+	"ban list":    true,
+	"db check":    true,
+}
+
+// auditLog - append-only JSON lines file rotated by size
+// (nil auditLog is off)
+type auditLog struct {
+	cfg   AuditConfig
+	file  *os.File
+	size  int64
+	mutex sync.Mutex
+}
+
+// newAuditLog - auditLog constructor (nil if off)
+func newAuditLog(cfg AuditConfig) *auditLog {
+	if cfg.File == "" {
+		return nil
+	}
+	return &auditLog{cfg: cfg}
+}
+
+// write - append event
+func (a *auditLog) write(ev AuditEvent) error {
+
+	if a == nil {
+		return nil
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	data, _ := json.Marshal(ev)
+	data = append(data, '\n')
+
+	// rotate
+	if a.file != nil && a.size+int64(len(data)) > int64(a.cfg.MaxSizeMB)<<20 {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if a.file == nil {
+		f, err := os.OpenFile(a.cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		a.file, a.size = f, info.Size()
+	}
+
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+
+	return err
+}
+
+// rotate - file -> file.1 -> file.2 ... (the oldest is removed)
+func (a *auditLog) rotate() error {
+
+	a.file.Close()
+	a.file = nil
+
+	// (MaxFiles==0 removes the current file)
+	os.Remove(auditFileName(a.cfg.File, a.cfg.MaxFiles))
+	for i := a.cfg.MaxFiles - 1; i >= 0; i-- {
+		if err := os.Rename(auditFileName(a.cfg.File, i), auditFileName(a.cfg.File, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// close - close file
+func (a *auditLog) close() error {
+
+	if a == nil {
+		return nil
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+
+	return err
+}
+
+// auditFileName - name of rotated file (0 - current file)
+func auditFileName(file string, i int) string {
+	if i == 0 {
+		return file
+	}
+	return file + "." + strconv.Itoa(i)
+}
+
+// audit - write event (errors are logged)
+func (srv *Server) audit(ev AuditEvent) {
+
+	ev.Time = time.Now().UTC()
+	if err := srv.auditLog.write(ev); err != nil {
+		srv.logger.Error("audit log write failed", "err", err, "event", ev.Event)
+	}
+}
+
+// auditRequest - record client request (if it's security-relevant);
+// 'user' is session user before the request
+func (srv *Server) auditRequest(s *session, user string, rqst protocol.Request, reply, outcome string, err error) {
+
+	command, ok := auditedCommands[rqst.Command]
+	if !ok {
+		return
+	}
+
+	ev := AuditEvent{Event: command.event, User: user, Remote: s.key, Outcome: outcome}
+	if command.userInData1 {
+		ev.User = rqst.Data1
+		if user != rqst.Data1 {
+			ev.Actor = user
+		}
+	}
+	if command.data1Detail {
+		ev.Detail = rqst.Data1
+	}
+	if command.data2Detail {
+		ev.Detail = rqst.Data2
+	}
+
+	// two-step login
+	if rqst.Command == protocol.ScmdLoginTOTP {
+		ev.User, ev.Detail = s.pendingLogin, "one-time code"
+		if ev.User == "" {
+			ev.User = s.user()
+		}
+	}
+	if rqst.Command == protocol.ScmdTokenLogin {
+		ev.User, ev.Detail = s.user(), "API token"
+		if id, _ := s.token(); id != "" {
+			ev.Detail += " " + id
+		}
+	}
+	if reply == protocol.ReplyTOTPRequired {
+		ev.Detail = "password ok, waiting for one-time code"
+	}
+	if err != nil {
+		ev.Detail = strings.TrimSpace(ev.Detail + " " + err.Error())
+	}
+
+	srv.audit(ev)
+}
+
+// auditDenied - record request rejected by permission check
+func (srv *Server) auditDenied(s *session, rqst protocol.Request) {
+	srv.audit(AuditEvent{Event: AuditDenied, User: s.userName, Remote: s.key, Outcome: AuditFailure, Detail: string(rqst.Command)})
+}
+
+// adminAuditEvent - audit event of admin command (secrets are not recorded)
+func adminAuditEvent(actor, name string, args []string, err error) AuditEvent {
+
+	ev := AuditEvent{Event: AuditAdminCommand, Actor: actor, Remote: "local", Outcome: AuditSuccess, Detail: name}
+	if event, ok := adminAuditEvents[name]; ok {
+		ev.Event = event
+	}
+
+	if command, ok := adminCommands[name]; ok {
+		if strings.HasPrefix(command.args, "<name>") && len(args) > 0 {
+			ev.User = args[0]
+		}
+		if len(args) > command.nArgs {
+			args = args[:command.nArgs]
+		}
+	}
+	if command, ok := liveAdminCommands[name]; ok && strings.HasPrefix(command.args, "<user>") && len(args) > 0 {
+		ev.User = args[0]
+	}
+	if len(args) > 0 {
+		ev.Detail += " " + strings.Join(args, " ")
+	}
+
+	if err != nil {
+		ev.Outcome = AuditFailure
+		ev.Detail += ": " + err.Error()
+	}
+
+	ev.Time = time.Now().UTC()
+	return ev
+}
+
+// auditQuery - audit log filter
+type auditQuery struct {
+	user  string
+	event string
+	since time.Time
+	until time.Time
+}
+
+// match - event passes filter
+func (q *auditQuery) match(ev *AuditEvent) bool {
+	return (q.user == "" || ev.User == q.user || ev.Actor == q.user) &&
+		(q.event == "" || ev.Event == q.event) &&
+		(q.since.IsZero() || !ev.Time.Before(q.since)) &&
+		(q.until.IsZero() || ev.Time.Before(q.until))
+}
+
+// queryAudit - print matching events from rotated and current files (oldest first)
+func queryAudit(cfg AuditConfig, q auditQuery, w io.Writer) error {
+
+	for i := cfg.MaxFiles; i >= 0; i-- {
+		f, err := os.Open(auditFileName(cfg.File, i))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1<<20)
+		for scanner.Scan() {
+			var ev AuditEvent
+			if json.Unmarshal(scanner.Bytes(), &ev) != nil {
+				continue
+			}
+			if q.match(&ev) {
+				fmt.Fprintln(w, scanner.Text())
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseAuditTime - RFC 3339 time, date (2006-01-02) or duration before now (24h)
+func parseAuditTime(s string) (time.Time, error) {
+
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	return time.Time{}, errors.New("Invalid time '" + s + "'")
+}
+
+// RunAuditCommand - query audit log, i.e. ["query", "-user", "alice", "-since", "24h"].
+// Returns process exit code.
+func RunAuditCommand(args []string, stdout, stderr io.Writer) int {
+
+	if len(args) == 0 || args[0] != "query" {
+		AuditUsage(stderr)
+		return 2
+	}
+
+	var q auditQuery
+	var since, until string
+	cfg, rest, _, err := parseConfigFlags(args[1:], func(fs *flag.FlagSet) {
+		fs.StringVar(&q.user, "user", "", "events of the user (as user or actor)")
+		fs.StringVar(&q.event, "event", "", "event name (i.e. login)")
+		fs.StringVar(&since, "since", "", "from time: RFC 3339, date or duration ago (i.e. 24h)")
+		fs.StringVar(&until, "until", "", "to time: RFC 3339, date or duration ago")
+	})
+	if err == nil && len(rest) > 0 {
+		err = errors.New("Unexpected argument '" + rest[0] + "'")
+	}
+	if err == nil {
+		q.since, err = parseAuditTime(since)
+	}
+	if err == nil {
+		q.until, err = parseAuditTime(until)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	if cfg.Audit.File == "" {
+		fmt.Fprintln(stderr, "Audit log is off")
+		return 2
+	}
+
+	if err := queryAudit(cfg.Audit, q, stdout); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+// AuditUsage - print audit command usage
+func AuditUsage(w io.Writer) {
+	fmt.Fprintln(w, "Audit log:")
+	fmt.Fprintf(w, "  %-28s %s\n", "audit query [flags]", "print events (-user, -event, -since, -until)")
+}
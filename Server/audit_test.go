@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "messenger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := AuditConfig{File: filepath.Join(dir, "audit.log"), MaxSizeMB: 1, MaxFiles: 2}
+	a := newAuditLog(cfg)
+	defer a.close()
+
+	day := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	write := func(user string, day int) {
+		ev := AuditEvent{Time: time.Date(2026, 1, day, 0, 0, 0, 0, time.UTC), Event: AuditLogin, User: user, Outcome: AuditSuccess}
+		if err := a.write(ev); err != nil {
+			t.Fatal(err)
+		}
+		// pretend the file is full
+		a.size = 1 << 20
+	}
+
+	// 4 files: the oldest one is removed by rotation
+	write("a", 1)
+	write("b", 2)
+	write("a", 3)
+	write("a", 4)
+
+	query := func(q auditQuery) int {
+		var out bytes.Buffer
+		if err := queryAudit(cfg, q, &out); err != nil {
+			t.Fatal(err)
+		}
+		return len(splitLines(out.String()))
+	}
+
+	if n := query(auditQuery{}); n != 3 {
+		t.Error("Expected 3 events after rotation, got ", n)
+	}
+	if n := query(auditQuery{user: "a"}); n != 2 {
+		t.Error("Expected 2 events of 'a', got ", n)
+	}
+	if n := query(auditQuery{since: day.AddDate(0, 0, 2), until: day.AddDate(0, 0, 3)}); n != 1 {
+		t.Error("Expected 1 event in time range, got ", n)
+	}
+
+	// nil audit log is off
+	var off *auditLog
+	if err := off.write(AuditEvent{}); err != nil {
+		t.Error(err)
+	}
+}
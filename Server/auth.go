@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authentication backends
+const (
+	AuthLocal    = "local"
+	AuthHtpasswd = "htpasswd"
+	AuthLDAP     = "ldap"
+)
+
+// AuthConfig - authentication backends
+type AuthConfig struct {
+	// backends tried in this order for new users; existing users are checked
+	// by the backend that registered them
+	Backends []string
+	// htpasswd file with bcrypt hashes ("htpasswd -B")
+	HtpasswdFile string
+	// LDAP server for bind
+	LDAP LDAPConfig
+}
+
+// errUnknownUser - authenticator doesn't know the user (next one is tried)
+var errUnknownUser = errors.New("unknown user")
+
+// errInvalidPassword - wrong password
+var errInvalidPassword = errors.New("Invalid password")
+
+// Authenticator - checks user credentials
+type Authenticator interface {
+	// Name - backend name (AuthLocal, ...)
+	Name() string
+	// Authenticate - check password; errUnknownUser if the user is unknown
+	Authenticate(name, password string) error
+}
+
+// newAuthenticators - authenticators of configured backends
+func newAuthenticators(cfg AuthConfig, db LocalDbInterface) []Authenticator {
+
+	list := []Authenticator{}
+	for _, backend := range cfg.Backends {
+		switch backend {
+		case AuthLocal:
+			list = append(list, &localAuthenticator{db: db})
+		case AuthHtpasswd:
+			list = append(list, &htpasswdAuthenticator{file: cfg.HtpasswdFile})
+		case AuthLDAP:
+			list = append(list, &ldapAuthenticator{cfg: cfg.LDAP})
+		}
+	}
+
+	return list
+}
+
+// authenticate - check password with backend of the user (or any backend for new users);
+// returns backend name
+func (srv *Server) authenticate(name, password string) (string, error) {
+
+	source, exists := srv.localDb.GetAuthSource(name)
+
+	for _, a := range srv.authenticators {
+		if exists && a.Name() != source {
+			continue
+		}
+		err := a.Authenticate(name, password)
+		if errors.Is(err, errUnknownUser) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return a.Name(), nil
+	}
+
+	return "", errors.New("User '" + name + "' does not exist")
+}
+
+// provisionUser - create record of user authenticated by external backend
+func (srv *Server) provisionUser(name, source string) error {
+
+	if err := srv.nicknamePolicy().check(name); err != nil {
+		return errors.New("User '" + name + "' can't be registered: " + err.Error())
+	}
+	if err := srv.localDb.ProvisionUser(name, source); err != nil {
+		return err
+	}
+
+	srv.logger.Info("user provisioned", "name", name, "auth", source)
+	return nil
+}
+
+// localAuthenticator - passwords stored in LocalDb
+type localAuthenticator struct {
+	db LocalDbInterface
+}
+
+// Name - Authenticator interface
+func (a *localAuthenticator) Name() string {
+	return AuthLocal
+}
+
+// Authenticate - Authenticator interface
+func (a *localAuthenticator) Authenticate(name, password string) error {
+
+	hashes := a.db.GetPasswordHistory(name)
+	if len(hashes) == 0 || hashes[0] == "" {
+		return errUnknownUser
+	}
+
+	if err := a.db.CheckPassword(name, password); err != nil {
+		return err
+	}
+
+	// replace hash made by old client
+	if legacyPasswordHash(hashes[0]) {
+		if hash, err := hashPassword(password); err == nil {
+			a.db.ChangePassword(name, hash, 0)
+		}
+	}
+
+	return nil
+}
+
+// htpasswdAuthenticator - Apache htpasswd file with bcrypt hashes
+// (re-read when changed)
+type htpasswdAuthenticator struct {
+	file string
+
+	users   map[string]string
+	modTime time.Time
+	mutex   sync.Mutex
+}
+
+// Name - Authenticator interface
+func (a *htpasswdAuthenticator) Name() string {
+	return AuthHtpasswd
+}
+
+// Authenticate - Authenticator interface
+func (a *htpasswdAuthenticator) Authenticate(name, password string) error {
+
+	hash, err := a.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return errInvalidPassword
+	}
+
+	return nil
+}
+
+// lookup - hash of user from current file content
+func (a *htpasswdAuthenticator) lookup(name string) (string, error) {
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	info, err := os.Stat(a.file)
+	if err != nil {
+		return "", err
+	}
+
+	if a.users == nil || !info.ModTime().Equal(a.modTime) {
+		users, err := readHtpasswd(a.file)
+		if err != nil {
+			return "", err
+		}
+		a.users, a.modTime = users, info.ModTime()
+	}
+
+	hash, ok := a.users[name]
+	if !ok {
+		return "", errUnknownUser
+	}
+
+	return hash, nil
+}
+
+// readHtpasswd - "name:hash" lines (only bcrypt hashes are used)
+func readHtpasswd(file string) (map[string]string, error) {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(line, ":")
+		if ok && strings.HasPrefix(hash, "$2") {
+			users[name] = hash
+		}
+	}
+
+	return users, scanner.Err()
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"bufio"
+	"encoding/asn1"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ldapStandIn - LDAP server that answers simple binds from 'users' (DN -> password)
+func ldapStandIn(t *testing.T, users map[string]string) string {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, err := readBER(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				var rqst ldapBindMessage
+				if _, err := asn1.Unmarshal(data, &rqst); err != nil {
+					return
+				}
+				code := ldapInvalidCredentials
+				if password, ok := users[string(rqst.Request.Name)]; ok && password == string(rqst.Request.Password) {
+					code = ldapSuccess
+				}
+				reply, _ := asn1.Marshal(struct {
+					ID     int
+					Result ldapResult `asn1:"application,tag:1"`
+				}{rqst.ID, ldapResult{Code: asn1.Enumerated(code)}})
+				conn.Write(reply)
+			}()
+		}
+	}()
+
+	return "ldap://" + listener.Addr().String()
+}
+
+func TestAuthenticators(t *testing.T) {
+
+	passwordHashCost = bcrypt.MinCost
+	defer func() { passwordHashCost = bcrypt.DefaultCost }()
+
+	dir, err := ioutil.TempDir("", "messenger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	htpasswd := filepath.Join(dir, "htpasswd")
+	hash, _ := bcrypt.GenerateFromPassword([]byte("carol-password"), bcrypt.MinCost)
+	ioutil.WriteFile(htpasswd, []byte("# team\ncarol:"+string(hash)+"\n"), 0600)
+
+	cfg := DefaultConfig()
+	cfg.Storage.Backend = StorageMemory
+	cfg.RateLimits.Login = RateLimitScopes{}
+	cfg.Auth.Backends = []string{AuthLocal, AuthHtpasswd, AuthLDAP}
+	cfg.Auth.HtpasswdFile = htpasswd
+	cfg.Auth.LDAP.URL = ldapStandIn(t, map[string]string{
+		"uid=dave,ou=people,dc=example,dc=com":  "dave-password",
+		"uid=carol,ou=people,dc=example,dc=com": "ldap-password",
+		`uid=a\,b,ou=people,dc=example,dc=com`:  "comma-password",
+	})
+	cfg.Auth.LDAP.BindDN = "uid={user},ou=people,dc=example,dc=com"
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServerWithConfig(cfg)
+	if err := srv.localDb.Init(); err != nil {
+		t.Fatal(err)
+	}
+	hash, _ = bcrypt.GenerateFromPassword([]byte("alice-password"), bcrypt.MinCost)
+	srv.localDb.AddUser("alice", string(hash), nil)
+
+	for _, c := range []struct {
+		name, password, source string
+	}{
+		{"alice", "alice-password", AuthLocal},
+		{"alice", "dave-password", ""},
+		{"carol", "carol-password", AuthHtpasswd},
+		{"carol", "ldap-password", ""},
+		{"dave", "dave-password", AuthLDAP},
+		{"dave", "", ""},
+		{"a,b", "comma-password", AuthLDAP},
+		{"eve", "eve-password", ""},
+	} {
+		source, err := srv.authenticate(c.name, c.password)
+		if source != c.source || (err == nil) != (c.source != "") {
+			t.Errorf("%s/%s: %q %v", c.name, c.password, source, err)
+		}
+	}
+
+	// external users are registered on first login and stay with their backend
+	login := func(name, password string) error {
+		s := &session{key: name, ip: "10.0.0.1", logger: slog.Default()}
+		_, err := srv.handleLogin(s, protocol.Request{Command: protocol.ScmdLogin, Data1: name, Data2: password})
+		return err
+	}
+	if err := login("carol", "carol-password"); err != nil {
+		t.Fatal(err)
+	}
+	if source, ok := srv.localDb.GetAuthSource("carol"); !ok || source != AuthHtpasswd {
+		t.Error("User is not provisioned: ", source)
+	}
+	srv.localDb.Logout("carol")
+	if err := login("Carol", "carol-password"); err != nil {
+		t.Error(err)
+	}
+	if problems := srv.localDb.Check(); len(problems) > 0 {
+		t.Error(problems)
+	}
+
+	carol := &session{key: "carol", ip: "10.0.0.1", userName: "carol", logger: slog.Default()}
+	_, err = srv.handleChangePassword(carol, protocol.Request{Command: protocol.ScmdChangePassword, Data1: "new-password", Data2: "carol-password"})
+	if err == nil {
+		t.Error("Expected error: password of external user can't be changed")
+	}
+}
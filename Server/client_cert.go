@@ -0,0 +1,281 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthCertificate - users registered by client certificate login
+const AuthCertificate = "certificate"
+
+// time for TLS handshake of new connection
+const constHandshakeTimeout = 10 * time.Second
+
+// CertMapping - client certificate that logs in as a user
+type CertMapping struct {
+	// "cn:<common name>", "subject:<distinguished name>", "dns:<name>",
+	// "email:<address>" or "uri:<URI>"
+	Match    string
+	Nickname string
+}
+
+// certMatchKinds - kinds of CertMapping.Match
+var certMatchKinds = []string{"cn", "subject", "dns", "email", "uri"}
+
+// matches - certificate matches mapping
+func (m *CertMapping) matches(cert *x509.Certificate) bool {
+
+	kind, value, _ := strings.Cut(m.Match, ":")
+
+	var values []string
+	switch kind {
+	case "cn":
+		values = []string{cert.Subject.CommonName}
+	case "subject":
+		values = []string{cert.Subject.String()}
+	case "dns":
+		values = cert.DNSNames
+	case "email":
+		values = cert.EmailAddresses
+	case "uri":
+		for _, u := range cert.URIs {
+			values = append(values, u.String())
+		}
+	}
+
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// certFingerprint - SHA-256 of certificate (hex)
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// certChecker - client certificate revocation (CRL is re-read when changed)
+type certChecker struct {
+	cfg TLSConfig
+	cas *x509.CertPool
+	// CA certificates that sign CRL
+	caCerts []*x509.Certificate
+
+	// revoked serial numbers (hex) from CRL
+	revoked    map[string]bool
+	crlModTime time.Time
+	mutex      sync.Mutex
+}
+
+// newCertChecker - certChecker constructor (reads client CA file)
+func newCertChecker(cfg TLSConfig) (*certChecker, error) {
+
+	data, err := ioutil.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &certChecker{cfg: cfg, cas: x509.NewCertPool()}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		c.cas.AddCert(cert)
+		c.caCerts = append(c.caCerts, cert)
+	}
+	if len(c.caCerts) == 0 {
+		return nil, errors.New("No certificates in '" + cfg.ClientCAFile + "'")
+	}
+
+	if err := c.loadCRL(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// loadCRL - read CRL (PEM or DER) if it's changed
+func (c *certChecker) loadCRL() error {
+
+	if c.cfg.CRLFile == "" {
+		return nil
+	}
+
+	info, err := os.Stat(c.cfg.CRLFile)
+	if err != nil {
+		return err
+	}
+	if c.revoked != nil && info.ModTime().Equal(c.crlModTime) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(c.cfg.CRLFile)
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return err
+	}
+
+	// CRL must be signed by client CA
+	signed := false
+	for _, ca := range c.caCerts {
+		if crl.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return errors.New("CRL '" + c.cfg.CRLFile + "' is not signed by client CA")
+	}
+
+	revoked := make(map[string]bool)
+	for _, entry := range crl.RevokedCertificateEntries {
+		revoked[entry.SerialNumber.Text(16)] = true
+	}
+	c.revoked, c.crlModTime = revoked, info.ModTime()
+
+	return nil
+}
+
+// check - reject revoked and denied certificates
+func (c *certChecker) check(cert *x509.Certificate) error {
+
+	serial := cert.SerialNumber.Text(16)
+	fingerprint := certFingerprint(cert)
+	for _, denied := range c.cfg.DeniedCerts {
+		denied = strings.ToLower(strings.ReplaceAll(denied, ":", ""))
+		if denied == fingerprint || denied == "serial"+serial {
+			return errors.New("certificate is denied")
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// keep the last good CRL if the new one can't be read
+	if err := c.loadCRL(); err != nil && c.revoked == nil {
+		return err
+	}
+	if c.revoked[serial] {
+		return errors.New("certificate is revoked")
+	}
+
+	return nil
+}
+
+// tlsConfig - TLS config of listener (client certificates are verified if client CA is set)
+func (srv *Server) tlsConfig() (*tls.Config, error) {
+
+	cert, err := tls.LoadX509KeyPair(srv.cfg.TLS.CertFile, srv.cfg.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if srv.cfg.TLS.ClientCAFile != "" {
+		checker, err := newCertChecker(srv.cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = checker.cas
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return nil
+			}
+			return checker.check(cs.PeerCertificates[0])
+		}
+	}
+
+	return config, nil
+}
+
+// certNickname - nickname mapped to client certificate ("" - none)
+func (srv *Server) certNickname(cert *x509.Certificate) string {
+	for _, m := range srv.cfg.TLS.ClientCerts {
+		if m.matches(cert) {
+			return normalizeNickname(m.Nickname)
+		}
+	}
+	return ""
+}
+
+// certificateLogin - TLS handshake and login by mapped client certificate;
+// the connection must be closed if it fails
+func (srv *Server) certificateLogin(s *session, conn *tls.Conn) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), constHandshakeTimeout)
+	defer cancel()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	name := srv.certNickname(certs[0])
+	if name == "" {
+		return nil
+	}
+
+	name = srv.localDb.ResolveName(name)
+
+	ev := AuditEvent{Event: AuditLogin, User: name, Remote: s.key, Outcome: AuditFailure, Detail: "client certificate " + certFingerprint(certs[0])}
+	code, err := protocol.NoticeLoginFailed, error(nil)
+	if r := srv.localDb.GetRestriction(RestrictionBan, name); r != nil {
+		code, err = protocol.NoticeBanned, errors.New("You are banned "+r.describe())
+	} else {
+		err = srv.loginByCertificate(s, name)
+	}
+	if err != nil {
+		ev.Detail += ": " + err.Error()
+		srv.audit(ev)
+		s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		sendNotice(s.conn, code, err.Error())
+		return err
+	}
+
+	ev.Outcome = AuditSuccess
+	srv.audit(ev)
+	return sendLoggedIn(s.conn, name, "client certificate")
+}
+
+// loginByCertificate - log session in as mapped user (registered on first login)
+func (srv *Server) loginByCertificate(s *session, name string) error {
+
+	if _, exists := srv.localDb.GetAuthSource(name); !exists {
+		if err := srv.provisionUser(name, AuthCertificate); err != nil {
+			return err
+		}
+	}
+
+	if err := srv.localDb.GoOnline(name, s.conn); err != nil {
+		return err
+	}
+	s.setUser(name)
+	s.logger.Info("logged in", "name", name, "auth", AuthCertificate)
+
+	return nil
+}
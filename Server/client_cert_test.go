@@ -0,0 +1,210 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA - certificate authority for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCA - self-signed CA
+func newTestCA(t *testing.T) *testCA {
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	return &testCA{cert: cert, key: key}
+}
+
+// issue - certificate signed by CA (PEM certificate and key)
+func (ca *testCA) issue(t *testing.T, serial int64, template *x509.Certificate) tls.Certificate {
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template.SerialNumber = big.NewInt(serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writePEM - write PEM block to file
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientCertificateLogin(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "messenger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.cert.Raw)
+
+	server := ca.issue(t, 2, &x509.Certificate{Subject: pkix.Name{CommonName: "localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	writePEM(t, filepath.Join(dir, "server.pem"), "CERTIFICATE", server.Certificate[0])
+	keyDer, _ := x509.MarshalECPrivateKey(server.PrivateKey.(*ecdsa.PrivateKey))
+	writePEM(t, filepath.Join(dir, "server.key"), "EC PRIVATE KEY", keyDer)
+
+	client := func(serial int64, cn string, dns ...string) tls.Certificate {
+		return ca.issue(t, serial, &x509.Certificate{Subject: pkix.Name{CommonName: cn}, DNSNames: dns,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	}
+	bot := client(10, "build-bot")
+	monitor := client(11, "monitor", "monitor.example.com")
+	anonymous := client(12, "someone")
+	revoked := client(13, "build-bot")
+	denied := client(14, "build-bot")
+	banned := client(15, "spammer")
+
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now().Add(-time.Hour),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: big.NewInt(13), RevocationTime: time.Now()}},
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, "ca.crl"), "X509 CRL", crl)
+
+	deniedCert, _ := x509.ParseCertificate(denied.Certificate[0])
+
+	cfg := DefaultConfig()
+	cfg.Storage.Backend = StorageMemory
+	cfg.Network = "tcp"
+	cfg.TLS = TLSConfig{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+		CRLFile:      filepath.Join(dir, "ca.crl"),
+		ClientCerts: []CertMapping{
+			{Match: "cn:build-bot", Nickname: "bot"},
+			{Match: "dns:monitor.example.com", Nickname: "Monitor"},
+			{Match: "cn:spammer", Nickname: "spammer"},
+		},
+		DeniedCerts: []string{certFingerprint(deniedCert)},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServerWithConfig(cfg)
+	if err := srv.localDb.Init(); err != nil {
+		t.Fatal(err)
+	}
+	srv.localDb.ProvisionUser("monitor", AuthCertificate)
+	srv.localDb.ProvisionUser("spammer", AuthCertificate)
+	srv.localDb.SetRestriction(RestrictionBan, "spammer", newRestriction("admin", 0, "spam"))
+
+	listener, err := srv.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go srv.serve(listener)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	// connect - first message from server ("" if the connection is open and nothing is sent)
+	connect := func(cert *tls.Certificate) (protocol.MessageFromServer, error) {
+		config := &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{*cert}
+		}
+		conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+		if err != nil {
+			return protocol.MessageFromServer{}, err
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var msg protocol.MessageFromServer
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return msg, nil
+			}
+			return msg, err
+		}
+		msg.Decode(line)
+		return msg, nil
+	}
+
+	for _, c := range []struct {
+		name   string
+		cert   *tls.Certificate
+		notice string
+		user   string
+	}{
+		{"mapped by CN", &bot, protocol.NoticeLoggedIn, "bot"},
+		{"mapped by DNS name", &monitor, protocol.NoticeLoggedIn, "monitor"},
+		{"not mapped", &anonymous, "", ""},
+		{"no certificate", nil, "", ""},
+		{"banned", &banned, protocol.NoticeBanned, ""},
+	} {
+		msg, err := connect(c.cert)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if msg.NoticeCode() != c.notice || msg.NoticeNickname() != c.user {
+			t.Errorf("%s: %+v", c.name, msg)
+		}
+	}
+
+	if source, ok := srv.localDb.GetAuthSource("bot"); !ok || source != AuthCertificate {
+		t.Error("User is not provisioned: ", source)
+	}
+	if _, err := srv.authenticate("bot", ""); err == nil {
+		t.Error("Expected error: certificate user has no password")
+	}
+
+	// handshake fails
+	for name, cert := range map[string]*tls.Certificate{"revoked": &revoked, "denied": &denied} {
+		if msg, err := connect(cert); err == nil {
+			t.Errorf("%s: expected error, got %+v", name, msg)
+		}
+	}
+}
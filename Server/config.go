@@ -0,0 +1,516 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config - server configuration
+//
+// Effective configuration is merged in this order (later wins):
+//  1. defaults (DefaultConfig)
+//  2. JSON config file ('-config' flag or MESSENGER_CONFIG environment variable)
+//  3. MESSENGER_* environment variables
+//  4. command-line flags
+type Config struct {
+	// Listen addresses (i.e. ":1111")
+	Listen []string
+	// Network: "tcp", "tcp4" or "tcp6"
+	Network string
+
+	// Storage
+	Storage StorageConfig
+
+	// TLS for client connections
+	TLS TLSConfig
+
+	// HTTP endpoints
+	HTTP HTTPConfig
+
+	// Admin control
+	Admin AdminConfig
+
+	// Audit log
+	Audit AuditConfig
+
+	// Nickname rules
+	Nickname NicknamePolicy
+
+	// Password rules
+	Password PasswordPolicy
+
+	// Authentication backends
+	Auth AuthConfig
+
+	// Limits
+	RateLimits       RateLimits
+	ConnectionLimits ConnectionLimits
+
+	// Logging
+	Log LogConfig
+
+	// TestMode allows 'Clear' command for everybody (never use in production)
+	TestMode bool
+}
+
+// StorageConfig - storage backend
+type StorageConfig struct {
+	// Backend: "file" (JSON file) or "memory" (nothing is saved)
+	Backend string
+	// File name for "file" backend
+	File string
+	// encryption key (32 bytes in base64) for "file" backend: file with the key
+	// or name of environment variable with the key (empty - not encrypted)
+	KeyFile string
+	KeyEnv  string
+}
+
+// TLSConfig - TLS certificate (TLS is off if empty)
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// CA certificates of client certificates (empty - client certificates are not used)
+	ClientCAFile string
+	// CRL of client CA (PEM or DER, re-read when changed)
+	CRLFile string
+	// client certificates that log in automatically (first match is used)
+	ClientCerts []CertMapping
+	// denied client certificates: SHA-256 fingerprints (hex, colons are allowed)
+	// or "serial:<hex>"
+	DeniedCerts []string
+}
+
+// HTTPConfig - HTTP listeners for monitoring and debugging
+type HTTPConfig struct {
+	// Listen address for /metrics, /healthz and /readyz (empty - off)
+	Listen string
+	// Listen address for /debug/pprof/ (empty - off; must be reachable by admins only)
+	PprofListen string
+}
+
+// AdminConfig - admin control socket
+type AdminConfig struct {
+	// Unix domain socket path (empty - off)
+	Socket string
+}
+
+// AuditConfig - audit log of security-relevant events
+type AuditConfig struct {
+	// JSON lines file (empty - off)
+	File string
+	// Rotate when the file is bigger (MB)
+	MaxSizeMB int
+	// Number of rotated files to keep
+	MaxFiles int
+}
+
+// LogConfig - logging
+type LogConfig struct {
+	// Level: "DEBUG", "INFO", "WARN" or "ERROR"
+	Level slog.Level
+	// Format: "text" or "json"
+	Format string
+}
+
+// Storage backends
+const (
+	StorageFile   = "file"
+	StorageMemory = "memory"
+)
+
+// DefaultConfig - default configuration
+func DefaultConfig() Config {
+	return Config{
+		Listen:           []string{":1111"},
+		Network:          "tcp4",
+		Storage:          StorageConfig{Backend: StorageFile, File: constLocalDbFn},
+		RateLimits:       DefaultRateLimits(),
+		ConnectionLimits: DefaultConnectionLimits(),
+		Admin:            AdminConfig{Socket: constAdminSocket},
+		Audit:            AuditConfig{File: constAuditFile, MaxSizeMB: 10, MaxFiles: 5},
+		Nickname:         DefaultNicknamePolicy(),
+		Password:         DefaultPasswordPolicy(),
+		Auth:             AuthConfig{Backends: []string{AuthLocal}, LDAP: LDAPConfig{Timeout: Duration(10 * time.Second)}},
+		Log:              LogConfig{Level: slog.LevelInfo, Format: LogFormatText},
+	}
+}
+
+// Validate - check configuration
+func (cfg *Config) Validate() error {
+
+	if len(cfg.Listen) == 0 {
+		return errors.New("No listen address")
+	}
+
+	switch cfg.Network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return errors.New("Invalid network '" + cfg.Network + "'")
+	}
+
+	switch cfg.Storage.Backend {
+	case StorageFile:
+		if cfg.Storage.File == "" {
+			return errors.New("No storage file")
+		}
+	case StorageMemory:
+	default:
+		return errors.New("Invalid storage backend '" + cfg.Storage.Backend + "'")
+	}
+
+	if cfg.Storage.KeyFile != "" && cfg.Storage.KeyEnv != "" {
+		return errors.New("Set storage key file or storage key variable, not both")
+	}
+	if (cfg.Storage.KeyFile != "" || cfg.Storage.KeyEnv != "") && cfg.Storage.Backend != StorageFile {
+		return errors.New("Storage key is used by file backend only")
+	}
+
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return errors.New("Both TLS certificate and key files are required")
+	}
+	if (cfg.TLS.ClientCAFile != "" || cfg.TLS.CRLFile != "" || len(cfg.TLS.ClientCerts) > 0) &&
+		(cfg.TLS.CertFile == "" || cfg.TLS.ClientCAFile == "") {
+		return errors.New("Client certificates require TLS certificate and client CA file")
+	}
+	for _, m := range cfg.TLS.ClientCerts {
+		kind, value, _ := strings.Cut(m.Match, ":")
+		if !slices.Contains(certMatchKinds, kind) || value == "" || m.Nickname == "" {
+			return errors.New("Invalid client certificate mapping '" + m.Match + "'")
+		}
+	}
+
+	if cfg.Audit.File != "" && (cfg.Audit.MaxSizeMB <= 0 || cfg.Audit.MaxFiles < 0) {
+		return errors.New("Invalid audit log rotation settings")
+	}
+
+	if cfg.Nickname.MinLength < 1 || cfg.Nickname.MaxLength < cfg.Nickname.MinLength {
+		return errors.New("Invalid nickname length limits")
+	}
+
+	if cfg.Password.MinLength < 1 || cfg.Password.MinLength > constMaxPassword || cfg.Password.History < 0 {
+		return errors.New("Invalid password policy")
+	}
+
+	if len(cfg.Auth.Backends) == 0 {
+		return errors.New("No authentication backend")
+	}
+	for _, backend := range cfg.Auth.Backends {
+		switch backend {
+		case AuthLocal:
+		case AuthHtpasswd:
+			if cfg.Auth.HtpasswdFile == "" {
+				return errors.New("No htpasswd file")
+			}
+		case AuthLDAP:
+			if cfg.Auth.LDAP.URL == "" || !strings.Contains(cfg.Auth.LDAP.BindDN, "{user}") {
+				return errors.New("LDAP URL and bind DN with {user} are required")
+			}
+		default:
+			return errors.New("Invalid authentication backend '" + backend + "'")
+		}
+	}
+
+	if cfg.Log.Format != LogFormatText && cfg.Log.Format != LogFormatJSON {
+		return errors.New("Invalid log format '" + cfg.Log.Format + "'")
+	}
+
+	return nil
+}
+
+// Encode - encodes config to indented JSON
+func (cfg *Config) Encode() []byte {
+	data, _ := json.MarshalIndent(cfg, "", "  ")
+	return append(data, '\n')
+}
+
+// LoadConfig - load effective configuration from defaults, config file,
+// environment and command-line args. 'printConfig' is set by '-print-config' flag.
+func LoadConfig(args []string) (cfg Config, printConfig bool, err error) {
+
+	var rest []string
+	if cfg, rest, printConfig, err = parseConfig(args); err != nil {
+		return
+	}
+	if len(rest) > 0 {
+		err = errors.New("Unexpected argument '" + rest[0] + "'")
+	}
+	return
+}
+
+// parseConfig - LoadConfig that returns args left after flags
+func parseConfig(args []string) (cfg Config, rest []string, printConfig bool, err error) {
+	return parseConfigFlags(args, nil)
+}
+
+// parseConfigFlags - parseConfig with additional flags defined by 'extra'
+func parseConfigFlags(args []string, extra func(fs *flag.FlagSet)) (cfg Config, rest []string, printConfig bool, err error) {
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	if extra != nil {
+		extra(fs)
+	}
+	configFile := fs.String("config", os.Getenv("MESSENGER_CONFIG"), "JSON config file (env MESSENGER_CONFIG)")
+	fs.BoolVar(&printConfig, "print-config", false, "print effective config and exit")
+
+	values := make(map[string]*optionValue)
+	for _, opt := range configOptions {
+		values[opt.name] = &optionValue{isBool: opt.isBool}
+		fs.Var(values[opt.name], opt.name, opt.usage+" (env "+opt.envName()+")")
+	}
+
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+	rest = fs.Args()
+
+	// defaults
+	cfg = DefaultConfig()
+
+	// config file
+	if *configFile != "" {
+		var data []byte
+		if data, err = ioutil.ReadFile(*configFile); err != nil {
+			return
+		}
+		if err = json.Unmarshal(data, &cfg); err != nil {
+			err = errors.New("Config file '" + *configFile + "': " + err.Error())
+			return
+		}
+	}
+
+	// environment
+	for _, opt := range configOptions {
+		if v, ok := os.LookupEnv(opt.envName()); ok {
+			if err = opt.set(&cfg, v); err != nil {
+				err = errors.New(opt.envName() + ": " + err.Error())
+				return
+			}
+		}
+	}
+
+	// flags
+	fs.Visit(func(f *flag.Flag) {
+		for _, opt := range configOptions {
+			if opt.name == f.Name && err == nil {
+				if err = opt.set(&cfg, values[opt.name].value); err != nil {
+					err = errors.New("-" + opt.name + ": " + err.Error())
+				}
+			}
+		}
+	})
+	if err != nil {
+		return
+	}
+
+	err = cfg.Validate()
+	return
+}
+
+// configOption - setting that can be overridden by environment variable and flag
+type configOption struct {
+	// flag name
+	name   string
+	usage  string
+	isBool bool
+	set    func(cfg *Config, value string) error
+}
+
+// envName - environment variable name (i.e. "max-connections" -> "MESSENGER_MAX_CONNECTIONS")
+func (opt *configOption) envName() string {
+	return "MESSENGER_" + strings.ToUpper(strings.Replace(opt.name, "-", "_", -1))
+}
+
+// configOptions - settings available as flags and environment variables
+// (everything else is set in config file)
+var configOptions = []configOption{
+	{"listen", "listen addresses, comma separated", false, func(cfg *Config, v string) error {
+		cfg.Listen = splitList(v)
+		return nil
+	}},
+	{"network", "network: tcp, tcp4 or tcp6", false, func(cfg *Config, v string) error {
+		cfg.Network = v
+		return nil
+	}},
+	{"storage-backend", "storage backend: file or memory", false, func(cfg *Config, v string) error {
+		cfg.Storage.Backend = v
+		return nil
+	}},
+	{"storage-file", "storage file name", false, func(cfg *Config, v string) error {
+		cfg.Storage.File = v
+		return nil
+	}},
+	{"storage-key-file", "file with storage encryption key (32 bytes in base64)", false, func(cfg *Config, v string) error {
+		cfg.Storage.KeyFile = v
+		return nil
+	}},
+	{"storage-key-env", "environment variable with storage encryption key (32 bytes in base64)", false, func(cfg *Config, v string) error {
+		cfg.Storage.KeyEnv = v
+		return nil
+	}},
+	{"tls-cert", "TLS certificate file", false, func(cfg *Config, v string) error {
+		cfg.TLS.CertFile = v
+		return nil
+	}},
+	{"tls-key", "TLS key file", false, func(cfg *Config, v string) error {
+		cfg.TLS.KeyFile = v
+		return nil
+	}},
+	{"tls-client-ca", "CA file of client certificates (mapping is set in config file)", false, func(cfg *Config, v string) error {
+		cfg.TLS.ClientCAFile = v
+		return nil
+	}},
+	{"tls-crl", "CRL file of client CA", false, func(cfg *Config, v string) error {
+		cfg.TLS.CRLFile = v
+		return nil
+	}},
+	{"http-listen", "HTTP address for /metrics, /healthz and /readyz (empty - off)", false, func(cfg *Config, v string) error {
+		cfg.HTTP.Listen = v
+		return nil
+	}},
+	{"pprof-listen", "admin only HTTP address for /debug/pprof/ (empty - off)", false, func(cfg *Config, v string) error {
+		cfg.HTTP.PprofListen = v
+		return nil
+	}},
+	{"admin-socket", "admin control socket path (empty - off)", false, func(cfg *Config, v string) error {
+		cfg.Admin.Socket = v
+		return nil
+	}},
+	{"audit-file", "audit log file (empty - off)", false, func(cfg *Config, v string) error {
+		cfg.Audit.File = v
+		return nil
+	}},
+	{"audit-max-size", "rotate audit log when bigger (MB)", false, func(cfg *Config, v string) error {
+		return setInt(&cfg.Audit.MaxSizeMB, v)
+	}},
+	{"audit-max-files", "number of rotated audit log files to keep", false, func(cfg *Config, v string) error {
+		return setInt(&cfg.Audit.MaxFiles, v)
+	}},
+	{"nickname-min-length", "min nickname length (characters)", false, func(cfg *Config, v string) error {
+		return setInt(&cfg.Nickname.MinLength, v)
+	}},
+	{"nickname-max-length", "max nickname length (characters)", false, func(cfg *Config, v string) error {
+		return setInt(&cfg.Nickname.MaxLength, v)
+	}},
+	{"reserved-nicknames", "nicknames nobody can register, comma separated", false, func(cfg *Config, v string) error {
+		cfg.Nickname.Reserved = splitList(v)
+		return nil
+	}},
+	{"password-min-length", "min password length (characters)", false, func(cfg *Config, v string) error {
+		return setInt(&cfg.Password.MinLength, v)
+	}},
+	{"breached-passwords-file", "file of breached passwords (plain or SHA-1 hex) to refuse (empty - off)", false, func(cfg *Config, v string) error {
+		cfg.Password.BreachedFile = v
+		return nil
+	}},
+	{"password-history", "number of last passwords that can't be reused (0 - off)", false, func(cfg *Config, v string) error {
+		return setInt(&cfg.Password.History, v)
+	}},
+	{"auth-backends", "authentication backends in order: local, htpasswd, ldap (comma separated)", false, func(cfg *Config, v string) error {
+		cfg.Auth.Backends = splitList(v)
+		return nil
+	}},
+	{"htpasswd-file", "htpasswd file with bcrypt hashes for htpasswd backend", false, func(cfg *Config, v string) error {
+		cfg.Auth.HtpasswdFile = v
+		return nil
+	}},
+	{"ldap-url", "LDAP server for ldap backend (ldap://host or ldaps://host)", false, func(cfg *Config, v string) error {
+		cfg.Auth.LDAP.URL = v
+		return nil
+	}},
+	{"ldap-bind-dn", "LDAP bind DN template, i.e. uid={user},ou=people,dc=example,dc=com", false, func(cfg *Config, v string) error {
+		cfg.Auth.LDAP.BindDN = v
+		return nil
+	}},
+	{"max-connections", "max concurrent connections (0 - unlimited)", false, func(cfg *Config, v string) error {
+		return setInt(&cfg.ConnectionLimits.MaxConnections, v)
+	}},
+	{"max-connections-per-ip", "max concurrent connections from one IP (0 - unlimited)", false, func(cfg *Config, v string) error {
+		return setInt(&cfg.ConnectionLimits.MaxConnectionsPerIP, v)
+	}},
+	{"max-failed-logins", "failed logins before lockout (0 - no lockout)", false, func(cfg *Config, v string) error {
+		return setInt(&cfg.RateLimits.MaxFailedLogins, v)
+	}},
+	{"lockout-duration", "lockout duration after failed logins (i.e. 5m)", false, func(cfg *Config, v string) error {
+		return cfg.RateLimits.LockoutDuration.UnmarshalText([]byte(v))
+	}},
+	{"log-level", "log level: debug, info, warn or error", false, func(cfg *Config, v string) error {
+		return cfg.Log.Level.UnmarshalText([]byte(v))
+	}},
+	{"log-format", "log format: text or json", false, func(cfg *Config, v string) error {
+		cfg.Log.Format = v
+		return nil
+	}},
+	{"test-mode", "allow 'Clear' command for everybody (for tests only)", true, func(cfg *Config, v string) (err error) {
+		cfg.TestMode, err = strconv.ParseBool(v)
+		return err
+	}},
+}
+
+// optionValue - flag.Value of configOption
+type optionValue struct {
+	value  string
+	isBool bool
+}
+
+// String - flag.Value interface
+func (v *optionValue) String() string {
+	return v.value
+}
+
+// Set - flag.Value interface
+func (v *optionValue) Set(s string) error {
+	v.value = s
+	return nil
+}
+
+// IsBoolFlag - allows '-flag' without value for boolean options
+func (v *optionValue) IsBoolFlag() bool {
+	return v.isBool
+}
+
+// splitList - split comma separated list
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// setInt - parse int setting
+func setInt(dst *int, s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*dst = n
+	return nil
+}
+
+// Duration - time.Duration written as text in config (i.e. "5m")
+type Duration time.Duration
+
+// MarshalText - encode duration as text
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText - decode duration from text
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "messenger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "config.json")
+	data := `{
+		"Listen": [":2222"],
+		"Storage": {"Backend": "memory"},
+		"ConnectionLimits": {"MaxConnections": 5, "MaxConnectionsPerIP": 2},
+		"RateLimits": {"LockoutDuration": "1m"}
+	}`
+	if err := ioutil.WriteFile(fn, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("MESSENGER_MAX_CONNECTIONS", "7")
+	os.Setenv("MESSENGER_LISTEN", ":3333")
+	defer os.Unsetenv("MESSENGER_MAX_CONNECTIONS")
+	defer os.Unsetenv("MESSENGER_LISTEN")
+
+	cfg, printConfig, err := LoadConfig([]string{"-config", fn, "-listen", ":4444,:5555", "-log-level", "debug", "-print-config"})
+	if err != nil {
+		t.Error("LoadConfig error: ", err)
+		return
+	}
+
+	// flag > env > file > default
+	if len(cfg.Listen) != 2 || cfg.Listen[0] != ":4444" || cfg.Listen[1] != ":5555" {
+		t.Error("Listen: ", cfg.Listen)
+	}
+	if cfg.ConnectionLimits.MaxConnections != 7 {
+		t.Error("MaxConnections: ", cfg.ConnectionLimits.MaxConnections)
+	}
+	if cfg.ConnectionLimits.MaxConnectionsPerIP != 2 {
+		t.Error("MaxConnectionsPerIP: ", cfg.ConnectionLimits.MaxConnectionsPerIP)
+	}
+	if cfg.Storage.Backend != StorageMemory {
+		t.Error("Storage: ", cfg.Storage.Backend)
+	}
+	if time.Duration(cfg.RateLimits.LockoutDuration) != time.Minute {
+		t.Error("LockoutDuration: ", cfg.RateLimits.LockoutDuration)
+	}
+	if cfg.Network != "tcp4" {
+		t.Error("Network: ", cfg.Network)
+	}
+	if cfg.Log.Level != slog.LevelDebug || !printConfig {
+		t.Error("Log level / print config: ", cfg.Log.Level, printConfig)
+	}
+
+	// invalid values
+	if _, _, err := LoadConfig([]string{"-storage-backend", "sql"}); err == nil {
+		t.Error("Expected invalid backend error")
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnectionLimits - max concurrent connections (0 means unlimited)
+type ConnectionLimits struct {
+	// Max connections in total
+	MaxConnections int
+	// Max connections from one IP address
+	MaxConnectionsPerIP int
+}
+
+// DefaultConnectionLimits - default connection limits
+func DefaultConnectionLimits() ConnectionLimits {
+	return ConnectionLimits{MaxConnections: 1000, MaxConnectionsPerIP: 20}
+}
+
+// connLimiter - counts accepted connections
+type connLimiter struct {
+	limits ConnectionLimits
+	total  int
+	perIP  map[string]int
+	mutex  sync.Mutex
+}
+
+// newConnLimiter - connLimiter constructor
+func newConnLimiter(limits ConnectionLimits) *connLimiter {
+	cl := new(connLimiter)
+	cl.limits = limits
+	cl.perIP = make(map[string]int)
+	return cl
+}
+
+// setLimits - change limits (open connections are not closed)
+func (cl *connLimiter) setLimits(limits ConnectionLimits) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	cl.limits = limits
+}
+
+// acquire - register a new connection from ip.
+// It returns the reason the connection is rejected or "" if it's admitted.
+func (cl *connLimiter) acquire(ip string) string {
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	if cl.limits.MaxConnections > 0 && cl.total >= cl.limits.MaxConnections {
+		return "Server is full. Please try again later."
+	}
+	if cl.limits.MaxConnectionsPerIP > 0 && cl.perIP[ip] >= cl.limits.MaxConnectionsPerIP {
+		return "Too many connections from your address. Please try again later."
+	}
+
+	cl.total++
+	cl.perIP[ip]++
+
+	return ""
+}
+
+// release - unregister closed connection
+func (cl *connLimiter) release(ip string) {
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	cl.total--
+	if cl.perIP[ip]--; cl.perIP[ip] <= 0 {
+		delete(cl.perIP, ip)
+	}
+}
+
+// acceptBackoff - delay before retrying temporary accept failure after 'delay'
+// (0 - the previous accept succeeded): 5ms doubled up to 1s
+func acceptBackoff(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > time.Second {
+		return time.Second
+	}
+	return delay
+}
+
+// remoteIP - IP address of the connection peer (without port)
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return ip
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimiter(t *testing.T) {
+
+	cl := newConnLimiter(ConnectionLimits{MaxConnections: 3, MaxConnectionsPerIP: 2})
+
+	for i, c := range []struct {
+		ip       string
+		admitted bool
+	}{
+		{"10.0.0.1", true},
+		{"10.0.0.1", true},
+		{"10.0.0.1", false}, // per IP
+		{"10.0.0.2", true},
+		{"10.0.0.3", false}, // total
+	} {
+		if reason := cl.acquire(c.ip); (reason == "") != c.admitted {
+			t.Errorf("%d %s: admitted=%v, got %q", i+1, c.ip, c.admitted, reason)
+		}
+	}
+
+	// released connections free both limits
+	cl.release("10.0.0.1")
+	if reason := cl.acquire("10.0.0.3"); reason != "" {
+		t.Error("Total limit is not released: ", reason)
+	}
+	cl.release("10.0.0.2")
+	if reason := cl.acquire("10.0.0.1"); reason != "" {
+		t.Error("Per IP limit is not released: ", reason)
+	}
+	cl.release("10.0.0.1")
+	cl.release("10.0.0.1")
+	cl.release("10.0.0.3")
+	if cl.total != 0 || len(cl.perIP) != 0 {
+		t.Error("Not released: ", cl.total, cl.perIP)
+	}
+
+	// unlimited
+	cl.setLimits(ConnectionLimits{})
+	for i := 0; i < 10; i++ {
+		if reason := cl.acquire("10.0.0.1"); reason != "" {
+			t.Fatal(reason)
+		}
+	}
+}
+
+func TestAcceptBackoff(t *testing.T) {
+
+	delay := time.Duration(0)
+	for _, expected := range []time.Duration{5, 10, 20, 40, 80, 160, 320, 640, 1000, 1000} {
+		if delay = acceptBackoff(delay); delay != expected*time.Millisecond {
+			t.Errorf("Expected %v, got %v", expected*time.Millisecond, delay)
+		}
+	}
+}
+
+// temporaryError - temporary accept failure (i.e. too many open files)
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// testListener - listener returning queued connections and errors
+type testListener struct {
+	accepts chan interface{}
+}
+
+func (l *testListener) Accept() (net.Conn, error) {
+	a, ok := <-l.accepts
+	if !ok {
+		return nil, errors.New("closed")
+	}
+	if err, ok := a.(error); ok {
+		return nil, err
+	}
+	return a.(net.Conn), nil
+}
+
+func (l *testListener) Close() error   { return nil }
+func (l *testListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestAdmission(t *testing.T) {
+
+	srv := newTestServer(t)
+	srv.conns = newConnLimiter(ConnectionLimits{MaxConnections: 2})
+
+	listener := &testListener{accepts: make(chan interface{}, 10)}
+	done := make(chan bool)
+	go func() {
+		srv.serve(listener)
+		close(done)
+	}()
+
+	// temporary errors are retried
+	listener.accepts <- temporaryError{}
+	listener.accepts <- temporaryError{}
+
+	clients := []net.Conn{}
+	for i := 0; i < 3; i++ {
+		client, server := net.Pipe()
+		defer client.Close()
+		clients = append(clients, client)
+		listener.accepts <- server
+	}
+
+	// the third one is over the limit
+	client := clients[2]
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg protocol.MessageFromServer
+	msg.Decode(line)
+	if msg.Type != protocol.Notice || msg.NoticeCode() != protocol.NoticeServerFull || msg.NoticeText() != "Server is full. Please try again later." {
+		t.Error("Expected server full notice: ", line)
+	}
+
+	// closed connections are released
+	clients[0].Close()
+	clients[1].Close()
+	for i := 0; ; i++ {
+		srv.conns.mutex.Lock()
+		total := srv.conns.total
+		srv.conns.mutex.Unlock()
+		if total == 0 {
+			break
+		}
+		if i == 500 {
+			t.Fatal("Connections are not released: ", total)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// other errors stop the accept loop
+	close(listener.accepts)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Accept loop is not stopped")
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// portable export format
+const (
+	constExportFormat  = "messenger-export"
+	constExportVersion = 1
+)
+
+// DbExport - portable JSON format of the whole storage (backup, export, migration
+// between storage backends):
+//
+//	{
+//	 "Format": "messenger-export",
+//	 "Version": 1,
+//	 "Created": "2024-05-01T10:00:00Z",
+//	 "Users": [{"Name": "alice", "PasswordHash": "$2a$...", ...}, ...],
+//	 "IPBans": {"10.0.0.1": {"By": "admin", ...}}
+//	}
+//
+// Users are sorted by name and have the fields of UserInfo (empty ones are omitted).
+// A backup is the same JSON encrypted with the storage key (when it is set).
+type DbExport struct {
+	Format  string
+	Version int
+	Created time.Time
+	Users   []*UserInfo
+	IPBans  map[string]*Restriction `json:",omitempty"`
+}
+
+// Backup - write consistent snapshot of storage to file ('encrypt' - with storage
+// key if it is set); returns number of users
+func (db *LocalDb) Backup(fileName string, encrypt bool) (int, error) {
+
+	if db.isDbFile(fileName) {
+		return 0, errors.New("Backup can't overwrite the database file")
+	}
+
+	// changes wait until the snapshot is encoded
+	db.mutex.RLock()
+	export := DbExport{Format: constExportFormat, Version: constExportVersion, Created: time.Now().UTC(),
+		Users: []*UserInfo{}, IPBans: db.ipBans}
+	for _, user := range db.users {
+		export.Users = append(export.Users, user)
+	}
+	sort.Slice(export.Users, func(i, j int) bool { return export.Users[i].Name < export.Users[j].Name })
+	data, err := json.MarshalIndent(export, "", " ")
+	db.mutex.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	if encrypt {
+		if data, err = encryptDb(db.key, data); err != nil {
+			return 0, err
+		}
+	}
+	if err := writeFileAtomic(fileName, data, constDbFileMode); err != nil {
+		return 0, err
+	}
+
+	db.logger.Info("db backup written", "file", fileName, "users", len(export.Users), "encrypted", encrypt && db.key != nil)
+	return len(export.Users), nil
+}
+
+// Restore - load backup or export file into empty storage ('merge' - add users
+// to not empty storage); nothing is changed if it fails. Returns number of users.
+func (db *LocalDb) Restore(fileName string, merge bool) (int, error) {
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+	data, _, err = decryptDb(db.key, data)
+	if err != nil {
+		return 0, err
+	}
+	export, err := parseExport(data)
+	if err != nil {
+		return 0, err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if !merge && (len(db.users) > 0 || len(db.ipBans) > 0) {
+		return 0, errors.New("Database is not empty (use 'db import' to add users)")
+	}
+
+	// add users (same checks as registration)
+	added := []string{}
+	undo := func() {
+		for _, name := range added {
+			delete(db.users, name)
+		}
+	}
+	for _, user := range export.Users {
+		if err := db.checkUnique(user.Name, ""); err != nil {
+			undo()
+			return 0, err
+		}
+		db.users[user.Name] = user
+		added = append(added, user.Name)
+	}
+
+	// existing IP bans are kept
+	bans := []string{}
+	for ip, r := range export.IPBans {
+		if _, ok := db.ipBans[ip]; !ok && r != nil {
+			db.ipBans[ip] = r
+			bans = append(bans, ip)
+		}
+	}
+
+	if err := db.save(); err != nil {
+		undo()
+		for _, ip := range bans {
+			delete(db.ipBans, ip)
+		}
+		return 0, err
+	}
+
+	db.logger.Info("db backup restored", "file", fileName, "users", len(added), "merge", merge)
+	return len(added), nil
+}
+
+// parseExport - decode and check export format
+func parseExport(data []byte) (*DbExport, error) {
+
+	var export DbExport
+	if err := json.Unmarshal(data, &export); err != nil || export.Format != constExportFormat {
+		return nil, errors.New("Not a backup or export file")
+	}
+	if export.Version < 1 || export.Version > constExportVersion {
+		return nil, errors.New("Unsupported export version " + strconv.Itoa(export.Version))
+	}
+
+	for i, user := range export.Users {
+		if user == nil || user.Name == "" {
+			return nil, errors.New("User " + strconv.Itoa(i+1) + " has no name")
+		}
+		if user.passwordHash() == "" && user.Auth == "" {
+			return nil, errors.New("User '" + user.Name + "' has no password")
+		}
+	}
+
+	return &export, nil
+}
+
+// isDbFile - file name is the db file or its journal
+func (db *LocalDb) isDbFile(fileName string) bool {
+
+	if db.fileName == "" {
+		return false
+	}
+	a, err1 := filepath.Abs(fileName)
+	b, err2 := filepath.Abs(db.fileName)
+
+	return err1 == nil && err2 == nil && (a == b || a == b+constJournalExt)
+}
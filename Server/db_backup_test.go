@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDbBackup(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "messenger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "db.json")
+	backup := filepath.Join(dir, "backup.json")
+	export := filepath.Join(dir, "export.json")
+
+	db := NewLocalDb(fn, slog.Default())
+	db.SetKey(bytes.Repeat([]byte{1}, constDbKeySize))
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.AddUser("alice", "$2a$hash", nil)
+	db.AddUser("bob", "$2a$hash", nil)
+	db.SetRole("alice", "admin")
+	db.UpdateRoster("alice", "bob", RosterRequest)
+	db.UpdateRoster("bob", "alice", RosterAccept)
+	db.SetRestriction(RestrictionIPBan, "10.0.0.1", newRestriction("admin", 0, "spam"))
+
+	if n, err := db.Backup(backup, true); err != nil || n != 2 {
+		t.Fatal(n, err)
+	}
+	if n, err := db.Backup(export, false); err != nil || n != 2 {
+		t.Fatal(n, err)
+	}
+	if _, err := db.Backup(fn, true); err == nil {
+		t.Error("Expected error: backup over db file")
+	}
+
+	data, _ := ioutil.ReadFile(backup)
+	if bytes.Contains(data, []byte("alice")) {
+		t.Error("Backup is not encrypted")
+	}
+	data, _ = ioutil.ReadFile(export)
+	if !bytes.Contains(data, []byte(`"Format": "messenger-export"`)) || !bytes.Contains(data, []byte("alice")) {
+		t.Error("Invalid export: ", string(data))
+	}
+
+	// accidental Clear
+	db.Clear()
+	if n, err := db.Restore(backup, false); err != nil || n != 2 {
+		t.Fatal(n, err)
+	}
+	if db.GetRole("alice") != "admin" || db.GetRestriction(RestrictionIPBan, "10.0.0.1") == nil {
+		t.Error("Not restored")
+	}
+	if p, _ := db.GetPrivacy("bob"); len(p.Contacts) != 1 || p.Contacts[0] != "alice" {
+		t.Error("Contacts are not restored: ", p.Contacts)
+	}
+	if _, err := db.Restore(backup, false); err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Error("Expected not empty error: ", err)
+	}
+
+	// another backend (memory, no key)
+	memory := NewLocalDb("", slog.Default())
+	memory.Init()
+	if _, err := memory.Restore(backup, false); err == nil {
+		t.Error("Expected error: backup is encrypted")
+	}
+	if n, err := memory.Restore(export, false); err != nil || n != 2 || !memory.DoesUserExist("bob") {
+		t.Fatal(n, err)
+	}
+
+	// import is all or nothing
+	memory = NewLocalDb("", slog.Default())
+	memory.Init()
+	memory.AddUser("Bob", "$2a$hash", nil)
+	if _, err := memory.Restore(export, true); err == nil || memory.DoesUserExist("alice") {
+		t.Error("Expected conflict error: ", err)
+	}
+	memory.DeleteUser("Bob")
+	memory.AddUser("carol", "$2a$hash", nil)
+	if n, err := memory.Restore(export, true); err != nil || n != 2 || len(memory.GetUserList()) != 3 {
+		t.Error("Import failed: ", n, err)
+	}
+
+	ioutil.WriteFile(export, []byte(`{"Format": "messenger-export", "Version": 2}`), 0600)
+	if _, err := memory.Restore(export, true); err == nil {
+		t.Error("Expected version error")
+	}
+}
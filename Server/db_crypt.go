@@ -0,0 +1,144 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// db file encryption
+const (
+	constDbCipher  = "AES-256-GCM"
+	constDbKeySize = 32
+)
+
+// encryptedDb - encrypted db file ({"Encrypted": {...}})
+type encryptedDb struct {
+	Algorithm string
+	// storageKeyID of the key
+	KeyID string
+	// base64 GCM nonce and ciphertext of JSON db file
+	Nonce string
+	Data  string
+}
+
+// dbEnvelope - db file that may be encrypted
+type dbEnvelope struct {
+	Encrypted *encryptedDb `json:",omitempty"`
+}
+
+// readStorageKey - storage encryption key from file or environment variable (nil - no encryption)
+func readStorageKey(cfg StorageConfig) ([]byte, error) {
+
+	switch {
+	case cfg.KeyFile != "":
+		data, err := ioutil.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return parseStorageKey(string(data))
+	case cfg.KeyEnv != "":
+		v := os.Getenv(cfg.KeyEnv)
+		if v == "" {
+			return nil, errors.New("Storage key variable " + cfg.KeyEnv + " is not set")
+		}
+		return parseStorageKey(v)
+	}
+
+	return nil, nil
+}
+
+// parseStorageKey - base64 key (i.e. 'head -c 32 /dev/urandom | base64')
+func parseStorageKey(v string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+	if err != nil || len(key) != constDbKeySize {
+		return nil, errors.New("Storage key must be 32 random bytes in base64")
+	}
+	return key, nil
+}
+
+// storageKeyID - key identifier stored with encrypted data (the key can't be derived from it)
+func storageKeyID(key []byte) string {
+	sum := sha256.Sum256(append([]byte("messenger storage key "), key...))
+	return hex.EncodeToString(sum[:4])
+}
+
+// dbAEAD - AES-256-GCM of key
+func dbAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptDb - encrypt db file content (nil key - content as is)
+func encryptDb(key, data []byte) ([]byte, error) {
+
+	if key == nil {
+		return data, nil
+	}
+
+	aead, err := dbAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	id := storageKeyID(key)
+	sealed := aead.Seal(nil, nonce, data, []byte(constDbCipher+" "+id))
+
+	return json.MarshalIndent(dbEnvelope{Encrypted: &encryptedDb{
+		Algorithm: constDbCipher,
+		KeyID:     id,
+		Nonce:     base64.StdEncoding.EncodeToString(nonce),
+		Data:      base64.StdEncoding.EncodeToString(sealed),
+	}}, "", " ")
+}
+
+// decryptDb - decrypt db file content (not encrypted content is returned as is);
+// 'encrypted' tells if the content was encrypted
+func decryptDb(key, data []byte) (plain []byte, encrypted bool, err error) {
+
+	var envelope dbEnvelope
+	if json.Unmarshal(data, &envelope) != nil || envelope.Encrypted == nil || envelope.Encrypted.Algorithm == "" {
+		return data, false, nil
+	}
+	e := envelope.Encrypted
+
+	if e.Algorithm != constDbCipher {
+		return nil, true, errors.New("Unsupported db encryption '" + e.Algorithm + "'")
+	}
+	if key == nil {
+		return nil, true, errors.New("Db file is encrypted, set storage key (-storage-key-file or -storage-key-env)")
+	}
+	if id := storageKeyID(key); id != e.KeyID {
+		return nil, true, errors.New("Wrong storage key: db file is encrypted with key " + e.KeyID + ", the configured key is " + id)
+	}
+
+	nonce, err1 := base64.StdEncoding.DecodeString(e.Nonce)
+	sealed, err2 := base64.StdEncoding.DecodeString(e.Data)
+	aead, err := dbAEAD(key)
+	if err != nil {
+		return nil, true, err
+	}
+	if err1 != nil || err2 != nil || len(nonce) != aead.NonceSize() {
+		return nil, true, errors.New("Encrypted db file is damaged")
+	}
+	plain, err = aead.Open(nil, nonce, sealed, []byte(constDbCipher+" "+e.KeyID))
+	if err != nil {
+		return nil, true, errors.New("Encrypted db file is damaged or modified")
+	}
+
+	return plain, true, nil
+}
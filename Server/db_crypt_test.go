@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDbEncryption(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "messenger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key1 := bytes.Repeat([]byte{1}, constDbKeySize)
+	key2 := bytes.Repeat([]byte{2}, constDbKeySize)
+	keyFile := filepath.Join(dir, "key")
+	ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key2)+"\n"), 0600)
+
+	fn := filepath.Join(dir, "db.json")
+	open := func(key []byte) (*LocalDb, error) {
+		db := NewLocalDb(fn, slog.Default())
+		db.SetKey(key)
+		return db, db.Init()
+	}
+
+	// plain file is encrypted on first open with key
+	db, err := open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AddUser("alice", "$2a$hash", nil)
+	db.Close()
+
+	if db, err = open(key1); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	data, _ := ioutil.ReadFile(fn)
+	if bytes.Contains(data, []byte("alice")) || !bytes.Contains(data, []byte(constDbCipher)) {
+		t.Fatal("File is not encrypted: ", string(data))
+	}
+
+	for _, c := range []struct {
+		key []byte
+		err string
+	}{
+		{nil, "is encrypted"},
+		{key2, "Wrong storage key"},
+	} {
+		if db, err := open(c.key); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("Expected %q error: %v", c.err, err)
+			if err == nil {
+				db.Close()
+			}
+		}
+	}
+
+	// modified data
+	modified := bytes.Replace(data, []byte(`"Data": "`), []byte(`"Data": "AAAA`), 1)
+	ioutil.WriteFile(fn, modified, 0600)
+	if _, err := open(key1); err == nil || !strings.Contains(err.Error(), "damaged") {
+		t.Error("Expected damaged file error: ", err)
+	}
+	ioutil.WriteFile(fn, data, 0600)
+
+	// rotation with admin command
+	key1File := filepath.Join(dir, "key1")
+	ioutil.WriteFile(key1File, []byte(base64.StdEncoding.EncodeToString(key1)), 0600)
+	rekey := func(currentKey, newKey string) {
+		var out bytes.Buffer
+		args := []string{"db", "rekey", "-storage-file", fn, "-audit-file", filepath.Join(dir, "audit.log")}
+		if currentKey != "" {
+			args = append(args, "-storage-key-file", currentKey)
+		}
+		if code := RunAdminCommand(append(args, newKey), strings.NewReader(""), &out, &out); code != 0 {
+			t.Fatal("db rekey: ", out.String())
+		}
+	}
+
+	rekey(key1File, keyFile)
+	if db, err = open(key2); err != nil {
+		t.Fatal(err)
+	}
+	if !db.DoesUserExist("alice") {
+		t.Error("User is lost")
+	}
+	db.Close()
+
+	rekey(keyFile, "none")
+	if db, err = open(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if !db.DoesUserExist("alice") {
+		t.Error("User is lost after decryption")
+	}
+
+	if _, err := parseStorageKey("c2hvcnQ="); err == nil {
+		t.Error("Expected key size error")
+	}
+}
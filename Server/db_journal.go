@@ -0,0 +1,345 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// db journal (write-ahead log of changes since the last snapshot)
+const (
+	constJournalExt = ".journal"
+	// journal records before the db file is rewritten
+	constJournalCompact = 1000
+)
+
+// journalRecord - new state of changed users and IP bans (nil - deleted)
+type journalRecord struct {
+	Users  map[string]*UserInfo    `json:",omitempty"`
+	IPBans map[string]*Restriction `json:",omitempty"`
+}
+
+// journal line: "<crc32 of the rest> <seq> <record JSON, encrypted if key is set>\n"
+// (seq is not encrypted: records older than the db file are skipped without key)
+
+// writeFileAtomic - replace file: write temp file, flush it and rename over the old one
+func writeFileAtomic(fileName string, data []byte, perm os.FileMode) error {
+
+	tmpName := fileName + ".tmp"
+	f, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, fileName)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return syncDir(filepath.Dir(fileName))
+}
+
+// journalName - journal file of db file
+func (db *LocalDb) journalName() string {
+	return db.fileName + constJournalExt
+}
+
+// openJournal - open journal for appending
+func (db *LocalDb) openJournal() error {
+
+	f, err := os.OpenFile(db.journalName(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, constDbFileMode)
+	if err != nil {
+		db.logger.Error("can't open db journal", "file", db.journalName(), "err", err)
+		return err
+	}
+	db.journal = f
+
+	return nil
+}
+
+// closeJournal - close journal file
+func (db *LocalDb) closeJournal() error {
+
+	if db.journal == nil {
+		return nil
+	}
+	err := db.journal.Close()
+	db.journal = nil
+
+	return err
+}
+
+// stateOf - copy of users and IP bans before change (nil - not exist);
+// commit writes their new state or restores this one if it fails
+func (db *LocalDb) stateOf(users []string, ips []string) journalRecord {
+
+	before := journalRecord{Users: make(map[string]*UserInfo), IPBans: make(map[string]*Restriction)}
+	for _, name := range users {
+		before.Users[name] = cloneUser(db.users[name])
+	}
+	// restrictions are replaced, not changed
+	for _, ip := range ips {
+		before.IPBans[ip] = db.ipBans[ip]
+	}
+
+	return before
+}
+
+// rollback - restore users and IP bans changed after stateOf
+func (db *LocalDb) rollback(before journalRecord) {
+
+	for name, old := range before.Users {
+		user, ok := db.users[name]
+		switch {
+		case old == nil:
+			delete(db.users, name)
+		case ok:
+			// the same object: sessions keep pointers to it
+			copyStored(user, old)
+		default:
+			db.users[name] = old
+		}
+	}
+	for ip, r := range before.IPBans {
+		if r == nil {
+			delete(db.ipBans, ip)
+		} else {
+			db.ipBans[ip] = r
+		}
+	}
+}
+
+// cloneUser - copy of saved fields of user (nil - nil)
+func cloneUser(user *UserInfo) *UserInfo {
+
+	if user == nil {
+		return nil
+	}
+	data, _ := json.Marshal(user)
+	clone := new(UserInfo)
+	json.Unmarshal(data, clone)
+
+	return clone
+}
+
+// copyStored - set saved (exported) fields of user
+func copyStored(user, from *UserInfo) {
+	dst, src := reflect.ValueOf(user).Elem(), reflect.ValueOf(from).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		if dst.Type().Field(i).IsExported() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
+
+// commit - write new state of users and IP bans changed after stateOf to
+// journal (the db file is rewritten after constJournalCompact records);
+// the change is rolled back if it can't be written
+func (db *LocalDb) commit(before journalRecord) error {
+
+	// memory only
+	if db.fileName == "" {
+		return nil
+	}
+
+	// not open yet (Init) or journal is broken - write everything
+	var err error
+	if db.journal == nil {
+		err = db.save()
+	} else {
+		err = db.writeJournal(before)
+	}
+	if err != nil {
+		db.rollback(before)
+		return err
+	}
+
+	// the change is in journal already
+	if db.journalRecords >= constJournalCompact {
+		if err := db.save(); err != nil {
+			db.logger.Error("can't compact db journal", "file", db.journalName(), "err", err)
+		}
+	}
+
+	return nil
+}
+
+// writeJournal - append record with current state of users and IP bans of 'changed'
+func (db *LocalDb) writeJournal(changed journalRecord) error {
+
+	start := time.Now()
+
+	record := journalRecord{Users: make(map[string]*UserInfo)}
+	for name := range changed.Users {
+		record.Users[name] = db.users[name]
+	}
+	if len(changed.IPBans) > 0 {
+		record.IPBans = make(map[string]*Restriction)
+		for ip := range changed.IPBans {
+			record.IPBans[ip] = db.ipBans[ip]
+		}
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if data, err = encryptDb(db.key, data); err != nil {
+		return err
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, data); err != nil {
+		return err
+	}
+
+	line := strconv.FormatUint(db.seq+1, 10) + " " + compact.String()
+	line = fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE([]byte(line)), line)
+
+	// a partly written record is cut off (it must not be applied on start)
+	info, err := db.journal.Stat()
+	if err != nil {
+		db.writeErr = err
+		return err
+	}
+	if _, err = db.journal.WriteString(line); err == nil {
+		err = db.journal.Sync()
+	}
+	if err != nil {
+		db.logger.Error("can't write db journal", "file", db.journalName(), "err", err)
+		db.journal.Truncate(info.Size())
+		db.writeErr = err
+		return err
+	}
+	db.writeErr = nil
+	db.seq++
+	db.journalRecords++
+
+	if db.onSave != nil {
+		db.onSave(time.Since(start))
+	}
+
+	return nil
+}
+
+// truncateJournal - empty journal after the db file is written
+func (db *LocalDb) truncateJournal() error {
+
+	db.journalRecords = 0
+	if db.journal == nil {
+		return nil
+	}
+	if err := db.journal.Truncate(0); err != nil {
+		return err
+	}
+
+	return db.journal.Sync()
+}
+
+// replayJournal - apply journal records newer than the db file; a damaged
+// last record (crash during write) is dropped, damage before valid records
+// is an error. Returns number of applied records.
+func (db *LocalDb) replayJournal() (int, error) {
+
+	f, err := os.Open(db.journalName())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	applied := 0
+	reader := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return applied, nil
+		}
+		if err != nil && err != io.EOF {
+			return applied, err
+		}
+
+		// crash during write damages the last line only
+		seq, data, ok := parseJournalLine(line)
+		if !ok {
+			if _, err := reader.Peek(1); err != io.EOF {
+				return applied, errors.New("Db journal is damaged at line " + strconv.Itoa(n) + ", records after it can't be applied")
+			}
+			db.logger.Warn("db journal is truncated, the last record is dropped", "file", db.journalName(), "line", n)
+			return applied, nil
+		}
+		// already in the db file
+		if seq <= db.seq {
+			continue
+		}
+
+		// with key every record must be authenticated (only db file is
+		// encrypted on start, see load)
+		data, encrypted, err := decryptDb(db.key, data)
+		if err != nil {
+			return applied, err
+		}
+		if db.key != nil && !encrypted {
+			return applied, errors.New("Db journal record " + strconv.Itoa(n) + " is not encrypted (start without storage key to apply it)")
+		}
+		var record journalRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return applied, errors.New("Invalid db journal record " + strconv.Itoa(n) + ": " + err.Error())
+		}
+
+		for name, user := range record.Users {
+			if user == nil {
+				delete(db.users, name)
+			} else {
+				db.users[name] = user
+			}
+		}
+		for ip, r := range record.IPBans {
+			if r == nil {
+				delete(db.ipBans, ip)
+			} else {
+				db.ipBans[ip] = r
+			}
+		}
+		db.seq = seq
+		applied++
+	}
+}
+
+// parseJournalLine - sequence number and record of complete journal line
+func parseJournalLine(line []byte) (uint64, []byte, bool) {
+
+	line, complete := bytes.CutSuffix(line, []byte("\n"))
+	sum, rest, ok := bytes.Cut(line, []byte(" "))
+	if !complete || !ok || fmt.Sprintf("%08x", crc32.ChecksumIEEE(rest)) != string(sum) {
+		return 0, nil, false
+	}
+
+	seqText, data, ok := bytes.Cut(rest, []byte(" "))
+	seq, err := strconv.ParseUint(string(seqText), 10, 64)
+	if !ok || err != nil {
+		return 0, nil, false
+	}
+
+	return seq, data, true
+}
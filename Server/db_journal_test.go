@@ -0,0 +1,237 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDbJournal(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "messenger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "db.json")
+	open := func(key []byte) *LocalDb {
+		db := NewLocalDb(fn, slog.Default())
+		db.SetKey(key)
+		if err := db.Init(); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	// crash - stop without writing journal to db file
+	crash := func(db *LocalDb) {
+		db.closeJournal()
+		unlockFile(fn)
+	}
+	journal := func() []byte {
+		data, _ := ioutil.ReadFile(fn + constJournalExt)
+		return data
+	}
+
+	// changes are in journal only
+	db := open(nil)
+	db.AddUser("alice", "$2a$hash", nil)
+	db.AddUser("bob", "$2a$hash", nil)
+	db.SetRole("alice", "admin")
+	db.SetRestriction(RestrictionIPBan, "10.0.0.1", newRestriction("admin", 0, "spam"))
+	data, _ := ioutil.ReadFile(fn)
+	if bytes.Contains(data, []byte("alice")) || !bytes.Contains(journal(), []byte("alice")) {
+		t.Fatal("Changes are not in journal")
+	}
+	crash(db)
+
+	// damaged tail of journal is dropped
+	before := journal()
+	f, _ := os.OpenFile(fn+constJournalExt, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString("0badc0de 5 {\"Users\":{\"mallory\"")
+	f.Close()
+
+	db = open(nil)
+	if !db.DoesUserExist("alice") || !db.DoesUserExist("bob") || db.DoesUserExist("mallory") ||
+		db.GetRole("alice") != "admin" || db.GetRestriction(RestrictionIPBan, "10.0.0.1") == nil {
+		t.Fatal("Journal is not applied: ", db.GetUserList())
+	}
+	if len(journal()) != 0 {
+		t.Error("Journal is not compacted")
+	}
+
+	// damaged record before valid ones stops start, journal is kept
+	db.AddUser("dave", "$2a$hash", nil)
+	db.AddUser("erin", "$2a$hash", nil)
+	crash(db)
+	damaged := journal()
+	damaged[len(damaged)/2-10] ^= 1
+	ioutil.WriteFile(fn+constJournalExt, damaged, 0600)
+	if err := NewLocalDb(fn, slog.Default()).Init(); err == nil || !strings.Contains(err.Error(), "damaged") {
+		t.Fatal("Expected damaged journal error: ", err)
+	}
+	if !bytes.Equal(journal(), damaged) {
+		t.Fatal("Journal is changed")
+	}
+	os.Remove(fn + constJournalExt)
+	db = open(nil)
+
+	// records already in db file are skipped
+	db.DeleteUser("bob")
+	crash(db)
+	ioutil.WriteFile(fn+constJournalExt, before, 0600)
+	db = open(nil)
+	if db.DoesUserExist("bob") {
+		t.Error("Old journal record is applied")
+	}
+	db.Close()
+
+	// journal without db file
+	db = open(nil)
+	db.AddUser("frank", "$2a$hash", nil)
+	crash(db)
+	os.Rename(fn, fn+".lost")
+	if err := NewLocalDb(fn, slog.Default()).Init(); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatal("Expected missing db file error: ", err)
+	}
+	os.Rename(fn+".lost", fn)
+	open(nil).Close()
+
+	// encrypted journal
+	key := bytes.Repeat([]byte{1}, constDbKeySize)
+	db = open(key)
+	db.AddUser("carol", "$2a$hash", nil)
+	if bytes.Contains(journal(), []byte("carol")) {
+		t.Error("Journal is not encrypted")
+	}
+	crash(db)
+	db = open(key)
+	if !db.DoesUserExist("carol") {
+		t.Error("Encrypted journal is not applied")
+	}
+	crash(db)
+
+	// not encrypted record is rejected with key
+	record := "99 {\"Users\":{\"mallory\":{\"Name\":\"mallory\",\"Role\":\"admin\"}}}"
+	injected := fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE([]byte(record)), record)
+	ioutil.WriteFile(fn+constJournalExt, []byte(injected), 0600)
+	db = NewLocalDb(fn, slog.Default())
+	db.SetKey(key)
+	if err := db.Init(); err == nil || !strings.Contains(err.Error(), "not encrypted") {
+		t.Fatal("Expected not encrypted record error: ", err)
+	}
+	os.Remove(fn + constJournalExt)
+	db = open(key)
+	defer db.Close()
+
+	if _, err := os.Stat(fn + ".tmp"); !os.IsNotExist(err) {
+		t.Error("Temp file is left: ", err)
+	}
+}
+
+func TestDbJournalRollback(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "messenger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "db.json")
+	db := NewLocalDb(fn, slog.Default())
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	db.AddUser("alice", "$2a$hash", nil)
+	db.AddUser("bob", "$2a$hash", nil)
+	db.SetRole("alice", "admin")
+	client, server := net.Pipe()
+	defer client.Close()
+	db.GoOnline("alice", server)
+
+	// journal can't be written
+	db.journal.Close()
+
+	if err := db.SetRole("alice", "moderator"); err == nil || db.GetRole("alice") != "admin" {
+		t.Error("Role is not rolled back: ", err, db.GetRole("alice"))
+	}
+	if err := db.AddUser("carol", "$2a$hash", nil); err == nil || db.DoesUserExist("carol") {
+		t.Error("User is not rolled back: ", err)
+	}
+	if _, err := db.UpdateRoster("alice", "bob", RosterRequest); err == nil {
+		t.Error("Expected error")
+	}
+	if p, _ := db.GetPrivacy("bob"); len(p.RequestsIn) != 0 {
+		t.Error("Roster is not rolled back: ", p.RequestsIn)
+	}
+	if err := db.SetRestriction(RestrictionIPBan, "10.0.0.1", newRestriction("admin", 0, "")); err == nil ||
+		db.GetRestriction(RestrictionIPBan, "10.0.0.1") != nil {
+		t.Error("IP ban is not rolled back: ", err)
+	}
+	if online := db.GetOnlineUserList(); len(online) != 1 || online[0] != "alice" {
+		t.Error("Session is lost: ", online)
+	}
+
+	db.journal = nil
+	unlockFile(fn)
+}
+
+func TestDbClear(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "messenger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "db.json")
+	open := func() *LocalDb {
+		db := NewLocalDb(fn, slog.Default())
+		if err := db.Init(); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	// clear only, clean restart
+	db := open()
+	db.AddUser("alice", "$2a$hash", nil)
+	db.Close()
+	db = open()
+	if err := db.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db = open()
+	if list := db.GetUserList(); len(list) != 0 {
+		t.Error("Cleared users are back after restart: ", list)
+	}
+
+	// clear, new user and crash
+	db.AddUser("alice", "$2a$hash", nil)
+	db.Close()
+	db = open()
+	db.Clear()
+	db.AddUser("bob", "$2a$hash", nil)
+	db.closeJournal()
+	unlockFile(fn)
+	db = open()
+	if list := db.GetUserList(); len(list) != 1 || list[0] != "bob" {
+		t.Error("Expected only 'bob' after crash: ", list)
+	}
+
+	// nothing is cleared if the file can't be written
+	os.Mkdir(fn+".tmp", 0700)
+	if err := db.Clear(); err == nil || !db.DoesUserExist("bob") {
+		t.Error("Clear is not rolled back: ", err)
+	}
+	os.Remove(fn + ".tmp")
+	db.Close()
+}
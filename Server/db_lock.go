@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DbLockedError - database file is used by another running process
+type DbLockedError struct {
+	File string
+	// owner process (0 - unknown)
+	Pid int
+}
+
+// Error - error interface
+func (e *DbLockedError) Error() string {
+	if e.Pid == 0 {
+		return fmt.Sprintf("Database '%s' is in use by another process", e.File)
+	}
+	return fmt.Sprintf("Database '%s' is in use by process %d", e.File, e.Pid)
+}
+
+// locks - open lock files by db file name
+var (
+	locks      = make(map[string]*os.File)
+	locksMutex sync.Mutex
+)
+
+// lockFile - lock '<fileName>.lock' by the operating system (see lockOpen);
+// the lock is held while the file is open and is released when the process
+// exits. The file has our PID for DbLockedError only.
+func lockFile(fileName string) error {
+
+	lockName := fileName + ".lock"
+
+	f, ok, err := lockOpen(lockName)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		pid := 0
+		if data, err := os.ReadFile(lockName); err == nil {
+			pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+		}
+		return &DbLockedError{File: fileName, Pid: pid}
+	}
+
+	// owner info
+	if err := f.Truncate(0); err == nil {
+		f.Seek(0, io.SeekStart)
+		fmt.Fprintln(f, os.Getpid())
+	}
+
+	locksMutex.Lock()
+	defer locksMutex.Unlock()
+	locks[fileName] = f
+
+	return nil
+}
+
+// unlockFile - release lock (the lock file stays: removing it would let two
+// processes lock different files of the same name)
+func unlockFile(fileName string) error {
+
+	locksMutex.Lock()
+	f, ok := locks[fileName]
+	delete(locks, fileName)
+	locksMutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+	f.Truncate(0)
+
+	return f.Close()
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestDbLock(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "messenger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "db.json")
+
+	// lock file of a process that no longer runs (or of a reused PID)
+	ioutil.WriteFile(fn+".lock", []byte("1\n"), 0600)
+	if err := lockFile(fn); err != nil {
+		t.Fatal(err)
+	}
+
+	var locked *DbLockedError
+	if err := lockFile(fn); !errors.As(err, &locked) || locked.Pid != os.Getpid() {
+		t.Fatal("Expected locked error with our PID: ", err)
+	}
+	if err := unlockFile(fn); err != nil {
+		t.Fatal(err)
+	}
+
+	// only one of concurrent starters gets the lock
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	taken := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if lockFile(fn) == nil {
+				mutex.Lock()
+				taken++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if taken != 1 {
+		t.Error("Lock is taken ", taken, " times")
+	}
+	unlockFile(fn)
+}
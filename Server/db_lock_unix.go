@@ -0,0 +1,40 @@
+//go:build !windows
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockOpen - open lock file and take exclusive flock without waiting
+// (false - it's locked by another process or open file)
+func lockOpen(lockName string) (*os.File, bool, error) {
+
+	f, err := os.OpenFile(lockName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		f.Close()
+		return nil, false, nil
+	}
+	if err != nil {
+		f.Close()
+		return nil, false, err
+	}
+
+	return f, true, nil
+}
+
+// syncDir - flush directory entries (rename) to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
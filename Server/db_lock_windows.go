@@ -0,0 +1,37 @@
+//go:build windows
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// ERROR_SHARING_VIOLATION (not in syscall package)
+const errorSharingViolation syscall.Errno = 32
+
+// lockOpen - open lock file for writing without sharing write access
+// (false - another process has it open); others can still read the PID
+func lockOpen(lockName string) (*os.File, bool, error) {
+
+	name, err := syscall.UTF16PtrFromString(lockName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, syscall.FILE_SHARE_READ,
+		nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err == errorSharingViolation {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return os.NewFile(uintptr(h), lockName), true, nil
+}
+
+// syncDir - directories can't be flushed on Windows (rename is durable there)
+func syncDir(dir string) error {
+	return nil
+}
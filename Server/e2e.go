@@ -0,0 +1,44 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"encoding/base64"
+	"errors"
+)
+
+// X25519 public key size
+const constPublicKeySize = 32
+
+// handleSetPublicKey - SetPublicKey (the server only stores and hands out the key,
+// messages are encrypted and decrypted by clients)
+func (srv *Server) handleSetPublicKey(s *session, rqst protocol.Request) (string, error) {
+
+	if rqst.Data1 != "" {
+		key, err := base64.StdEncoding.DecodeString(rqst.Data1)
+		if err != nil || len(key) != constPublicKeySize {
+			return "", errors.New("Invalid public key (base64 X25519 key expected)")
+		}
+	}
+
+	if err := srv.localDb.SetPublicKey(s.userName, rqst.Data1); err != nil {
+		return "", err
+	}
+
+	s.logger.Info("public key changed", "name", s.userName, "removed", rqst.Data1 == "")
+	return "ok", nil
+}
+
+// handleGetPublicKey - GetPublicKey
+func (srv *Server) handleGetPublicKey(s *session, rqst protocol.Request) (string, error) {
+
+	name := rqst.Data1
+	key, ok := srv.localDb.GetPublicKey(name)
+	if !ok {
+		return "", errors.New("User '" + name + "' does not exist")
+	}
+	if key == "" {
+		return "", errors.New("User '" + name + "' has no public key")
+	}
+
+	return key, nil
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestPublicKeys(t *testing.T) {
+
+	srv := newTestServer(t, "a", "b")
+	request := newTestClient(t, srv, "a").request
+
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", constPublicKeySize)))
+	for _, bad := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if reply := request(protocol.ScmdSetPublicKey, bad, ""); reply == "ok" {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+	if reply := request(protocol.ScmdSetPublicKey, key, ""); reply != "ok" {
+		t.Fatal(reply)
+	}
+	if reply := request(protocol.ScmdGetPublicKey, "a", ""); reply != key {
+		t.Error(reply)
+	}
+	if reply := request(protocol.ScmdGetPublicKey, "b", ""); reply != "User 'b' has no public key" {
+		t.Error("Expected no key error: ", reply)
+	}
+	if reply := request(protocol.ScmdGetPublicKey, "c", ""); reply != "User 'c' does not exist" {
+		t.Error("Expected no user error: ", reply)
+	}
+
+	// removed
+	request(protocol.ScmdSetPublicKey, "", "")
+	if reply := request(protocol.ScmdGetPublicKey, "a", ""); reply != "User 'a' has no public key" {
+		t.Error("Key is not removed")
+	}
+}
@@ -0,0 +1,364 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// session - client connection state
+type session struct {
+	conn net.Conn
+
+	// rate limiting keys (remote address and IP)
+	key string
+	ip  string
+
+	// user name after login (written by setUser only; other goroutines read it with user)
+	userName string
+	mutex    sync.Mutex
+
+	// API token of login (nil scopes - login with password; written by setToken only)
+	tokenID     string
+	tokenScopes []string
+
+	// user waiting for one-time code after password (session goroutine only)
+	pendingLogin string
+	pendingUntil time.Time
+
+	// connection time
+	started time.Time
+
+	// logger with connection fields
+	connLogger *slog.Logger
+	// logger with connection and current request fields
+	logger *slog.Logger
+}
+
+// newSession - session constructor
+func newSession(conn net.Conn, logger *slog.Logger) *session {
+	s := new(session)
+	s.conn = conn
+	s.key = conn.RemoteAddr().String()
+	s.ip = remoteIP(conn)
+	s.started = time.Now()
+	s.connLogger = logger.With("remote", s.key)
+	s.logger = s.connLogger
+	return s
+}
+
+// setUser - set user name after login/logout
+func (s *session) setUser(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.userName = name
+}
+
+// user - user name (for other goroutines)
+func (s *session) user() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.userName
+}
+
+// setToken - set API token after login with token (nil scopes - no token)
+func (s *session) setToken(id string, scopes []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokenID, s.tokenScopes = id, scopes
+}
+
+// logout - forget logged in user, its API token and pending login
+func (s *session) logout() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.userName, s.tokenID, s.tokenScopes = "", "", nil
+	s.pendingLogin, s.pendingUntil = "", time.Time{}
+}
+
+// token - API token ID and scopes (for other goroutines)
+func (s *session) token() (string, []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.tokenID, s.tokenScopes
+}
+
+// lockedConn - connection that can be written from several goroutines
+// (every message is written with one Write call)
+type lockedConn struct {
+	net.Conn
+	mutex sync.Mutex
+}
+
+// Write - net.Conn interface
+func (c *lockedConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.Conn.Write(b)
+}
+
+// requestHandler - processes client request; returns reply text or error
+type requestHandler func(srv *Server, s *session, rqst protocol.Request) (string, error)
+
+// requestHandlers - handlers of client commands
+var requestHandlers = map[protocol.CommandToServer]requestHandler{
+	protocol.ScmdCheckUniqueNickName: (*Server).handleCheckUniqueNickName,
+	protocol.ScmdRegisterUser:        (*Server).handleRegisterUser,
+	protocol.ScmdLogin:               (*Server).handleLogin,
+	protocol.ScmdLogout:              (*Server).handleLogout,
+	protocol.ScmdChangePassword:      (*Server).handleChangePassword,
+	protocol.ScmdGetOnlineUserList:   (*Server).handleGetOnlineUserList,
+	protocol.ScmdMessageTo:           (*Server).handleMessageTo,
+	protocol.ScmdClear:               (*Server).handleClear,
+	protocol.ScmdSetRole:             (*Server).handleSetRole,
+	protocol.ScmdKick:                (*Server).handleKick,
+	protocol.ScmdBan:                 (*Server).handleBan,
+	protocol.ScmdUnban:               (*Server).handleUnban,
+	protocol.ScmdBanIP:               (*Server).handleBanIP,
+	protocol.ScmdUnbanIP:             (*Server).handleUnbanIP,
+	protocol.ScmdMute:                (*Server).handleMute,
+	protocol.ScmdUnmute:              (*Server).handleUnmute,
+	protocol.ScmdBlock:               (*Server).handleBlock,
+	protocol.ScmdUnblock:             (*Server).handleUnblock,
+	protocol.ScmdAddContact:          (*Server).handleAddContact,
+	protocol.ScmdAcceptContact:       (*Server).handleAcceptContact,
+	protocol.ScmdDeclineContact:      (*Server).handleDeclineContact,
+	protocol.ScmdRemoveContact:       (*Server).handleRemoveContact,
+	protocol.ScmdGetRoster:           (*Server).handleGetRoster,
+	protocol.ScmdGetProfile:          (*Server).handleGetProfile,
+	protocol.ScmdSetProfile:          (*Server).handleSetProfile,
+	protocol.ScmdGetAvatar:           (*Server).handleGetAvatar,
+	protocol.ScmdChangeNickname:      (*Server).handleChangeNickname,
+	protocol.ScmdDeleteAccount:       (*Server).handleDeleteAccount,
+	protocol.ScmdLoginTOTP:           (*Server).handleLoginTOTP,
+	protocol.ScmdSetupTOTP:           (*Server).handleSetupTOTP,
+	protocol.ScmdConfirmTOTP:         (*Server).handleConfirmTOTP,
+	protocol.ScmdDisableTOTP:         (*Server).handleDisableTOTP,
+	protocol.ScmdGetPrivacy:          (*Server).handleGetPrivacy,
+	protocol.ScmdSetPrivacy:          (*Server).handleSetPrivacy,
+	protocol.ScmdCreateToken:         (*Server).handleCreateToken,
+	protocol.ScmdListTokens:          (*Server).handleListTokens,
+	protocol.ScmdRevokeToken:         (*Server).handleRevokeToken,
+	protocol.ScmdTokenLogin:          (*Server).handleTokenLogin,
+	protocol.ScmdSetPublicKey:        (*Server).handleSetPublicKey,
+	protocol.ScmdGetPublicKey:        (*Server).handleGetPublicKey,
+}
+
+// rateLimitedError - request rejected by rate limiting
+type rateLimitedError struct {
+	retryAfter time.Duration
+}
+
+// Error - error interface
+func (e *rateLimitedError) Error() string {
+	return protocol.ReplyRateLimited
+}
+
+// handleCheckUniqueNickName - CheckUniqueNickName
+func (srv *Server) handleCheckUniqueNickName(s *session, rqst protocol.Request) (string, error) {
+
+	name := normalizeNickname(rqst.Data1)
+	if err := srv.nicknamePolicy().check(name); err != nil {
+		return "", err
+	}
+	if err := srv.localDb.CheckUnique(name); err != nil {
+		return "", err
+	}
+
+	return "ok", nil
+}
+
+// handleRegisterUser - RegisterUser
+func (srv *Server) handleRegisterUser(s *session, rqst protocol.Request) (string, error) {
+
+	if ok, retryAfter := srv.limiter.allow(actionRegister, s.key, "", s.ip); !ok {
+		return "", &rateLimitedError{retryAfter}
+	}
+
+	name := normalizeNickname(rqst.Data1)
+	if err := srv.nicknamePolicy().check(name); err != nil {
+		return "", err
+	}
+
+	if err := srv.passwords.addUser(srv.localDb, name, rqst.Data2); err != nil {
+		return "", err
+	}
+
+	return "ok", nil
+}
+
+// handleLogin - Login
+func (srv *Server) handleLogin(s *session, rqst protocol.Request) (string, error) {
+
+	// registered name (i.e. "bob" for "Bob")
+	name := srv.localDb.ResolveName(normalizeNickname(rqst.Data1))
+
+	if ok, retryAfter := srv.limiter.allow(actionLogin, s.key, name, s.ip); !ok {
+		return "", &rateLimitedError{retryAfter}
+	}
+	if locked, retryAfter := srv.limiter.lockedOut(name, s.ip); locked {
+		return "", &rateLimitedError{retryAfter}
+	}
+	if r := srv.localDb.GetRestriction(RestrictionBan, name); r != nil {
+		s.logger.Info("login failed", "name", name, "err", "banned")
+		return "", errors.New("You are banned " + r.describe())
+	}
+
+	source, err := srv.authenticate(name, rqst.Data2)
+	if err != nil {
+		srv.limiter.loginFailed(name, s.ip)
+		s.logger.Info("login failed", "name", name, "err", err)
+		return "", err
+	}
+
+	// first login of user from external backend
+	if _, exists := srv.localDb.GetAuthSource(name); !exists {
+		if err := srv.provisionUser(name, source); err != nil {
+			return "", err
+		}
+	}
+
+	// second step with one-time code
+	if srv.localDb.TOTPEnabled(name) {
+		s.pendingLogin, s.pendingUntil = name, srv.now().Add(constTOTPLoginTimeout)
+		return protocol.ReplyTOTPRequired, nil
+	}
+
+	if err := srv.localDb.GoOnline(name, s.conn); err != nil {
+		return "", err
+	}
+
+	srv.limiter.loginSucceeded(name, s.ip)
+	s.logger.Info("logged in", "name", name, "auth", source)
+	s.setUser(name)
+
+	return "ok", nil
+}
+
+// handleLogout - Logout
+func (srv *Server) handleLogout(s *session, rqst protocol.Request) (string, error) {
+	srv.localDb.Logout(s.userName)
+	s.logout()
+	return "ok", nil
+}
+
+// handleChangePassword - ChangePassword (Data1 - new password, Data2 - current password)
+func (srv *Server) handleChangePassword(s *session, rqst protocol.Request) (string, error) {
+
+	name := s.userName
+
+	// current password is guessed like at login
+	if locked, retryAfter := srv.limiter.lockedOut(name, s.ip); locked {
+		return "", &rateLimitedError{retryAfter}
+	}
+	source, err := srv.authenticate(name, rqst.Data2)
+	if err != nil {
+		srv.limiter.loginFailed(name, s.ip)
+		return "", errors.New("Invalid current password")
+	}
+	if source != AuthLocal {
+		return "", errors.New("Password is managed by " + source + " authentication")
+	}
+
+	if err := srv.passwords.setPassword(srv.localDb, name, rqst.Data1); err != nil {
+		return "", err
+	}
+
+	// other sessions of the user must log in again
+	srv.closeSessions(func(other *session) bool { return other != s && other.user() == name },
+		protocol.NoticeSessionRevoked, "Password is changed, log in again")
+
+	s.logger.Info("password changed", "name", name)
+	return "ok", nil
+}
+
+// handleGetOnlineUserList - GetOnlineUserList
+func (srv *Server) handleGetOnlineUserList(s *session, rqst protocol.Request) (string, error) {
+	userList := srv.visibleOnlineUsers(s.userName)
+	if len(userList) > 0 {
+		return "online users: " + strings.Join(userList, ","), nil
+	}
+	return "no online users", nil
+}
+
+// handleMessageTo - MessageTo
+func (srv *Server) handleMessageTo(s *session, rqst protocol.Request) (string, error) {
+
+	// check mute
+	if r := srv.localDb.GetRestriction(RestrictionMute, s.userName); r != nil {
+		return "", errors.New("You are muted " + r.describe())
+	}
+
+	// check flooding
+	if ok, retryAfter := srv.limiter.allow(actionMessage, s.key, s.userName, s.ip); !ok {
+		return "", &rateLimitedError{retryAfter}
+	}
+
+	// check recipient's block list and privacy options
+	if deliver, err := srv.checkMessagePrivacy(s.userName, rqst.Data1); !deliver {
+		if err == nil {
+			s.logger.Debug("message dropped", "to", rqst.Data1, "reason", "blocked")
+			return "ok", nil
+		}
+		return "", err
+	}
+
+	sender, _ := srv.localDb.GetProfile(s.userName)
+
+	srv.localDb.RLock()
+	defer srv.localDb.RUnlock()
+
+	// get recipient user info
+	name := rqst.Data1
+	userInfo, isFound := srv.localDb.FindUser(name)
+
+	// check recipient connection
+	if !isFound {
+		return "", errors.New("User '" + name + "' does not exist")
+	}
+	if userInfo.conn == nil {
+		return "", errors.New("User '" + name + "' is offline")
+	}
+
+	// send message
+	if err := sendMessage(userInfo.conn, s.userName, sender.DisplayName, rqst.Data2); err != nil {
+		return "", err
+	}
+	atomic.AddUint64(&srv.metrics.messagesRouted, 1)
+
+	return "ok", nil
+}
+
+// handleSetRole - SetRole (promote/demote user)
+func (srv *Server) handleSetRole(s *session, rqst protocol.Request) (string, error) {
+
+	if !validRole(rqst.Data2) {
+		return "", errors.New("Invalid role '" + rqst.Data2 + "'")
+	}
+
+	// admin can't lock himself out (use 'user role' admin command)
+	if rqst.Data1 == s.userName && rqst.Data2 != protocol.RoleAdmin {
+		return "", errors.New("You can't demote yourself")
+	}
+
+	if err := srv.localDb.SetRole(rqst.Data1, rqst.Data2); err != nil {
+		return "", err
+	}
+
+	s.logger.Info("role changed", "name", rqst.Data1, "role", rqst.Data2)
+	return "ok", nil
+}
+
+// handleClear - Clear (admin or test mode only)
+func (srv *Server) handleClear(s *session, rqst protocol.Request) (string, error) {
+	if err := srv.localDb.Clear(); err != nil {
+		return "", err
+	}
+	s.logger.Warn("database cleared")
+	return "ok", nil
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync/atomic"
+)
+
+// handleHealthz - GET /healthz (liveness: the process is serving HTTP)
+func (srv *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz - GET /readyz (readiness: accepting clients and storage is writable)
+func (srv *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := srv.ready(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// ready - check that all listeners accept connections and storage can persist
+// (storage state only: it is called on every probe)
+func (srv *Server) ready() error {
+
+	if srv.isStopping() {
+		return errors.New("server is stopping")
+	}
+
+	if int(atomic.LoadInt32(&srv.accepting)) != len(srv.cfg.Listen) {
+		return errors.New("listener is not accepting connections")
+	}
+
+	if err := srv.localDb.Ready(); err != nil {
+		return errors.New("storage is not writable: " + err.Error())
+	}
+
+	return nil
+}
+
+// httpMux - metrics and health endpoints
+func (srv *Server) httpMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", srv.handleMetrics)
+	mux.HandleFunc("/healthz", srv.handleHealthz)
+	mux.HandleFunc("/readyz", srv.handleReadyz)
+	return mux
+}
+
+// pprofMux - profiling endpoints (admin only address)
+func pprofMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// startHTTP - start HTTP server on addr
+func (srv *Server) startHTTP(addr string, handler http.Handler) error {
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	httpServer := &http.Server{Handler: handler}
+
+	srv.mutex.Lock()
+	srv.httpServers = append(srv.httpServers, httpServer)
+	srv.mutex.Unlock()
+
+	srv.logger.Info("HTTP listening", "addr", listener.Addr().String())
+
+	go func() {
+		if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			srv.logger.Error("HTTP serve failed", "addr", addr, "err", err)
+		}
+	}()
+
+	return nil
+}
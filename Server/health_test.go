@@ -0,0 +1,74 @@
+package server
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "messenger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := newTestServer(t)
+	srv.cfg.Listen = []string{"127.0.0.1:0", "127.0.0.1:0"}
+
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		srv.httpMux().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, w.Body.String()
+	}
+	ready := func(expected string) {
+		code, body := get("/readyz")
+		if (expected == "" && code != http.StatusOK) || (expected != "" && (code != http.StatusServiceUnavailable || !strings.Contains(body, expected))) {
+			t.Errorf("Expected %q, got %d %q", expected, code, body)
+		}
+	}
+
+	// alive while not ready
+	if code, body := get("/healthz"); code != http.StatusOK || body != "ok\n" {
+		t.Error("healthz: ", code, body)
+	}
+
+	// one of two listeners is accepting
+	ready("listener is not accepting connections")
+	atomic.AddInt32(&srv.accepting, 1)
+	ready("listener is not accepting connections")
+	atomic.AddInt32(&srv.accepting, 1)
+	ready("")
+
+	// storage is checked without touching files
+	db := NewLocalDb(filepath.Join(dir, "db.json"), slog.Default())
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	srv.localDb = db
+	ready("")
+	db.journal.Close()
+	if err := db.AddUser("a", "$2a$hash", nil); err == nil {
+		t.Fatal("Expected write error")
+	}
+	ready("storage is not writable")
+
+	// stopping
+	srv.localDb = NewLocalDb("", slog.Default())
+	ready("")
+	srv.mutex.Lock()
+	srv.stopping = true
+	srv.mutex.Unlock()
+	ready("server is stopping")
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Error("healthz of stopping server: ", code)
+	}
+}
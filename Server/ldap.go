@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LDAPConfig - LDAP simple bind
+type LDAPConfig struct {
+	// ldap://host:389 or ldaps://host:636
+	URL string
+	// bind DN, "{user}" is replaced with nickname
+	// (i.e. "uid={user},ou=people,dc=example,dc=com")
+	BindDN string
+	// connect and bind timeout
+	Timeout Duration
+}
+
+// LDAP result codes
+const (
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+)
+
+// ldapBindRequest - BindRequest with simple authentication (RFC 4511)
+type ldapBindRequest struct {
+	Version  int
+	Name     []byte
+	Password []byte `asn1:"tag:0"`
+}
+
+// ldapBindMessage - LDAPMessage with BindRequest
+type ldapBindMessage struct {
+	ID      int
+	Request ldapBindRequest `asn1:"application,tag:0"`
+}
+
+// ldapResult - LDAPResult of BindResponse
+type ldapResult struct {
+	Code       asn1.Enumerated
+	MatchedDN  []byte
+	Diagnostic []byte
+}
+
+// ldapMessage - LDAPMessage with any operation
+type ldapMessage struct {
+	ID int
+	Op asn1.RawValue
+}
+
+// ldapAuthenticator - LDAP bind as the user
+type ldapAuthenticator struct {
+	cfg LDAPConfig
+}
+
+// Name - Authenticator interface
+func (a *ldapAuthenticator) Name() string {
+	return AuthLDAP
+}
+
+// Authenticate - Authenticator interface
+func (a *ldapAuthenticator) Authenticate(name, password string) error {
+
+	// empty password is unauthenticated bind that always succeeds
+	if password == "" {
+		return errInvalidPassword
+	}
+
+	dn := strings.ReplaceAll(a.cfg.BindDN, "{user}", escapeDN(name))
+	code, err := ldapBind(a.cfg, dn, password)
+	if err != nil {
+		return errors.New("LDAP: " + err.Error())
+	}
+
+	switch code {
+	case ldapSuccess:
+		return nil
+	case ldapInvalidCredentials:
+		return errInvalidPassword
+	}
+
+	return errors.New("LDAP: bind result " + strconv.Itoa(code))
+}
+
+// ldapBind - simple bind; returns LDAP result code
+func ldapBind(cfg LDAPConfig, dn, password string) (int, error) {
+
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return 0, err
+	}
+
+	timeout := time.Duration(cfg.Timeout)
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		conn, err = dialer.Dial("tcp", hostPort(u, "389"))
+	case "ldaps":
+		conn, err = tls.DialWithDialer(dialer, "tcp", hostPort(u, "636"), &tls.Config{ServerName: u.Hostname()})
+	default:
+		err = errors.New("Unsupported URL scheme '" + u.Scheme + "'")
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	request, err := asn1.Marshal(ldapBindMessage{ID: 1, Request: ldapBindRequest{Version: 3, Name: []byte(dn), Password: []byte(password)}})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+
+	data, err := readBER(bufio.NewReader(conn))
+	if err != nil {
+		return 0, err
+	}
+	var msg ldapMessage
+	if _, err := asn1.Unmarshal(data, &msg); err != nil {
+		return 0, err
+	}
+	if msg.ID != 1 || msg.Op.Class != asn1.ClassApplication || msg.Op.Tag != 1 {
+		return 0, errors.New("Unexpected reply")
+	}
+	var result ldapResult
+	if _, err := asn1.UnmarshalWithParams(msg.Op.FullBytes, &result, "application,tag:1"); err != nil {
+		return 0, err
+	}
+
+	// UnbindRequest
+	conn.Write([]byte{0x30, 0x05, 0x02, 0x01, 0x02, 0x42, 0x00})
+
+	return int(result.Code), nil
+}
+
+// hostPort - host:port of URL with default port
+func hostPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// readBER - read one BER element (tag, length and content)
+func readBER(r *bufio.Reader) ([]byte, error) {
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	// long form length
+	length := int(header[1])
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 {
+			return nil, errors.New("Unsupported BER length")
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		header = append(header, b...)
+		length = 0
+		for _, c := range b {
+			length = length<<8 | int(c)
+		}
+	}
+	if length > 1<<20 {
+		return nil, errors.New("Too big BER element")
+	}
+
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+
+	return append(header, content...), nil
+}
+
+// escapeDN - escape attribute value for DN (RFC 4514)
+func escapeDN(value string) string {
+
+	var b strings.Builder
+	for i, r := range value {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, r),
+			r == '#' && i == 0,
+			r == ' ' && (i == 0 || i == len(value)-1):
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
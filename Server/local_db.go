@@ -1,32 +1,141 @@
 package server
 
 import (
+	"GitHub/Messenger-to-learn-golang/protocol"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 )
 
-// Local DB Filename
+// Default Local DB Filename
 const (
 	constLocalDbFn = "local_db.json"
 )
 
+// db file permissions (password hashes are inside)
+const constDbFileMode = 0600
+
+// db file format version
+// (version 0 - map of users without header)
+const constDbVersion = 1
+
+// dbFile - db file format
+type dbFile struct {
+	Version int
+	// sequence number of the last journal record in the file
+	Seq   uint64 `json:",omitempty"`
+	Users map[string]*UserInfo
+	// banned IP addresses
+	IPBans map[string]*Restriction `json:",omitempty"`
+}
+
 // LocalDb - Local Database
 type LocalDb struct {
-	users map[string]*UserInfo
-	mutex sync.RWMutex
+	users  map[string]*UserInfo
+	ipBans map[string]*Restriction
+	mutex  sync.RWMutex
+
+	// JSON file name ("" - keep in memory only)
+	fileName string
+
+	// storage encryption key (nil - file is not encrypted)
+	key []byte
+
+	// journal of changes since the file was written (see db_journal.go)
+	journal        *os.File
+	journalRecords int
+	seq            uint64
+	// error of the last write (nil - it succeeded)
+	writeErr error
+
+	logger *slog.Logger
+
+	// called after save with its duration
+	onSave func(time.Duration)
+}
+
+// NewLocalDb - LocalDb constructor (fileName=="" - keep in memory only)
+func NewLocalDb(fileName string, logger *slog.Logger) *LocalDb {
+	db := new(LocalDb)
+	db.fileName = fileName
+	db.logger = logger
+	return db
+}
+
+// SetKey - set storage encryption key (before Init; nil - no encryption)
+func (db *LocalDb) SetKey(key []byte) {
+	db.key = key
+}
+
+// Rekey - save db file encrypted with new key (nil - not encrypted)
+func (db *LocalDb) Rekey(key []byte) error {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	old := db.key
+	db.key = key
+	if err := db.save(); err != nil {
+		db.key = old
+		return err
+	}
+
+	db.logger.Info("db key changed", "file", db.fileName, "encrypted", key != nil)
+	return nil
+}
+
+// OnSave - set callback called after each save with its duration
+func (db *LocalDb) OnSave(fn func(time.Duration)) {
+	db.onSave = fn
 }
 
 // UserInfo - User Info
 type UserInfo struct {
 	// User nickname
 	Name string
-	// Password
-	Md5Password string
+	// Authentication backend that registered the user ("" - local password)
+	Auth string `json:",omitempty"`
+	// Password: bcrypt hash
+	PasswordHash string `json:",omitempty"`
+	// Password hash made by old clients ("md5:<hex>"; replaced by PasswordHash on login)
+	Md5Password string `json:",omitempty"`
+	// previous password hashes (the newest first)
+	PasswordHistory []string `json:",omitempty"`
+	// two-factor authentication (nil - off)
+	TOTP *TOTP `json:",omitempty"`
+	// API tokens for bots and scripts
+	Tokens []APIToken `json:",omitempty"`
+	// X25519 public key for end-to-end encryption (base64)
+	PublicKey string `json:",omitempty"`
+	// Role: "user" (empty), "moderator" or "admin"
+	Role string `json:",omitempty"`
+
+	// Moderation (nil - none)
+	Ban  *Restriction `json:",omitempty"`
+	Mute *Restriction `json:",omitempty"`
+
+	// Privacy
+	Contacts     []string `json:",omitempty"`
+	Blocked      []string `json:",omitempty"`
+	HidePresence bool     `json:",omitempty"`
+	ContactsOnly bool     `json:",omitempty"`
+	BlockReply   string   `json:",omitempty"`
+
+	// pending contact requests (from and to other users)
+	RequestsIn  []string `json:",omitempty"`
+	RequestsOut []string `json:",omitempty"`
+
+	// Profile (nil - empty)
+	Profile *Profile `json:",omitempty"`
 
 	// Connection to send messages from other users
 	// (conn==nil before login and after logouy)
@@ -36,18 +145,44 @@ type UserInfo struct {
 	mutex sync.Mutex
 }
 
+// passwordHash - current password hash
+func (u *UserInfo) passwordHash() string {
+	if u.PasswordHash != "" {
+		return u.PasswordHash
+	}
+	return u.Md5Password
+}
+
 // Init - Initiate Local Db
 func (db *LocalDb) Init() error {
 
 	db.users = make(map[string]*UserInfo)
+	db.ipBans = make(map[string]*Restriction)
+
+	// memory only
+	if db.fileName == "" {
+		return nil
+	}
+
+	// only one process can use db file
+	if err := lockFile(db.fileName); err != nil {
+		return err
+	}
 
 	// create db file if not exist
 	if err := db.createIfNotExist(); err != nil {
+		unlockFile(db.fileName)
 		return err
 	}
 
-	// load from file
+	// load from file and journal
+	if err := db.openJournal(); err != nil {
+		unlockFile(db.fileName)
+		return err
+	}
 	if err := db.load(); err != nil {
+		db.closeJournal()
+		unlockFile(db.fileName)
 		return err
 	}
 
@@ -57,14 +192,22 @@ func (db *LocalDb) Init() error {
 // createIfNotExist - create db file if not exist
 func (db *LocalDb) createIfNotExist() error {
 
-	if _, err := os.Stat(constLocalDbFn); os.IsNotExist(err) || os.IsNotExist(err) {
+	if _, err := os.Stat(db.fileName); os.IsNotExist(err) || os.IsNotExist(err) {
+
+		// journal of lost db file would bring back its old records
+		if info, err := os.Stat(db.journalName()); err == nil && info.Size() > 0 {
+			return errors.New("Db file '" + db.fileName + "' is missing but its journal exists (restore the db file or remove '" + db.journalName() + "')")
+		}
 
 		// encode json
-		data, _ := json.MarshalIndent(db.users, "", " ")
+		data, err := encryptDb(db.key, db.encode())
+		if err != nil {
+			return err
+		}
 
 		// write file
-		if err := ioutil.WriteFile(constLocalDbFn, data, 0660); err != nil {
-			log.Fatal(err)
+		if err := writeFileAtomic(db.fileName, data, constDbFileMode); err != nil {
+			db.logger.Error("can't create db file", "file", db.fileName, "err", err)
 			return err
 		}
 	}
@@ -72,6 +215,67 @@ func (db *LocalDb) createIfNotExist() error {
 	return nil
 }
 
+// Close - write journal to db file and release it
+func (db *LocalDb) Close() error {
+
+	// memory only
+	if db.fileName == "" {
+		return nil
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	var err error
+	if db.journalRecords > 0 {
+		err = db.save()
+	}
+	if closeErr := db.closeJournal(); err == nil {
+		err = closeErr
+	}
+	if unlockErr := unlockFile(db.fileName); err == nil {
+		err = unlockErr
+	}
+
+	return err
+}
+
+// CheckWritable - check that db file directory is writable
+func (db *LocalDb) CheckWritable() error {
+
+	// memory only
+	if db.fileName == "" {
+		return nil
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(db.fileName), ".check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
+}
+
+// Ready - check that changes can be saved: the journal is open and the last
+// write succeeded (no file is touched, so it can be probed often)
+func (db *LocalDb) Ready() error {
+
+	// memory only
+	if db.fileName == "" {
+		return nil
+	}
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	if db.journal == nil {
+		return errors.New("db journal is not open")
+	}
+
+	return db.writeErr
+}
+
 // load - load db fromfile
 func (db *LocalDb) load() error {
 
@@ -79,39 +283,114 @@ func (db *LocalDb) load() error {
 	defer db.mutex.Unlock()
 
 	// read file
-	data, err := ioutil.ReadFile(constLocalDbFn)
+	data, err := ioutil.ReadFile(db.fileName)
+	if err != nil {
+		db.logger.Error("can't read db file", "file", db.fileName, "err", err)
+		return err
+	}
+
+	// decrypt (not encrypted file is encrypted when key is set)
+	data, encrypted, err := decryptDb(db.key, data)
+	if err != nil {
+		db.logger.Error("can't decrypt db file", "file", db.fileName, "err", err)
+		return err
+	}
+	if err := db.decode(data); err != nil {
+		return err
+	}
+
+	// changes after the file was written
+	applied, err := db.replayJournal()
 	if err != nil {
-		log.Fatal(err)
+		db.logger.Error("can't read db journal", "file", db.journalName(), "err", err)
 		return err
 	}
 
+	if !encrypted && db.key != nil {
+		db.logger.Info("encrypting db file", "file", db.fileName)
+		return db.save()
+	}
+
+	// compact (it also drops damaged tail of journal)
+	if info, err := db.journal.Stat(); err == nil && info.Size() > 0 {
+		db.logger.Info("db journal applied", "file", db.journalName(), "records", applied)
+		return db.save()
+	}
+
+	return nil
+}
+
+// decode - db file content
+func (db *LocalDb) decode(data []byte) error {
+
 	// decode json
-	db.users = make(map[string]*UserInfo)
-	if err := json.Unmarshal(data, &db.users); err != nil {
+	var header struct{ Version *int }
+	if err := json.Unmarshal(data, &header); err != nil {
+		return err
+	}
+
+	// version 0 (users only)
+	if header.Version == nil {
+		db.users = make(map[string]*UserInfo)
+		db.ipBans = make(map[string]*Restriction)
+		db.seq = 0
+		return json.Unmarshal(data, &db.users)
+	}
+
+	if *header.Version > constDbVersion {
+		return errors.New("Unsupported db file version " + strconv.Itoa(*header.Version))
+	}
+
+	file := dbFile{Users: make(map[string]*UserInfo), IPBans: make(map[string]*Restriction)}
+	if err := json.Unmarshal(data, &file); err != nil {
 		return err
 	}
+	db.users = file.Users
+	db.ipBans = file.IPBans
+	db.seq = file.Seq
 
 	return nil
 }
 
-// save to file
+// encode - db file content
+func (db *LocalDb) encode() []byte {
+	data, _ := json.MarshalIndent(dbFile{Version: constDbVersion, Seq: db.seq, Users: db.users, IPBans: db.ipBans}, "", " ")
+	return data
+}
+
+// save - write the whole db to file (atomically) and empty the journal
 func (db *LocalDb) save() error {
 
-	if Debug {
-		log.Printf("db: %+v\n", db)
+	// memory only
+	if db.fileName == "" {
+		return nil
 	}
 
+	start := time.Now()
+
 	// encode json
-	data, _ := json.MarshalIndent(db.users, "", " ")
-	if Debug {
-		log.Println(string(data))
+	data, err := encryptDb(db.key, db.encode())
+	if err != nil {
+		return err
 	}
 
 	// write file
-	if err := ioutil.WriteFile(constLocalDbFn, data, 0660); err != nil {
-		log.Fatal(err)
+	if err := writeFileAtomic(db.fileName, data, constDbFileMode); err != nil {
+		db.logger.Error("can't save db file", "file", db.fileName, "err", err)
+		db.writeErr = err
+		return err
+	}
+	if err := db.truncateJournal(); err != nil {
+		db.logger.Error("can't truncate db journal", "file", db.journalName(), "err", err)
+		db.writeErr = err
 		return err
 	}
+	db.writeErr = nil
+
+	db.logger.Debug("db saved", "file", db.fileName, "users", len(db.users))
+	if db.onSave != nil {
+		db.onSave(time.Since(start))
+	}
 
 	return nil
 }
@@ -138,30 +417,42 @@ func (db *LocalDb) DoesUserExist(name string) bool {
 	return ok
 }
 
-// AddUser - Add User
-func (db *LocalDb) AddUser(name, password string, conn net.Conn) error {
+// AddUser - Add User (password - bcrypt hash)
+func (db *LocalDb) AddUser(name, passwordHash string, conn net.Conn) error {
 
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
 	// check if user exists
-	if db.DoesUserExist(name) {
-		return errors.New("User '" + name + "' already exists")
+	if err := db.checkUnique(name, ""); err != nil {
+		return err
 	}
 
 	// add user info
-	db.users[name] = &UserInfo{name, password, nil, sync.Mutex{}}
+	before := db.stateOf([]string{name}, nil)
+	db.users[name] = &UserInfo{Name: name, PasswordHash: passwordHash}
 
 	// save changes
-	if err := db.save(); err != nil {
+	if err := db.commit(before); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// Login - login
-func (db *LocalDb) Login(name, password string, conn net.Conn) error {
+// DeleteUser - Delete User (online user is disconnected)
+func (db *LocalDb) DeleteUser(name string) error {
+	return db.deleteUser(name, true)
+}
+
+// DeleteLoggedInUser - delete user keeping its connection open (the session
+// deleting own account replies and logs out after it)
+func (db *LocalDb) DeleteLoggedInUser(name string) error {
+	return db.deleteUser(name, false)
+}
+
+// deleteUser - delete user and forget it in other users' lists
+func (db *LocalDb) deleteUser(name string, disconnect bool) error {
 
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
@@ -173,81 +464,858 @@ func (db *LocalDb) Login(name, password string, conn net.Conn) error {
 		return errors.New("User '" + name + "' does not exist")
 	}
 
-	// check if user offline
-	if user.conn != nil {
-		return errors.New("User '" + name + "' is already online")
+	names := []string{}
+	for n := range db.users {
+		names = append(names, n)
 	}
+	before := db.stateOf(names, nil)
+	delete(db.users, name)
 
-	// check password
-	if user.Md5Password != password {
-		return errors.New("Invalid password")
+	// forget deleted user in other users' lists
+	for _, u := range db.users {
+		u.Contacts = removeName(u.Contacts, name)
+		u.Blocked = removeName(u.Blocked, name)
+		u.RequestsIn = removeName(u.RequestsIn, name)
+		u.RequestsOut = removeName(u.RequestsOut, name)
 	}
 
-	// go online
-	user.conn = conn
-	db.users[name] = user
+	// other users are changed too: write the whole file
+	if err := db.save(); err != nil {
+		db.rollback(before)
+		return err
+	}
+
+	// disconnect
+	if disconnect && user.conn != nil {
+		user.conn.Close()
+	}
 
 	return nil
 }
 
-// ChangePassword -
-func (db *LocalDb) ChangePassword(name, newPassword string) error {
+// RenameUser - change user name (other users' lists are updated too)
+func (db *LocalDb) RenameUser(name, newName string) error {
 
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
+	// check if users exist
+	if !db.DoesUserExist(name) {
+		return errors.New("User '" + name + "' does not exist")
+	}
+	if err := db.checkUnique(newName, name); err != nil {
+		return err
+	}
+
+	db.rekey(name, newName)
+
+	// keep memory and file consistent
+	if err := db.save(); err != nil {
+		db.rekey(newName, name)
+		return err
+	}
+
+	return nil
+}
+
+// CheckUnique - check that name is not taken (the same case-folded name or confusable skeleton)
+func (db *LocalDb) CheckUnique(name string) error {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.checkUnique(name, "")
+}
+
+// checkUnique - check that name is not taken by other user than 'self'
+// (the same case-folded name or confusable skeleton)
+func (db *LocalDb) checkUnique(name, self string) error {
+
+	if name != self && db.DoesUserExist(name) {
+		return errors.New("User '" + name + "' already exists")
+	}
+
+	// the same name in other case first (the map order is random)
+	folded := foldNickname(name)
+	for existing := range db.users {
+		if existing != self && foldNickname(existing) == folded {
+			return errors.New("User '" + existing + "' already exists")
+		}
+	}
+
+	key := nicknameKey(name)
+	for existing := range db.users {
+		if existing != self && nicknameKey(existing) == key {
+			return errors.New("Nickname '" + name + "' is too similar to existing user '" + existing + "'")
+		}
+	}
+
+	return nil
+}
+
+// ResolveName - registered name of user (exact or case-insensitive match; name itself if not found)
+func (db *LocalDb) ResolveName(name string) string {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	if db.DoesUserExist(name) {
+		return name
+	}
+
+	folded := foldNickname(name)
+	for existing := range db.users {
+		if foldNickname(existing) == folded {
+			return existing
+		}
+	}
+
+	return name
+}
+
+// rekey - move user to new name
+func (db *LocalDb) rekey(name, newName string) {
+
+	user := db.users[name]
+	delete(db.users, name)
+	user.Name = newName
+	db.users[newName] = user
+
+	for _, u := range db.users {
+		for _, list := range []*[]string{&u.Contacts, &u.Blocked, &u.RequestsIn, &u.RequestsOut} {
+			if slices.Contains(*list, name) {
+				*list = addName(removeName(*list, name), newName)
+			}
+		}
+	}
+}
+
+// CheckPassword - check user password
+func (db *LocalDb) CheckPassword(name, password string) error {
+
+	db.mutex.RLock()
 	user, ok := db.users[name]
+	var hash string
+	if ok {
+		hash = user.passwordHash()
+	}
+	db.mutex.RUnlock()
 
 	// check if user exists
 	if !ok {
 		return errors.New("User '" + name + "' does not exist")
 	}
 
-	// change password
-	user.Md5Password = newPassword
-	db.users[name] = user
-	db.save()
+	// (slow hash is checked without lock)
+	if !checkPasswordHash(hash, password) {
+		return errors.New("Invalid password")
+	}
 
 	return nil
 }
 
-// GetOnlineUserList - Get Online User List
-func (db *LocalDb) GetOnlineUserList() []string {
+// GetUserList - Get all registered users (sorted)
+func (db *LocalDb) GetUserList() []string {
 
 	db.mutex.RLock()
 	defer db.mutex.RUnlock()
 
 	userList := []string{}
+	for name := range db.users {
+		userList = append(userList, name)
+	}
+	sort.Strings(userList)
 
-	for _, u := range db.users {
-		if u.conn != nil {
-			userList = append(userList, u.Name)
+	return userList
+}
+
+// Check - check db consistency; returns list of problems
+func (db *LocalDb) Check() []string {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	problems := []string{}
+	for name, user := range db.users {
+		switch {
+		case user == nil:
+			problems = append(problems, "User '"+name+"': empty record")
+		case name == "":
+			problems = append(problems, "User with empty name")
+		case user.Name != name:
+			problems = append(problems, "User '"+name+"': name mismatch '"+user.Name+"'")
+		case user.passwordHash() == "" && user.Auth == "":
+			problems = append(problems, "User '"+name+"': no password")
+		case user.Role != "" && !validRole(user.Role):
+			problems = append(problems, "User '"+name+"': invalid role '"+user.Role+"'")
 		}
 	}
 
-	return userList
+	// nicknames registered before nickname policy
+	keys := make(map[string]string)
+	for name := range db.users {
+		key := nicknameKey(name)
+		if other, ok := keys[key]; ok {
+			a, b := min(name, other), max(name, other)
+			problems = append(problems, "Users '"+a+"' and '"+b+"': confusable nicknames")
+		} else {
+			keys[key] = name
+		}
+	}
+	sort.Strings(problems)
+
+	return problems
 }
 
-// Logout - logout
-func (db *LocalDb) Logout(name string) {
+// ProvisionUser - add user authenticated by external backend (without local password)
+func (db *LocalDb) ProvisionUser(name, source string) error {
 
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
+	// check if user exists
+	if err := db.checkUnique(name, ""); err != nil {
+		return err
+	}
+
+	before := db.stateOf([]string{name}, nil)
+	db.users[name] = &UserInfo{Name: name, Auth: source}
+
+	return db.commit(before)
+}
+
+// GetAuthSource - authentication backend of user (false if user does not exist)
+func (db *LocalDb) GetAuthSource(name string) (string, bool) {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
 	user, ok := db.users[name]
-	if ok {
-		// go offline
-		user.conn = nil
-		db.users[name] = user
+	if !ok {
+		return "", false
 	}
+	if user.Auth == "" {
+		return AuthLocal, true
+	}
+
+	return user.Auth, true
 }
 
-// Clear - Clear Local Db (for testing)
-func (db *LocalDb) Clear() {
+// GoOnline - login of authenticated user
+func (db *LocalDb) GoOnline(name string, conn net.Conn) error {
 
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
-	// clear db
-	db.users = make(map[string]*UserInfo)
+	user, ok := db.users[name]
+
+	// check if user exists
+	if !ok {
+		return errors.New("User '" + name + "' does not exist")
+	}
+
+	// check if user offline
+	if user.conn != nil {
+		return errors.New("User '" + name + "' is already online")
+	}
+
+	user.conn = conn
+	return nil
+}
+
+// TOTPEnabled - user has two-factor authentication on
+func (db *LocalDb) TOTPEnabled(name string) bool {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	user, ok := db.users[name]
+	return ok && user.TOTP != nil && user.TOTP.Enabled
+}
+
+// UpdateTOTP - change TOTP settings of user: 'update' gets a copy (nil - none)
+// and returns new settings (nil - remove); nothing is changed if it fails
+func (db *LocalDb) UpdateTOTP(name string, update func(t *TOTP) (*TOTP, error)) error {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	user, ok := db.users[name]
+
+	// check if user exists
+	if !ok {
+		return errors.New("User '" + name + "' does not exist")
+	}
+
+	var current *TOTP
+	if user.TOTP != nil {
+		t := *user.TOTP
+		t.RecoveryCodes = slices.Clone(t.RecoveryCodes)
+		current = &t
+	}
+
+	t, err := update(current)
+	if err != nil {
+		return err
+	}
+	before := db.stateOf([]string{name}, nil)
+	user.TOTP = t
+
+	return db.commit(before)
+}
+
+// GetTokens - API tokens of user
+func (db *LocalDb) GetTokens(name string) []APIToken {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	user, ok := db.users[name]
+	if !ok {
+		return nil
+	}
+	return cloneTokens(user.Tokens)
+}
+
+// UpdateTokens - change API tokens of user: 'update' gets a copy and returns
+// new list; nothing is changed if it fails
+func (db *LocalDb) UpdateTokens(name string, update func(tokens []APIToken) ([]APIToken, error)) error {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	user, ok := db.users[name]
+
+	// check if user exists
+	if !ok {
+		return errors.New("User '" + name + "' does not exist")
+	}
+
+	tokens, err := update(cloneTokens(user.Tokens))
+	if err != nil {
+		return err
+	}
+	before := db.stateOf([]string{name}, nil)
+	user.Tokens = tokens
+
+	return db.commit(before)
+}
+
+// FindToken - owner of API token with this hash
+func (db *LocalDb) FindToken(hash string) (string, APIToken, bool) {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	for name, user := range db.users {
+		for _, t := range user.Tokens {
+			if t.Hash == hash {
+				t.Scopes = slices.Clone(t.Scopes)
+				return name, t, true
+			}
+		}
+	}
+
+	return "", APIToken{}, false
+}
+
+// cloneTokens - deep copy of token list
+func cloneTokens(tokens []APIToken) []APIToken {
+	list := slices.Clone(tokens)
+	for i := range list {
+		list[i].Scopes = slices.Clone(list[i].Scopes)
+	}
+	return list
+}
+
+// ChangePassword - set password hash; 'history' - number of previous hashes to keep
+func (db *LocalDb) ChangePassword(name, passwordHash string, history int) error {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	user, ok := db.users[name]
+
+	// check if user exists
+	if !ok {
+		return errors.New("User '" + name + "' does not exist")
+	}
+
+	// keep previous hash
+	before := db.stateOf([]string{name}, nil)
+	user.PasswordHistory = append([]string{user.passwordHash()}, user.PasswordHistory...)
+	if len(user.PasswordHistory) > history {
+		user.PasswordHistory = user.PasswordHistory[:history]
+	}
+	if len(user.PasswordHistory) == 0 {
+		user.PasswordHistory = nil
+	}
+
+	// change password
+	user.PasswordHash, user.Md5Password = passwordHash, ""
+	db.users[name] = user
+
+	return db.commit(before)
+}
+
+// GetPasswordHistory - current and previous password hashes (the newest first)
+func (db *LocalDb) GetPasswordHistory(name string) []string {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	user, ok := db.users[name]
+	if !ok {
+		return nil
+	}
+
+	return append([]string{user.passwordHash()}, user.PasswordHistory...)
+}
+
+// GetPublicKey - public key of user for end-to-end encryption (false if user does not exist)
+func (db *LocalDb) GetPublicKey(name string) (string, bool) {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	user, ok := db.users[name]
+	if !ok {
+		return "", false
+	}
+
+	return user.PublicKey, true
+}
+
+// SetPublicKey - change public key of user ("" - remove)
+func (db *LocalDb) SetPublicKey(name, key string) error {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	user, ok := db.users[name]
+
+	// check if user exists
+	if !ok {
+		return errors.New("User '" + name + "' does not exist")
+	}
+	before := db.stateOf([]string{name}, nil)
+	user.PublicKey = key
+
+	return db.commit(before)
+}
+
+// GetRole - user role ("" if user does not exist)
+func (db *LocalDb) GetRole(name string) string {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	user, ok := db.users[name]
+	if !ok {
+		return ""
+	}
+	if user.Role == "" {
+		return protocol.RoleUser
+	}
+
+	return user.Role
+}
+
+// SetRole - change user role
+func (db *LocalDb) SetRole(name, role string) error {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	user, ok := db.users[name]
+
+	// check if user exists
+	if !ok {
+		return errors.New("User '" + name + "' does not exist")
+	}
+
+	// "user" is not stored
+	if role == protocol.RoleUser {
+		role = ""
+	}
+	before := db.stateOf([]string{name}, nil)
+	user.Role = role
+
+	return db.commit(before)
+}
+
+// SetRestriction - ban or mute user, or ban IP address (r==nil - remove restriction)
+func (db *LocalDb) SetRestriction(kind, target string, r *Restriction) error {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if kind == RestrictionIPBan {
+		if r == nil && db.ipBans[target] == nil {
+			return errors.New("Address '" + target + "' is not banned")
+		}
+		before := db.stateOf(nil, []string{target})
+		if r == nil {
+			delete(db.ipBans, target)
+		} else {
+			db.ipBans[target] = r
+		}
+		return db.commit(before)
+	}
+
+	user, ok := db.users[target]
+
+	// check if user exists
+	if !ok {
+		return errors.New("User '" + target + "' does not exist")
+	}
+
+	field, state := &user.Ban, "banned"
+	if kind == RestrictionMute {
+		field, state = &user.Mute, "muted"
+	}
+	if r == nil && *field == nil {
+		return errors.New("User '" + target + "' is not " + state)
+	}
+	before := db.stateOf([]string{target}, nil)
+	*field = r
+
+	return db.commit(before)
+}
+
+// GetRestriction - active restriction (nil - none or expired)
+func (db *LocalDb) GetRestriction(kind, target string) *Restriction {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	var r *Restriction
+	switch kind {
+	case RestrictionIPBan:
+		r = db.ipBans[target]
+	case RestrictionBan:
+		if user, ok := db.users[target]; ok {
+			r = user.Ban
+		}
+	case RestrictionMute:
+		if user, ok := db.users[target]; ok {
+			r = user.Mute
+		}
+	}
+
+	if r == nil || !r.active(time.Now()) {
+		return nil
+	}
+
+	return r
+}
+
+// GetRestrictionList - active restrictions (sorted by kind and target)
+func (db *LocalDb) GetRestrictionList() []RestrictionEntry {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	now := time.Now()
+	list := []RestrictionEntry{}
+	add := func(kind, target string, r *Restriction) {
+		if r != nil && r.active(now) {
+			list = append(list, RestrictionEntry{kind, target, *r})
+		}
+	}
+
+	for ip, r := range db.ipBans {
+		add(RestrictionIPBan, ip, r)
+	}
+	for name, user := range db.users {
+		add(RestrictionBan, name, user.Ban)
+		add(RestrictionMute, name, user.Mute)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Kind != list[j].Kind {
+			return list[i].Kind < list[j].Kind
+		}
+		return list[i].Target < list[j].Target
+	})
+
+	return list
+}
+
+// GetPrivacy - contacts, block list and privacy options of the user
+func (db *LocalDb) GetPrivacy(name string) (Privacy, bool) {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	user, ok := db.users[name]
+	if !ok {
+		return Privacy{}, false
+	}
+
+	return Privacy{
+		Contacts:     append([]string{}, user.Contacts...),
+		Blocked:      append([]string{}, user.Blocked...),
+		RequestsIn:   append([]string{}, user.RequestsIn...),
+		RequestsOut:  append([]string{}, user.RequestsOut...),
+		HidePresence: user.HidePresence,
+		ContactsOnly: user.ContactsOnly,
+		BlockReply:   user.BlockReply,
+	}, true
+}
+
+// SetPrivacy - change privacy options of the user (lists are not changed)
+func (db *LocalDb) SetPrivacy(name string, p Privacy) error {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	user, ok := db.users[name]
+
+	// check if user exists
+	if !ok {
+		return errors.New("User '" + name + "' does not exist")
+	}
+
+	before := db.stateOf([]string{name}, nil)
+	user.HidePresence = p.HidePresence
+	user.ContactsOnly = p.ContactsOnly
+	user.BlockReply = p.BlockReply
+
+	return db.commit(before)
+}
+
+// SetBlocked - add or remove member of user's block list
+// (blocking removes contact and pending requests of both users)
+func (db *LocalDb) SetBlocked(name, member string, blocked bool) error {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	user, other, err := db.userPair(name, member)
+	if err != nil {
+		return err
+	}
+	before := db.stateOf([]string{name, member}, nil)
+
+	switch {
+	case blocked && slices.Contains(user.Blocked, member):
+		return errors.New("User '" + member + "' is already blocked")
+	case !blocked && !slices.Contains(user.Blocked, member):
+		return errors.New("User '" + member + "' is not blocked")
+	case blocked:
+		user.Blocked = addName(user.Blocked, member)
+		unlinkUsers(user, other)
+	default:
+		user.Blocked = removeName(user.Blocked, member)
+	}
+
+	return db.commit(before)
+}
+
+// UpdateRoster - change contacts of two users:
+//
+//	RosterRequest - send request (accepted at once if the other user has sent request too;
+//	                request from blocked user is not shown to the other user)
+//	RosterAccept  - accept request from other user
+//	RosterDecline - decline request from other user
+//	RosterRemove  - remove contact or cancel request
+//
+// It returns true if users became contacts.
+func (db *LocalDb) UpdateRoster(name, otherName, action string) (bool, error) {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	user, other, err := db.userPair(name, otherName)
+	if err != nil {
+		return false, err
+	}
+	before := db.stateOf([]string{name, otherName}, nil)
+
+	linked := false
+	switch action {
+	case RosterRequest:
+		switch {
+		case slices.Contains(user.Contacts, otherName):
+			return false, errors.New("User '" + otherName + "' is already in your contacts")
+		case slices.Contains(user.RequestsOut, otherName):
+			return false, errors.New("Request to '" + otherName + "' is already sent")
+		case slices.Contains(user.RequestsIn, otherName):
+			linkUsers(user, other)
+			linked = true
+		default:
+			user.RequestsOut = addName(user.RequestsOut, otherName)
+			if !slices.Contains(other.Blocked, name) {
+				other.RequestsIn = addName(other.RequestsIn, name)
+			}
+		}
+
+	case RosterAccept:
+		if !slices.Contains(user.RequestsIn, otherName) {
+			return false, errors.New("No request from '" + otherName + "'")
+		}
+		linkUsers(user, other)
+		linked = true
+
+	case RosterDecline:
+		if !slices.Contains(user.RequestsIn, otherName) {
+			return false, errors.New("No request from '" + otherName + "'")
+		}
+		user.RequestsIn = removeName(user.RequestsIn, otherName)
+		other.RequestsOut = removeName(other.RequestsOut, name)
+
+	case RosterRemove:
+		if !slices.Contains(user.Contacts, otherName) && !slices.Contains(user.RequestsOut, otherName) {
+			return false, errors.New("User '" + otherName + "' is not in your contacts")
+		}
+		unlinkUsers(user, other)
+
+	default:
+		return false, errors.New("Unknown roster action '" + action + "'")
+	}
+
+	if err := db.commit(before); err != nil {
+		return false, err
+	}
+
+	return linked, nil
+}
+
+// userPair - two different existing users
+func (db *LocalDb) userPair(name, otherName string) (*UserInfo, *UserInfo, error) {
+
+	user, ok := db.users[name]
+	if !ok {
+		return nil, nil, errors.New("User '" + name + "' does not exist")
+	}
+	other, ok := db.users[otherName]
+	if !ok {
+		return nil, nil, errors.New("User '" + otherName + "' does not exist")
+	}
+	if user == other {
+		return nil, nil, errors.New("You can't do it with yourself")
+	}
+
+	return user, other, nil
+}
+
+// linkUsers - make users contacts of each other
+func linkUsers(a, b *UserInfo) {
+	unlinkUsers(a, b)
+	a.Contacts = addName(a.Contacts, b.Name)
+	b.Contacts = addName(b.Contacts, a.Name)
+}
+
+// unlinkUsers - remove contact and pending requests of both users
+func unlinkUsers(a, b *UserInfo) {
+	for _, pair := range [][2]*UserInfo{{a, b}, {b, a}} {
+		u, other := pair[0], pair[1]
+		u.Contacts = removeName(u.Contacts, other.Name)
+		u.RequestsIn = removeName(u.RequestsIn, other.Name)
+		u.RequestsOut = removeName(u.RequestsOut, other.Name)
+	}
+}
+
+// addName - sorted list with name
+func addName(names []string, name string) []string {
+	if slices.Contains(names, name) {
+		return names
+	}
+	names = append(names, name)
+	sort.Strings(names)
+	return names
+}
+
+// removeName - list without name
+func removeName(names []string, name string) []string {
+	return slices.DeleteFunc(names, func(n string) bool { return n == name })
+}
+
+// GetProfile - user profile
+func (db *LocalDb) GetProfile(name string) (Profile, bool) {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	user, ok := db.users[name]
+	if !ok {
+		return Profile{}, false
+	}
+	if user.Profile == nil {
+		return Profile{}, true
+	}
+
+	return *user.Profile, true
+}
+
+// SetProfile - change user profile
+func (db *LocalDb) SetProfile(name string, p Profile) error {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	user, ok := db.users[name]
+
+	// check if user exists
+	if !ok {
+		return errors.New("User '" + name + "' does not exist")
+	}
+
+	before := db.stateOf([]string{name}, nil)
+	user.Profile = &p
+
+	return db.commit(before)
+}
+
+// GetOnlineUserList - Get Online User List (sorted)
+func (db *LocalDb) GetOnlineUserList() []string {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	userList := []string{}
+
+	for _, u := range db.users {
+		if u.conn != nil {
+			userList = append(userList, u.Name)
+		}
+	}
+	sort.Strings(userList)
+
+	return userList
+}
+
+// Logout - logout
+func (db *LocalDb) Logout(name string) {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	user, ok := db.users[name]
+	if ok {
+		// go offline
+		user.conn = nil
+		db.users[name] = user
+	}
+}
+
+// Clear - Clear Local Db (for testing)
+func (db *LocalDb) Clear() error {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	// clear db
+	users, ipBans := db.users, db.ipBans
+	db.users = make(map[string]*UserInfo)
+	db.ipBans = make(map[string]*Restriction)
+
+	// journal records before it must not be applied: write the whole file
+	if err := db.save(); err != nil {
+		db.users, db.ipBans = users, ipBans
+		return err
+	}
+
+	return nil
 }
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// redactedKeys - attributes never written to log as is (lower case)
+var redactedKeys = map[string]bool{
+	"password":    true,
+	"md5password": true,
+	"newpassword": true,
+	"token":       true,
+}
+
+// newLogger - create structured logger writing to w with level controlled by 'level'
+func newLogger(cfg LogConfig, level *slog.LevelVar, w io.Writer) *slog.Logger {
+
+	level.Set(cfg.Level)
+
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+
+	var handler slog.Handler
+	if cfg.Format == LogFormatJSON {
+		handler = slog.NewJSONHandler(w, options)
+	} else {
+		handler = slog.NewTextHandler(w, options)
+	}
+
+	return slog.New(handler)
+}
+
+// redactAttr - hide credentials
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if redactedKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, "[REDACTED]")
+	}
+	return a
+}
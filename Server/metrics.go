@@ -0,0 +1,203 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Request outcomes
+const (
+	outcomeOK          = "ok"
+	outcomeError       = "error"
+	outcomeRateLimited = "rate_limited"
+)
+
+// Histogram buckets (seconds)
+var (
+	requestDurationBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+	saveDurationBuckets    = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+)
+
+// requestKey - requests counter labels
+type requestKey struct {
+	command protocol.CommandToServer
+	outcome string
+}
+
+// metrics - server metrics in Prometheus text format
+type metrics struct {
+	activeConnections int64
+	messagesRouted    uint64
+	bytesIn           uint64
+	bytesOut          uint64
+
+	mutex           sync.Mutex
+	requests        map[requestKey]uint64
+	requestDuration map[protocol.CommandToServer]*histogram
+	saveDuration    *histogram
+}
+
+// newMetrics - metrics constructor
+func newMetrics() *metrics {
+	m := new(metrics)
+	m.requests = make(map[requestKey]uint64)
+	m.requestDuration = make(map[protocol.CommandToServer]*histogram)
+	m.saveDuration = newHistogram(saveDurationBuckets)
+	return m
+}
+
+// observeRequest - count request and its duration
+func (m *metrics) observeRequest(command protocol.CommandToServer, outcome string, d time.Duration) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.requests[requestKey{command, outcome}]++
+
+	h, ok := m.requestDuration[command]
+	if !ok {
+		h = newHistogram(requestDurationBuckets)
+		m.requestDuration[command] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// observeSave - storage save duration
+func (m *metrics) observeSave(d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.saveDuration.observe(d.Seconds())
+}
+
+// write - write metrics in Prometheus text format
+func (m *metrics) write(w io.Writer, usersOnline int) {
+
+	fmt.Fprintln(w, "# HELP messenger_connections_active Open client connections.")
+	fmt.Fprintln(w, "# TYPE messenger_connections_active gauge")
+	fmt.Fprintln(w, "messenger_connections_active", atomic.LoadInt64(&m.activeConnections))
+
+	fmt.Fprintln(w, "# HELP messenger_users_online Logged in users.")
+	fmt.Fprintln(w, "# TYPE messenger_users_online gauge")
+	fmt.Fprintln(w, "messenger_users_online", usersOnline)
+
+	fmt.Fprintln(w, "# HELP messenger_messages_routed_total Messages delivered to recipients.")
+	fmt.Fprintln(w, "# TYPE messenger_messages_routed_total counter")
+	fmt.Fprintln(w, "messenger_messages_routed_total", atomic.LoadUint64(&m.messagesRouted))
+
+	fmt.Fprintln(w, "# HELP messenger_received_bytes_total Bytes received from clients.")
+	fmt.Fprintln(w, "# TYPE messenger_received_bytes_total counter")
+	fmt.Fprintln(w, "messenger_received_bytes_total", atomic.LoadUint64(&m.bytesIn))
+
+	fmt.Fprintln(w, "# HELP messenger_sent_bytes_total Bytes sent to clients.")
+	fmt.Fprintln(w, "# TYPE messenger_sent_bytes_total counter")
+	fmt.Fprintln(w, "messenger_sent_bytes_total", atomic.LoadUint64(&m.bytesOut))
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// sorted for stable output
+	keys := []requestKey{}
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].command != keys[j].command {
+			return keys[i].command < keys[j].command
+		}
+		return keys[i].outcome < keys[j].outcome
+	})
+
+	fmt.Fprintln(w, "# HELP messenger_requests_total Client requests by command and outcome.")
+	fmt.Fprintln(w, "# TYPE messenger_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "messenger_requests_total{command=%q,outcome=%q} %d\n", string(k.command), k.outcome, m.requests[k])
+	}
+
+	commands := []protocol.CommandToServer{}
+	for c := range m.requestDuration {
+		commands = append(commands, c)
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i] < commands[j] })
+
+	fmt.Fprintln(w, "# HELP messenger_request_duration_seconds Request processing time.")
+	fmt.Fprintln(w, "# TYPE messenger_request_duration_seconds histogram")
+	for _, c := range commands {
+		m.requestDuration[c].write(w, "messenger_request_duration_seconds", fmt.Sprintf("command=%q,", string(c)))
+	}
+
+	fmt.Fprintln(w, "# HELP messenger_storage_save_duration_seconds Time to save storage.")
+	fmt.Fprintln(w, "# TYPE messenger_storage_save_duration_seconds histogram")
+	m.saveDuration.write(w, "messenger_storage_save_duration_seconds", "")
+}
+
+// histogram - cumulative histogram
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// newHistogram - histogram constructor
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// observe - add value
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// write - write histogram series; labels is "" or a list of labels ending with ','
+func (h *histogram) write(w io.Writer, name, labels string) {
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=%q} %d\n", name, labels, strconv.FormatFloat(b, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+	if labels == "" {
+		fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum, name, h.count)
+	} else {
+		labels = labels[:len(labels)-1]
+		fmt.Fprintf(w, "%s_sum{%s} %g\n%s_count{%s} %d\n", name, labels, h.sum, name, labels, h.count)
+	}
+}
+
+// countingConn - connection counting bytes in/out
+type countingConn struct {
+	net.Conn
+	metrics *metrics
+}
+
+// Read - net.Conn interface
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.metrics.bytesIn, uint64(n))
+	return n, err
+}
+
+// Write - net.Conn interface
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.metrics.bytesOut, uint64(n))
+	return n, err
+}
+
+// handleMetrics - GET /metrics
+func (srv *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	srv.metrics.write(w, len(srv.localDb.GetOnlineUserList()))
+}
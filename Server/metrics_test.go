@@ -0,0 +1,69 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+
+	srv := newTestServer(t, "a")
+
+	guest := newTestClient(t, srv, "")
+	guest.request(protocol.ScmdCheckUniqueNickName, "b", "")
+	guest.request(protocol.ScmdCheckUniqueNickName, "c", "")
+	guest.request(protocol.ScmdCheckUniqueNickName, "a", "")
+	guest.request("Unknown", "", "")
+	srv.metrics.observeSave(3 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	srv.httpMux().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Error("Content-Type: ", ct)
+	}
+
+	lines := map[string]bool{}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		lines[line] = true
+	}
+	for _, line := range []string{
+		"messenger_users_online 0",
+		`messenger_requests_total{command="CheckUniqueNickName",outcome="error"} 1`,
+		`messenger_requests_total{command="CheckUniqueNickName",outcome="ok"} 2`,
+		`messenger_requests_total{command="unknown",outcome="error"} 1`,
+		`messenger_request_duration_seconds_bucket{command="CheckUniqueNickName",le="+Inf"} 3`,
+		`messenger_request_duration_seconds_count{command="CheckUniqueNickName"} 3`,
+		`messenger_storage_save_duration_seconds_bucket{le="0.001"} 0`,
+		`messenger_storage_save_duration_seconds_bucket{le="0.005"} 1`,
+		`messenger_storage_save_duration_seconds_bucket{le="+Inf"} 1`,
+		"messenger_storage_save_duration_seconds_sum 0.003",
+		"messenger_storage_save_duration_seconds_count 1",
+	} {
+		if !lines[line] {
+			t.Errorf("No line %q", line)
+		}
+	}
+	if !strings.Contains(w.Body.String(), `messenger_request_duration_seconds_sum{command="CheckUniqueNickName"} `) {
+		t.Error("No request duration sum")
+	}
+
+	// buckets are cumulative
+	last := -1
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if !strings.HasPrefix(line, `messenger_request_duration_seconds_bucket{command="CheckUniqueNickName",`) {
+			continue
+		}
+		n, err := strconv.Atoi(line[strings.LastIndex(line, " ")+1:])
+		if err != nil || n < last {
+			t.Error("Invalid bucket: ", line)
+		}
+		last = n
+	}
+	if last != 3 {
+		t.Error("Expected 3 requests in the last bucket, got ", last)
+	}
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"errors"
+	"net"
+	"time"
+)
+
+// Restriction kinds
+const (
+	RestrictionBan   = "ban"
+	RestrictionMute  = "mute"
+	RestrictionIPBan = "ipban"
+)
+
+// Restriction - ban or mute
+type Restriction struct {
+	// end time (zero - forever)
+	Until time.Time
+	// reason shown to the user
+	Reason string
+	// moderator name and time
+	By      string
+	Created time.Time
+}
+
+// RestrictionEntry - restriction with its kind and target (user name or IP address)
+type RestrictionEntry struct {
+	Kind   string
+	Target string
+	Restriction
+}
+
+// newRestriction - restriction from now for duration (0 - forever)
+func newRestriction(by string, duration time.Duration, reason string) *Restriction {
+	r := &Restriction{Reason: reason, By: by, Created: time.Now().UTC()}
+	if duration > 0 {
+		r.Until = r.Created.Add(duration)
+	}
+	return r
+}
+
+// active - restriction is not expired
+func (r *Restriction) active(now time.Time) bool {
+	return r.Until.IsZero() || now.Before(r.Until)
+}
+
+// describe - "until <time>: <reason>"
+func (r *Restriction) describe() string {
+
+	text := "forever"
+	if !r.Until.IsZero() {
+		text = "until " + r.Until.UTC().Format("2006-01-02 15:04 MST")
+	}
+	if r.Reason != "" {
+		text += ": " + r.Reason
+	}
+
+	return text
+}
+
+// canModerate - moderators can't act on moderators and admins, admins can't act on admins
+func (srv *Server) canModerate(s *session, target string) error {
+
+	role := srv.localDb.GetRole(target)
+	if role == "" {
+		return errors.New("User '" + target + "' does not exist")
+	}
+
+	if rolePermissions[role] >= rolePermissions[srv.localDb.GetRole(s.userName)] {
+		return errors.New("Permission denied")
+	}
+
+	return nil
+}
+
+// logModeration - record moderation action
+func (s *session) logModeration(action, target string, duration time.Duration, reason string) {
+	s.logger.Warn("moderation", "action", action, "by", s.userName, "target", target,
+		"duration", duration.String(), "reason", reason)
+}
+
+// notifyUser - send notice to all sessions of the user
+func (srv *Server) notifyUser(name, code, text string) {
+	for _, s := range srv.sessionList() {
+		if s.user() == name {
+			sendNoticeTo(s.conn, code, text)
+		}
+	}
+}
+
+// handleKick - Kick
+func (srv *Server) handleKick(s *session, rqst protocol.Request) (string, error) {
+
+	if err := srv.canModerate(s, rqst.Data1); err != nil {
+		return "", err
+	}
+
+	text := "You have been kicked by moderator"
+	if rqst.Data2 != "" {
+		text += ": " + rqst.Data2
+	}
+	if srv.kickUser(rqst.Data1, protocol.NoticeKicked, text) == 0 {
+		return "", errors.New("User '" + rqst.Data1 + "' is not connected")
+	}
+
+	s.logModeration("kick", rqst.Data1, 0, rqst.Data2)
+	return "ok", nil
+}
+
+// handleBan - Ban
+func (srv *Server) handleBan(s *session, rqst protocol.Request) (string, error) {
+
+	duration, reason, err := protocol.ParseModerationArgs(rqst.Data2)
+	if err != nil {
+		return "", err
+	}
+	if err := srv.canModerate(s, rqst.Data1); err != nil {
+		return "", err
+	}
+
+	r := newRestriction(s.userName, duration, reason)
+	if err := srv.localDb.SetRestriction(RestrictionBan, rqst.Data1, r); err != nil {
+		return "", err
+	}
+	srv.kickUser(rqst.Data1, protocol.NoticeBanned, "You are banned "+r.describe())
+
+	s.logModeration("ban", rqst.Data1, duration, reason)
+	return "ok", nil
+}
+
+// handleUnban - Unban
+func (srv *Server) handleUnban(s *session, rqst protocol.Request) (string, error) {
+
+	if err := srv.canModerate(s, rqst.Data1); err != nil {
+		return "", err
+	}
+	if err := srv.localDb.SetRestriction(RestrictionBan, rqst.Data1, nil); err != nil {
+		return "", err
+	}
+
+	s.logModeration("unban", rqst.Data1, 0, "")
+	return "ok", nil
+}
+
+// handleBanIP - BanIP
+func (srv *Server) handleBanIP(s *session, rqst protocol.Request) (string, error) {
+
+	duration, reason, err := protocol.ParseModerationArgs(rqst.Data2)
+	if err != nil {
+		return "", err
+	}
+
+	ip := net.ParseIP(rqst.Data1)
+	if ip == nil {
+		return "", errors.New("Invalid IP address '" + rqst.Data1 + "'")
+	}
+	if ip.String() == s.ip {
+		return "", errors.New("You can't ban your own address")
+	}
+	// the ban would disconnect users the moderator can't ban
+	for _, c := range srv.sessionList() {
+		if name := c.user(); c.ip == ip.String() && name != "" && srv.canModerate(s, name) != nil {
+			return "", errors.New("Permission denied (user '" + name + "' is connected from this address)")
+		}
+	}
+
+	r := newRestriction(s.userName, duration, reason)
+	if err := srv.localDb.SetRestriction(RestrictionIPBan, ip.String(), r); err != nil {
+		return "", err
+	}
+	srv.closeSessions(func(c *session) bool { return c.ip == ip.String() },
+		protocol.NoticeBanned, "Your address is banned "+r.describe())
+
+	s.logModeration("banip", ip.String(), duration, reason)
+	return "ok", nil
+}
+
+// handleUnbanIP - UnbanIP
+func (srv *Server) handleUnbanIP(s *session, rqst protocol.Request) (string, error) {
+
+	ip := net.ParseIP(rqst.Data1)
+	if ip == nil {
+		return "", errors.New("Invalid IP address '" + rqst.Data1 + "'")
+	}
+
+	if err := srv.localDb.SetRestriction(RestrictionIPBan, ip.String(), nil); err != nil {
+		return "", err
+	}
+
+	s.logModeration("unbanip", ip.String(), 0, "")
+	return "ok", nil
+}
+
+// handleMute - Mute
+func (srv *Server) handleMute(s *session, rqst protocol.Request) (string, error) {
+
+	duration, reason, err := protocol.ParseModerationArgs(rqst.Data2)
+	if err != nil {
+		return "", err
+	}
+	if err := srv.canModerate(s, rqst.Data1); err != nil {
+		return "", err
+	}
+
+	r := newRestriction(s.userName, duration, reason)
+	if err := srv.localDb.SetRestriction(RestrictionMute, rqst.Data1, r); err != nil {
+		return "", err
+	}
+	srv.notifyUser(rqst.Data1, protocol.NoticeMuted, "You are muted "+r.describe())
+
+	s.logModeration("mute", rqst.Data1, duration, reason)
+	return "ok", nil
+}
+
+// handleUnmute - Unmute
+func (srv *Server) handleUnmute(s *session, rqst protocol.Request) (string, error) {
+
+	if err := srv.canModerate(s, rqst.Data1); err != nil {
+		return "", err
+	}
+	if err := srv.localDb.SetRestriction(RestrictionMute, rqst.Data1, nil); err != nil {
+		return "", err
+	}
+	srv.notifyUser(rqst.Data1, protocol.NoticeUnmuted, "You can send messages again")
+
+	s.logModeration("unmute", rqst.Data1, 0, "")
+	return "ok", nil
+}
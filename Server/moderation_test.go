@@ -0,0 +1,162 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestrictionStorage(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "messenger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// version 0 file
+	fn := filepath.Join(dir, "db.json")
+	if err := ioutil.WriteFile(fn, []byte(`{"a":{"Name":"a","Md5Password":"md5"}}`), 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	db := NewLocalDb(fn, slog.Default())
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if !db.DoesUserExist("a") {
+		t.Fatal("Legacy file is not loaded")
+	}
+
+	db.SetRestriction(RestrictionBan, "a", newRestriction("m", time.Hour, "spam"))
+	db.SetRestriction(RestrictionMute, "a", &Restriction{Until: time.Now().Add(-time.Minute)})
+	db.SetRestriction(RestrictionIPBan, "10.0.0.1", newRestriction("m", 0, ""))
+	db.Close()
+
+	// reload
+	db = NewLocalDb(fn, slog.Default())
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if r := db.GetRestriction(RestrictionBan, "a"); r == nil || r.Reason != "spam" {
+		t.Error("Ban is not saved: ", r)
+	}
+	if r := db.GetRestriction(RestrictionMute, "a"); r != nil {
+		t.Error("Expired mute is active")
+	}
+	if r := db.GetRestriction(RestrictionIPBan, "10.0.0.1"); r == nil || !strings.HasPrefix(r.describe(), "forever") {
+		t.Error("IP ban is not saved: ", r)
+	}
+	if list := db.GetRestrictionList(); len(list) != 2 {
+		t.Error("Restriction list: ", list)
+	}
+	if err := db.SetRestriction(RestrictionBan, "b", nil); err == nil {
+		t.Error("Expected error for unknown user")
+	}
+}
+
+func TestModeration(t *testing.T) {
+
+	cfg := DefaultConfig()
+	cfg.Storage.Backend = StorageMemory
+
+	srv := NewServerWithConfig(cfg)
+	if err := srv.localDb.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"u", "m", "a"} {
+		srv.localDb.AddUser(name, protocol.HashPassword([]byte("md5")), nil)
+	}
+	srv.localDb.SetRole("m", protocol.RoleModerator)
+	srv.localDb.SetRole("a", protocol.RoleAdmin)
+
+	mod := &session{userName: "m", logger: slog.Default()}
+	user := &session{key: "u", userName: "u", logger: slog.Default()}
+
+	request := func(handler requestHandler, s *session, command protocol.CommandToServer, data1, data2 string) error {
+		_, err := handler(srv, s, protocol.Request{Command: command, Data1: data1, Data2: data2})
+		return err
+	}
+
+	// moderator can't ban admin
+	if err := request((*Server).handleBan, mod, protocol.ScmdBan, "a", "1h"); err == nil {
+		t.Error("Expected permission error")
+	}
+
+	// mute
+	if err := request((*Server).handleMute, mod, protocol.ScmdMute, "u", "10m flood"); err != nil {
+		t.Error("Mute: ", err)
+	}
+	err := request((*Server).handleMessageTo, user, protocol.ScmdMessageTo, "m", "hi")
+	if err == nil || !strings.Contains(err.Error(), "muted") || !strings.Contains(err.Error(), "flood") {
+		t.Error("Expected mute error: ", err)
+	}
+	if err := request((*Server).handleUnmute, mod, protocol.ScmdUnmute, "u", ""); err != nil {
+		t.Error("Unmute: ", err)
+	}
+
+	// ban
+	if err := request((*Server).handleBan, mod, protocol.ScmdBan, "u", "forever abuse"); err != nil {
+		t.Error("Ban: ", err)
+	}
+	guest := &session{key: "g", logger: slog.Default()}
+	err = request((*Server).handleLogin, guest, protocol.ScmdLogin, "u", "md5")
+	if err == nil || !strings.Contains(err.Error(), "banned forever: abuse") {
+		t.Error("Expected ban error: ", err)
+	}
+	if err := request((*Server).handleUnban, mod, protocol.ScmdUnban, "u", ""); err != nil {
+		t.Error("Unban: ", err)
+	}
+	if err := request((*Server).handleLogin, guest, protocol.ScmdLogin, "u", "md5"); err != nil {
+		t.Error("Login after unban: ", err)
+	}
+
+	// moderator can't lift restrictions of admin and can't ban admin's address
+	srv.localDb.SetRestriction(RestrictionMute, "a", newRestriction("a", 0, ""))
+	srv.localDb.SetRestriction(RestrictionBan, "a", newRestriction("a", 0, ""))
+	if err := request((*Server).handleUnmute, mod, protocol.ScmdUnmute, "a", ""); err == nil || srv.localDb.GetRestriction(RestrictionMute, "a") == nil {
+		t.Error("Expected unmute permission error: ", err)
+	}
+	if err := request((*Server).handleUnban, mod, protocol.ScmdUnban, "a", ""); err == nil || srv.localDb.GetRestriction(RestrictionBan, "a") == nil {
+		t.Error("Expected unban permission error: ", err)
+	}
+	srv.addSession(&session{ip: "10.0.0.5", userName: "a"})
+	if err := request((*Server).handleBanIP, mod, protocol.ScmdBanIP, "10.0.0.5", "1h"); err == nil || srv.localDb.GetRestriction(RestrictionIPBan, "10.0.0.5") != nil {
+		t.Error("Expected IP ban permission error: ", err)
+	}
+
+	// invalid arguments
+	if err := request((*Server).handleBanIP, mod, protocol.ScmdBanIP, "nonsense", "1h"); err == nil {
+		t.Error("Expected invalid address error")
+	}
+	if err := request((*Server).handleMute, mod, protocol.ScmdMute, "u", "soon"); err == nil {
+		t.Error("Expected invalid duration error")
+	}
+}
+
+func TestNotifyStalledClient(t *testing.T) {
+
+	srv := newTestServer(t, "u")
+
+	// client doesn't read
+	client, server := net.Pipe()
+	defer client.Close()
+	srv.addSession(&session{conn: server, userName: "u"})
+
+	start := time.Now()
+	srv.notifyUser("u", protocol.NoticeMuted, "You are muted")
+	if out, _ := srv.adminAnnounce([]string{"hello"}); out[0] != "Sent to 0 client(s)" {
+		t.Error("Announce: ", out)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Error("Stalled client blocks notices for ", d)
+	}
+}
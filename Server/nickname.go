@@ -0,0 +1,125 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NicknamePolicy - rules for new nicknames
+//
+// Nicknames are stored in NFC form. Two nicknames are the same user if their
+// case-folded forms are equal and are too similar to coexist if their
+// confusable skeletons are equal (i.e. "bob", "Bob", "b0b" and Cyrillic "bоb").
+type NicknamePolicy struct {
+	// length limits (characters)
+	MinLength int
+	MaxLength int
+	// names nobody can register (compared by skeleton)
+	Reserved []string
+}
+
+// DefaultNicknamePolicy - default nickname policy
+func DefaultNicknamePolicy() NicknamePolicy {
+	return NicknamePolicy{
+		MinLength: 1,
+		MaxLength: 32,
+		Reserved:  []string{"admin", "administrator", "moderator", "root", "server", "system"},
+	}
+}
+
+// nicknamePunctuation - allowed non-alphanumeric characters (not first or last)
+const nicknamePunctuation = "_-."
+
+// normalizeNickname - nickname in NFC form (as it is stored)
+func normalizeNickname(name string) string {
+	return norm.NFC.String(name)
+}
+
+// foldNickname - case-insensitive form of nickname (compatibility characters are decomposed)
+func foldNickname(name string) string {
+	return norm.NFKC.String(cases.Fold().String(norm.NFKC.String(name)))
+}
+
+// nicknameKey - confusable skeleton of nickname; nicknames with equal keys can't coexist
+// (it's made of the folded nickname, so the same folded nicknames have the same key)
+func nicknameKey(name string) string {
+
+	var b strings.Builder
+	for _, r := range foldNickname(name) {
+		if s, ok := confusables[r]; ok {
+			b.WriteString(s)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+
+	return multiConfusables.Replace(b.String())
+}
+
+// confusables - characters that look like Latin letters (a small subset of Unicode confusables)
+var confusables = map[rune]string{
+	// digits
+	'0': "o", '1': "l", '5': "s",
+	// Latin (folded capital I is i, and I looks like l)
+	'i': "l", 'ı': "l", 'ȷ': "j", 'ɡ': "g", 'ℓ': "l",
+	// Cyrillic
+	'а': "a", 'в': "b", 'е': "e", 'ё': "e", 'һ': "h", 'і': "l", 'ї': "l", 'ј': "j",
+	'к': "k", 'ӏ': "l", 'м': "m", 'н': "h", 'о': "o", 'р': "p", 'с': "c", 'ѕ': "s",
+	'т': "t", 'у': "y", 'х': "x", 'ԁ': "d", 'ԛ': "q", 'ԝ': "w", 'ь': "b",
+	// Greek
+	'α': "a", 'β': "b", 'γ': "y", 'ε': "e", 'η': "n", 'ι': "l", 'κ': "k", 'ν': "v",
+	'ο': "o", 'ρ': "p", 'τ': "t", 'υ': "u", 'χ': "x", 'ω': "w",
+}
+
+// multiConfusables - letter sequences that look like one letter
+var multiConfusables = strings.NewReplacer("rn", "m", "vv", "w")
+
+// check - validate nickname (in NFC form)
+func (p *NicknamePolicy) check(name string) error {
+
+	if name == "" {
+		return errors.New("Empty nickname")
+	}
+	if !utf8.ValidString(name) {
+		return errors.New("Invalid nickname (not UTF-8)")
+	}
+	n := utf8.RuneCountInString(name)
+	if n < p.MinLength {
+		return errors.New("Too short nickname (" + strconv.Itoa(n) + " < " + strconv.Itoa(p.MinLength) + " characters)")
+	}
+	if p.MaxLength > 0 && n > p.MaxLength {
+		return errors.New("Too long nickname (" + strconv.Itoa(n) + " > " + strconv.Itoa(p.MaxLength) + " characters)")
+	}
+
+	// letters (with combining marks), digits and some punctuation inside
+	for i, r := range name {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+		case unicode.Is(unicode.M, r) && i > 0:
+		case strings.ContainsRune(nicknamePunctuation, r) && i > 0 && i+utf8.RuneLen(r) < len(name):
+		default:
+			return errors.New("Invalid character '" + string(r) + "' in nickname (letters, digits and '" +
+				nicknamePunctuation + "' inside are allowed)")
+		}
+	}
+
+	key := nicknameKey(name)
+	for _, reserved := range p.Reserved {
+		if key == nicknameKey(reserved) {
+			return errors.New("Nickname '" + name + "' is reserved")
+		}
+	}
+
+	return nil
+}
+
+// nicknamePolicy - nickname policy of the server
+func (srv *Server) nicknamePolicy() *NicknamePolicy {
+	return &srv.cfg.Nickname
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"log/slog"
+	"testing"
+)
+
+func TestNicknamePolicy(t *testing.T) {
+
+	policy := DefaultNicknamePolicy()
+	policy.MinLength = 2
+
+	valid := []string{"bob", "Bob_2", "a.b-c", "Алиса", "José", "日本"}
+	invalid := []string{"", "b", "with space", "a,b", "_bob", "bob.", "tab\t", "admin", "Server", "r00t",
+		"012345678901234567890123456789012"}
+
+	for _, name := range valid {
+		if err := policy.check(normalizeNickname(name)); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+	for _, name := range invalid {
+		if err := policy.check(normalizeNickname(name)); err == nil {
+			t.Errorf("%q: expected error", name)
+		}
+	}
+}
+
+func TestNicknameKey(t *testing.T) {
+
+	// decomposed "é" is stored composed
+	if normalizeNickname("José") != "José" {
+		t.Error("Nickname is not NFC")
+	}
+
+	same := [][2]string{
+		{"bob", "BOB"},
+		{"bob", "b0b"},
+		{"bob", "bоb"}, // Cyrillic o
+		{"alice", "AIice"},
+		{"ivan", "Ivan"},
+		{"ivan", "IVAN"},
+		{"modern", "modem"},
+		{"ｂｏｂ", "bob"}, // fullwidth
+		{"Straße", "STRASSE"},
+	}
+	for _, pair := range same {
+		if nicknameKey(pair[0]) != nicknameKey(pair[1]) {
+			t.Errorf("%q and %q must be confusable", pair[0], pair[1])
+		}
+	}
+	for _, pair := range [][2]string{{"bob", "rob"}, {"anna", "anne"}, {"José", "Jose"}} {
+		if nicknameKey(pair[0]) == nicknameKey(pair[1]) {
+			t.Errorf("%q and %q must differ", pair[0], pair[1])
+		}
+	}
+}
+
+func TestNicknameUniqueness(t *testing.T) {
+
+	cfg := DefaultConfig()
+	cfg.Storage.Backend = StorageMemory
+
+	srv := NewServerWithConfig(cfg)
+	if err := srv.localDb.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	guest := &session{key: "guest", ip: "10.0.0.1", logger: slog.Default()}
+	request := func(command protocol.CommandToServer, data1, data2 string) error {
+		_, err := requestHandlers[command](srv, guest, protocol.Request{Command: command, Data1: data1, Data2: data2})
+		return err
+	}
+
+	if err := request(protocol.ScmdRegisterUser, "Bob", "secret-password"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Bob", "bob", "B0B", "Воb"} {
+		if err := request(protocol.ScmdCheckUniqueNickName, name, ""); err == nil {
+			t.Errorf("%q: expected not unique", name)
+		}
+		if err := request(protocol.ScmdRegisterUser, name, "secret-password"); err == nil {
+			t.Errorf("%q: expected registration error", name)
+		}
+	}
+	if err := request(protocol.ScmdCheckUniqueNickName, "rob", ""); err != nil {
+		t.Error(err)
+	}
+
+	// login is case-insensitive
+	if err := request(protocol.ScmdLogin, "BOB", "secret-password"); err != nil {
+		t.Fatal(err)
+	}
+	if guest.user() != "Bob" {
+		t.Error("Expected registered name, got ", guest.user())
+	}
+
+	// own name can change case
+	if err := request(protocol.ScmdChangeNickname, "bob", ""); err != nil {
+		t.Error(err)
+	}
+	if guest.user() != "bob" {
+		t.Error("Nickname is not changed: ", guest.user())
+	}
+
+	// capital I is the same user, not a look-alike
+	srv.localDb.AddUser("ivan", "$2a$hash", nil)
+	for _, name := range []string{"Ivan", "IVAN"} {
+		if err := srv.localDb.CheckUnique(name); err == nil || err.Error() != "User 'ivan' already exists" {
+			t.Errorf("%q: %v", name, err)
+		}
+		if resolved := srv.localDb.ResolveName(name); resolved != "ivan" {
+			t.Errorf("%q resolved to %q", name, resolved)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordPolicy - rules for new passwords
+type PasswordPolicy struct {
+	// min length (characters)
+	MinLength int
+	// breached passwords file (empty - no check): one password per line,
+	// plain text or SHA-1 hex (lines "<hex>:<count>" of Pwned Passwords dumps work too)
+	BreachedFile string
+	// number of last passwords that can't be reused (including the current one; 0 - no check)
+	History int
+}
+
+// DefaultPasswordPolicy - default password policy
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{MinLength: 8, History: 3}
+}
+
+// bcrypt hashes at most 72 bytes
+const constMaxPassword = 72
+
+// passwordHashCost - bcrypt cost of new hashes
+var passwordHashCost = bcrypt.DefaultCost
+
+// hashPassword - bcrypt hash of password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordHashCost)
+	return string(hash), err
+}
+
+// legacyPasswordHash - hash is made by old client ("md5:<hex>")
+func legacyPasswordHash(hash string) bool {
+	return strings.HasPrefix(hash, "md5:")
+}
+
+// checkPasswordHash - password matches hash (bcrypt or legacy)
+func checkPasswordHash(hash, password string) bool {
+	if legacyPasswordHash(hash) {
+		return hash == protocol.HashPassword([]byte(password))
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// passwordChecker - password policy with loaded breached password list
+type passwordChecker struct {
+	policy PasswordPolicy
+	// SHA-1 of breached passwords
+	breached map[[sha1.Size]byte]bool
+}
+
+// newPasswordChecker - passwordChecker constructor (breached list is read by load)
+func newPasswordChecker(policy PasswordPolicy) *passwordChecker {
+	return &passwordChecker{policy: policy}
+}
+
+// load - read breached passwords file
+func (c *passwordChecker) load() error {
+
+	if c.policy.BreachedFile == "" {
+		return nil
+	}
+
+	f, err := os.Open(c.policy.BreachedFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	breached := make(map[[sha1.Size]byte]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		// SHA-1 hex (with optional count)
+		hexHash, _, _ := strings.Cut(line, ":")
+		var sum [sha1.Size]byte
+		if len(hexHash) == 2*sha1.Size {
+			if _, err := hex.Decode(sum[:], []byte(hexHash)); err == nil {
+				breached[sum] = true
+				continue
+			}
+		}
+
+		breached[sha1.Sum([]byte(line))] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	c.breached = breached
+	return nil
+}
+
+// check - validate new password of user ("" - new user)
+func (c *passwordChecker) check(db LocalDbInterface, name, password string) error {
+
+	if !utf8.ValidString(password) {
+		return errors.New("Invalid password (not UTF-8)")
+	}
+	if n := utf8.RuneCountInString(password); n < c.policy.MinLength {
+		return errors.New("Too short password (" + strconv.Itoa(n) + " < " + strconv.Itoa(c.policy.MinLength) + " characters)")
+	}
+	if len(password) > constMaxPassword {
+		return errors.New("Too long password (max " + strconv.Itoa(constMaxPassword) + " bytes)")
+	}
+	if c.breached[sha1.Sum([]byte(password))] {
+		return errors.New("The password is known from data breaches, choose another one")
+	}
+
+	if name != "" && c.policy.History > 0 {
+		hashes := db.GetPasswordHistory(name)
+		if len(hashes) > c.policy.History {
+			hashes = hashes[:c.policy.History]
+		}
+		for _, hash := range hashes {
+			if checkPasswordHash(hash, password) {
+				return errors.New("The password was used recently, choose another one")
+			}
+		}
+	}
+
+	return nil
+}
+
+// setPassword - validate, hash and store new password of existing user
+func (c *passwordChecker) setPassword(db LocalDbInterface, name, password string) error {
+
+	if err := c.check(db, name, password); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	// previous passwords are kept for reuse check
+	return db.ChangePassword(name, hash, max(c.policy.History-1, 0))
+}
+
+// addUser - validate and hash password of new user
+func (c *passwordChecker) addUser(db LocalDbInterface, name, password string) error {
+
+	if err := c.check(db, "", password); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return db.AddUser(name, hash, nil)
+}
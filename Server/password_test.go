@@ -0,0 +1,69 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "messenger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// plain and SHA-1 ("password1") lines
+	breached := filepath.Join(dir, "breached.txt")
+	ioutil.WriteFile(breached, []byte("qwertyuiop\nE38AD214943DAAD1D64C102FAEC29DE4AFE9DA3D:2427\n"), 0600)
+
+	srv := newTestServer(t)
+	srv.passwords = newPasswordChecker(PasswordPolicy{MinLength: 8, BreachedFile: breached, History: 2})
+	if err := srv.passwords.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range []string{"short", "qwertyuiop", "password1", strings.Repeat("x", 73)} {
+		if err := srv.passwords.check(srv.localDb, "", bad); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+
+	// old client's hash is replaced on login
+	srv.localDb.AddUser("a", protocol.HashPassword([]byte("first-password")), nil)
+	if _, err := srv.authenticate("a", "first-password"); err != nil {
+		t.Fatal(err)
+	}
+	if hashes := srv.localDb.GetPasswordHistory("a"); !strings.HasPrefix(hashes[0], "$2") {
+		t.Error("Hash is not upgraded: ", hashes[0])
+	}
+
+	a := newTestClient(t, srv, "a")
+	change := func(newPassword, current string) string {
+		return a.request(protocol.ScmdChangePassword, newPassword, current)
+	}
+
+	if reply := change("second-password", "wrong-password"); reply != "Invalid current password" {
+		t.Error("Expected current password error: ", reply)
+	}
+	if reply := change("second-password", "first-password"); reply != "ok" {
+		t.Fatal(reply)
+	}
+	if reply := change("first-password", "second-password"); reply == "ok" {
+		t.Error("Expected reuse error")
+	}
+	if reply := change("third-password", "second-password"); reply != "ok" {
+		t.Fatal(reply)
+	}
+	// out of history (2)
+	if reply := change("first-password", "third-password"); reply != "ok" {
+		t.Error(reply)
+	}
+	if err := srv.localDb.CheckPassword("a", "first-password"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"errors"
+)
+
+// permission - who can run a command
+type permission int
+
+const (
+	// permAnyone - also before login
+	permAnyone permission = iota
+	// permLoggedIn - any logged in user
+	permLoggedIn
+	// permModerator - moderators and admins
+	permModerator
+	// permAdmin - admins only
+	permAdmin
+)
+
+// commandPermissions - permission required by client commands
+// (commands missing here are admin only)
+var commandPermissions = map[protocol.CommandToServer]permission{
+	protocol.ScmdCheckUniqueNickName: permAnyone,
+	protocol.ScmdRegisterUser:        permAnyone,
+	protocol.ScmdLogin:               permAnyone,
+	protocol.ScmdLoginTOTP:           permAnyone,
+	protocol.ScmdGetOnlineUserList:   permAnyone,
+	protocol.ScmdLogout:              permLoggedIn,
+	protocol.ScmdChangePassword:      permLoggedIn,
+	protocol.ScmdMessageTo:           permLoggedIn,
+	protocol.ScmdBlock:               permLoggedIn,
+	protocol.ScmdUnblock:             permLoggedIn,
+	protocol.ScmdAddContact:          permLoggedIn,
+	protocol.ScmdAcceptContact:       permLoggedIn,
+	protocol.ScmdDeclineContact:      permLoggedIn,
+	protocol.ScmdRemoveContact:       permLoggedIn,
+	protocol.ScmdGetRoster:           permLoggedIn,
+	protocol.ScmdGetProfile:          permLoggedIn,
+	protocol.ScmdSetProfile:          permLoggedIn,
+	protocol.ScmdGetAvatar:           permLoggedIn,
+	protocol.ScmdChangeNickname:      permLoggedIn,
+	protocol.ScmdDeleteAccount:       permLoggedIn,
+	protocol.ScmdSetupTOTP:           permLoggedIn,
+	protocol.ScmdConfirmTOTP:         permLoggedIn,
+	protocol.ScmdDisableTOTP:         permLoggedIn,
+	protocol.ScmdGetPrivacy:          permLoggedIn,
+	protocol.ScmdSetPrivacy:          permLoggedIn,
+	protocol.ScmdTokenLogin:          permAnyone,
+	protocol.ScmdCreateToken:         permLoggedIn,
+	protocol.ScmdListTokens:          permLoggedIn,
+	protocol.ScmdRevokeToken:         permLoggedIn,
+	protocol.ScmdSetPublicKey:        permLoggedIn,
+	protocol.ScmdGetPublicKey:        permLoggedIn,
+	protocol.ScmdKick:                permModerator,
+	protocol.ScmdBan:                 permModerator,
+	protocol.ScmdUnban:               permModerator,
+	protocol.ScmdBanIP:               permModerator,
+	protocol.ScmdUnbanIP:             permModerator,
+	protocol.ScmdMute:                permModerator,
+	protocol.ScmdUnmute:              permModerator,
+	protocol.ScmdSetRole:             permAdmin,
+	protocol.ScmdClear:               permAdmin,
+}
+
+// rolePermissions - permission granted by role
+var rolePermissions = map[string]permission{
+	protocol.RoleUser:      permLoggedIn,
+	protocol.RoleModerator: permModerator,
+	protocol.RoleAdmin:     permAdmin,
+}
+
+// validRole - check role name
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// checkPermission - check that session user can run the command
+func (srv *Server) checkPermission(s *session, command protocol.CommandToServer) error {
+
+	required, ok := commandPermissions[command]
+	if !ok {
+		required = permAdmin
+	}
+
+	// test clients clear the database before login
+	if command == protocol.ScmdClear && srv.cfg.TestMode {
+		return nil
+	}
+
+	// session of API token can run commands of its scopes only
+	if s.tokenScopes != nil && !tokenAllows(s.tokenScopes, command) {
+		return errors.New("Not allowed by API token scope")
+	}
+
+	if required == permAnyone {
+		return nil
+	}
+
+	if s.userName == "" {
+		return errors.New("You are not logged in")
+	}
+
+	// role is read on every request, so promote/demote works at once
+	if rolePermissions[srv.localDb.GetRole(s.userName)] < required {
+		return errors.New("Permission denied")
+	}
+
+	return nil
+}
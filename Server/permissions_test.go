@@ -0,0 +1,47 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"testing"
+)
+
+func TestPermissions(t *testing.T) {
+
+	cfg := DefaultConfig()
+	cfg.Storage.Backend = StorageMemory
+
+	srv := NewServerWithConfig(cfg)
+	if err := srv.localDb.Init(); err != nil {
+		t.Fatal(err)
+	}
+	srv.localDb.AddUser("u", "md5", nil)
+	srv.localDb.AddUser("a", "md5", nil)
+	if err := srv.localDb.SetRole("a", protocol.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(user string, command protocol.CommandToServer, allowed bool) {
+		err := srv.checkPermission(&session{userName: user}, command)
+		if (err == nil) != allowed {
+			t.Errorf("%q %s: allowed=%v, got %v", user, command, allowed, err)
+		}
+	}
+
+	check("", protocol.ScmdLogin, true)
+	check("", protocol.ScmdMessageTo, false)
+	check("", protocol.ScmdClear, false)
+	check("u", protocol.ScmdMessageTo, true)
+	check("u", protocol.ScmdClear, false)
+	check("u", protocol.ScmdSetRole, false)
+	check("u", "Unknown", false)
+	check("a", protocol.ScmdClear, true)
+	check("a", protocol.ScmdSetRole, true)
+
+	// demoted admin loses permissions at once
+	srv.localDb.SetRole("a", protocol.RoleModerator)
+	check("a", protocol.ScmdClear, false)
+
+	// test mode
+	srv.cfg.TestMode = true
+	check("", protocol.ScmdClear, true)
+}
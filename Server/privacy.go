@@ -0,0 +1,168 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"errors"
+	"slices"
+	"strings"
+)
+
+// Privacy - contacts, block list and privacy options of a user
+type Privacy struct {
+	Contacts []string
+	Blocked  []string
+	// pending contact requests
+	RequestsIn  []string
+	RequestsOut []string
+
+	// hide from online user list of non-contacts
+	HidePresence bool
+	// accept messages from contacts only
+	ContactsOnly bool
+	// reply to blocked senders ("" - pretend the message is delivered)
+	BlockReply string
+}
+
+// isContact - name is in contacts
+func (p *Privacy) isContact(name string) bool {
+	return slices.Contains(p.Contacts, name)
+}
+
+// isBlocked - name is in block list
+func (p *Privacy) isBlocked(name string) bool {
+	return slices.Contains(p.Blocked, name)
+}
+
+// canSeePresence - viewer ("" - not logged in) can see that the user is online
+func (p *Privacy) canSeePresence(viewer string) bool {
+	if viewer != "" && p.isBlocked(viewer) {
+		return false
+	}
+	return !p.HidePresence || (viewer != "" && p.isContact(viewer))
+}
+
+// visibleOnlineUsers - online users the viewer can see
+func (srv *Server) visibleOnlineUsers(viewer string) []string {
+
+	list := []string{}
+	for _, name := range srv.localDb.GetOnlineUserList() {
+		p, ok := srv.localDb.GetPrivacy(name)
+		if ok && (name == viewer || p.canSeePresence(viewer)) {
+			list = append(list, name)
+		}
+	}
+
+	return list
+}
+
+// checkMessagePrivacy - check that sender can message recipient.
+// 'deliver' is false if the message is dropped silently.
+func (srv *Server) checkMessagePrivacy(sender, recipient string) (deliver bool, err error) {
+
+	p, ok := srv.localDb.GetPrivacy(recipient)
+	if !ok {
+		return false, errors.New("User '" + recipient + "' does not exist")
+	}
+
+	if p.isBlocked(sender) {
+		if p.BlockReply == "" {
+			return false, nil
+		}
+		return false, errors.New(p.BlockReply)
+	}
+
+	if p.ContactsOnly && !p.isContact(sender) {
+		return false, errors.New("User '" + recipient + "' accepts messages from contacts only")
+	}
+
+	return true, nil
+}
+
+// handleBlock - Block
+func (srv *Server) handleBlock(s *session, rqst protocol.Request) (string, error) {
+
+	if rqst.Data1 == s.userName {
+		return "", errors.New("You can't block yourself")
+	}
+	if err := srv.localDb.SetBlocked(s.userName, rqst.Data1, true); err != nil {
+		return "", err
+	}
+
+	return "ok", nil
+}
+
+// handleUnblock - Unblock
+func (srv *Server) handleUnblock(s *session, rqst protocol.Request) (string, error) {
+	if err := srv.localDb.SetBlocked(s.userName, rqst.Data1, false); err != nil {
+		return "", err
+	}
+	return "ok", nil
+}
+
+// handleGetPrivacy - GetPrivacy
+func (srv *Server) handleGetPrivacy(s *session, rqst protocol.Request) (string, error) {
+
+	p, ok := srv.localDb.GetPrivacy(s.userName)
+	if !ok {
+		return "", errors.New("User '" + s.userName + "' does not exist")
+	}
+
+	lines := []string{
+		"contacts: " + strings.Join(p.Contacts, ","),
+		"blocked: " + strings.Join(p.Blocked, ","),
+		protocol.PrivacyHidePresence + ": " + onOff(p.HidePresence),
+		protocol.PrivacyContactsOnly + ": " + onOff(p.ContactsOnly),
+		protocol.PrivacyBlockReply + ": " + p.BlockReply,
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// handleSetPrivacy - SetPrivacy
+func (srv *Server) handleSetPrivacy(s *session, rqst protocol.Request) (string, error) {
+
+	p, ok := srv.localDb.GetPrivacy(s.userName)
+	if !ok {
+		return "", errors.New("User '" + s.userName + "' does not exist")
+	}
+
+	var err error
+	switch rqst.Data1 {
+	case protocol.PrivacyHidePresence:
+		p.HidePresence, err = parseOnOff(rqst.Data2)
+	case protocol.PrivacyContactsOnly:
+		p.ContactsOnly, err = parseOnOff(rqst.Data2)
+	case protocol.PrivacyBlockReply:
+		p.BlockReply = strings.TrimSpace(rqst.Data2)
+	default:
+		err = errors.New("Unknown privacy option '" + rqst.Data1 + "'")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := srv.localDb.SetPrivacy(s.userName, p); err != nil {
+		return "", err
+	}
+
+	return "ok", nil
+}
+
+// onOff - "on"/"off"
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// parseOnOff - parse "on"/"off"
+func parseOnOff(s string) (bool, error) {
+	switch s {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, errors.New("Invalid value '" + s + "' (use on or off)")
+}
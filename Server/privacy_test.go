@@ -0,0 +1,66 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"strings"
+	"testing"
+)
+
+func TestPrivacy(t *testing.T) {
+
+	srv := newTestServer(t, "a", "b", "c")
+	a, c := newTestClient(t, srv, "a"), newTestClient(t, srv, "c")
+
+	// 'a' blocks 'b' silently, then with reply
+	if reply := a.request(protocol.ScmdBlock, "b", ""); reply != "ok" {
+		t.Fatal(reply)
+	}
+	if reply := a.request(protocol.ScmdBlock, "a", ""); reply != "You can't block yourself" {
+		t.Error("Expected error blocking yourself: ", reply)
+	}
+	if deliver, err := srv.checkMessagePrivacy("b", "a"); deliver || err != nil {
+		t.Error("Expected silent drop: ", deliver, err)
+	}
+	a.request(protocol.ScmdSetPrivacy, protocol.PrivacyBlockReply, "Go away")
+	if _, err := srv.checkMessagePrivacy("b", "a"); err == nil || err.Error() != "Go away" {
+		t.Error("Expected block reply: ", err)
+	}
+
+	// contacts only
+	a.request(protocol.ScmdAddContact, "c", "")
+	c.request(protocol.ScmdAcceptContact, "a", "")
+	if reply := a.request(protocol.ScmdUnblock, "b", ""); reply != "ok" {
+		t.Error("Unblock: ", reply)
+	}
+	if reply := a.request(protocol.ScmdSetPrivacy, protocol.PrivacyContactsOnly, "yes"); reply == "ok" {
+		t.Error("Expected invalid value error")
+	}
+	a.request(protocol.ScmdSetPrivacy, protocol.PrivacyContactsOnly, "on")
+	if _, err := srv.checkMessagePrivacy("b", "a"); err == nil || !strings.Contains(err.Error(), "contacts only") {
+		t.Error("Expected contacts only error: ", err)
+	}
+	if deliver, err := srv.checkMessagePrivacy("c", "a"); !deliver || err != nil {
+		t.Error("Contact can't send: ", err)
+	}
+
+	// hidden presence
+	p, _ := srv.localDb.GetPrivacy("a")
+	p.HidePresence = true
+	srv.localDb.SetPrivacy("a", p)
+	for viewer, visible := range map[string]bool{"": false, "b": false, "c": true, "a": true} {
+		if p, _ := srv.localDb.GetPrivacy("a"); (viewer == "a" || p.canSeePresence(viewer)) != visible {
+			t.Errorf("Presence of 'a' for %q: expected %v", viewer, visible)
+		}
+	}
+
+	reply := a.request(protocol.ScmdGetPrivacy, "", "")
+	if !strings.Contains(reply, "contacts: c\n") || !strings.Contains(reply, "hide_presence: on") {
+		t.Error("GetPrivacy: ", reply)
+	}
+
+	// deleted user disappears from lists
+	srv.localDb.DeleteUser("c")
+	if p, _ := srv.localDb.GetPrivacy("a"); len(p.Contacts) != 0 {
+		t.Error("Deleted user is still in contacts: ", p.Contacts)
+	}
+}
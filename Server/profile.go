@@ -0,0 +1,198 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // timezones on systems without tz database
+	"unicode"
+	"unicode/utf8"
+)
+
+// Profile field limits (characters; avatar - bytes)
+const (
+	constMaxDisplayName = 64
+	constMaxStatus      = 140
+	constMaxBio         = 1000
+	constMaxAvatar      = 64 * 1024
+)
+
+// Profile - user profile (nickname stays user identifier)
+type Profile struct {
+	DisplayName string `json:",omitempty"`
+	Status      string `json:",omitempty"`
+	Bio         string `json:",omitempty"`
+	// IANA time zone (i.e. "Europe/Berlin")
+	Timezone string `json:",omitempty"`
+	// image bytes (base64 in JSON)
+	Avatar []byte `json:",omitempty"`
+}
+
+// avatarHash - "sha256:<hex>" of avatar ("" - no avatar)
+func (p *Profile) avatarHash() string {
+	if len(p.Avatar) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(p.Avatar))
+}
+
+// checkText - validate profile text field
+func checkText(field, value string, maxLen int, multiline bool) error {
+
+	if !utf8.ValidString(value) {
+		return errors.New("Invalid " + field + " (not UTF-8)")
+	}
+	if n := utf8.RuneCountInString(value); n > maxLen {
+		return errors.New("Too long " + field + " (" + strconv.Itoa(n) + " > " + strconv.Itoa(maxLen) + " characters)")
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) && !(multiline && r == '\n') {
+			return errors.New("Invalid character in " + field)
+		}
+	}
+
+	return nil
+}
+
+// setField - validate and set profile field
+func (p *Profile) setField(field, value string) error {
+
+	if field != protocol.ProfileBio && field != protocol.ProfileAvatar {
+		value = strings.TrimSpace(value)
+	}
+
+	switch field {
+	case protocol.ProfileDisplayName:
+		if err := checkText(field, value, constMaxDisplayName, false); err != nil {
+			return err
+		}
+		p.DisplayName = value
+
+	case protocol.ProfileStatus:
+		if err := checkText(field, value, constMaxStatus, false); err != nil {
+			return err
+		}
+		p.Status = value
+
+	case protocol.ProfileBio:
+		if err := checkText(field, value, constMaxBio, true); err != nil {
+			return err
+		}
+		p.Bio = value
+
+	case protocol.ProfileTimezone:
+		if value != "" {
+			if _, err := time.LoadLocation(value); err != nil || value == "Local" {
+				return errors.New("Unknown timezone '" + value + "'")
+			}
+		}
+		p.Timezone = value
+
+	case protocol.ProfileAvatar:
+		avatar, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return errors.New("Invalid avatar (base64 expected)")
+		}
+		if len(avatar) > constMaxAvatar {
+			return errors.New("Too big avatar (" + strconv.Itoa(len(avatar)) + " > " + strconv.Itoa(constMaxAvatar) + " bytes)")
+		}
+		p.Avatar = avatar
+
+	default:
+		return errors.New("Unknown profile field '" + field + "'")
+	}
+
+	return nil
+}
+
+// profileOf - profile of the user visible to viewer
+func (srv *Server) profileOf(viewer, name string) (Profile, error) {
+
+	if name == "" {
+		name = viewer
+	}
+
+	p, ok := srv.localDb.GetProfile(name)
+	if !ok {
+		return Profile{}, errors.New("User '" + name + "' does not exist")
+	}
+
+	// blocked users don't see the profile
+	if privacy, _ := srv.localDb.GetPrivacy(name); privacy.isBlocked(viewer) {
+		return Profile{}, errors.New("User '" + name + "' does not exist")
+	}
+
+	return p, nil
+}
+
+// handleGetProfile - GetProfile
+func (srv *Server) handleGetProfile(s *session, rqst protocol.Request) (string, error) {
+
+	p, err := srv.profileOf(s.userName, rqst.Data1)
+	if err != nil {
+		return "", err
+	}
+
+	name := rqst.Data1
+	if name == "" {
+		name = s.userName
+	}
+
+	timezone := p.Timezone
+	if loc, err := time.LoadLocation(p.Timezone); err == nil && p.Timezone != "" {
+		timezone += " (local time " + time.Now().In(loc).Format("15:04") + ")"
+	}
+	avatar := "none"
+	if hash := p.avatarHash(); hash != "" {
+		avatar = hash + " (" + strconv.Itoa(len(p.Avatar)) + " bytes)"
+	}
+
+	lines := []string{
+		"nickname: " + name,
+		protocol.ProfileDisplayName + ": " + p.DisplayName,
+		protocol.ProfileStatus + ": " + p.Status,
+		protocol.ProfileBio + ": " + p.Bio,
+		protocol.ProfileTimezone + ": " + timezone,
+		protocol.ProfileAvatar + ": " + avatar,
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// handleSetProfile - SetProfile
+func (srv *Server) handleSetProfile(s *session, rqst protocol.Request) (string, error) {
+
+	p, ok := srv.localDb.GetProfile(s.userName)
+	if !ok {
+		return "", errors.New("User '" + s.userName + "' does not exist")
+	}
+
+	if err := p.setField(rqst.Data1, rqst.Data2); err != nil {
+		return "", err
+	}
+
+	if err := srv.localDb.SetProfile(s.userName, p); err != nil {
+		return "", err
+	}
+
+	return "ok", nil
+}
+
+// handleGetAvatar - GetAvatar
+func (srv *Server) handleGetAvatar(s *session, rqst protocol.Request) (string, error) {
+
+	p, err := srv.profileOf(s.userName, rqst.Data1)
+	if err != nil {
+		return "", err
+	}
+	if len(p.Avatar) == 0 {
+		return "", errors.New("No avatar")
+	}
+
+	return base64.StdEncoding.EncodeToString(p.Avatar), nil
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestProfile(t *testing.T) {
+
+	srv := newTestServer(t, "a", "b")
+	a, b := newTestClient(t, srv, "a"), newTestClient(t, srv, "b")
+
+	valid := [][2]string{
+		{protocol.ProfileDisplayName, "  Alice A.  "},
+		{protocol.ProfileStatus, "busy"},
+		{protocol.ProfileBio, "line 1\nline 2"},
+		{protocol.ProfileTimezone, "Europe/Berlin"},
+		{protocol.ProfileAvatar, base64.StdEncoding.EncodeToString([]byte("png"))},
+	}
+	for _, v := range valid {
+		if reply := a.request(protocol.ScmdSetProfile, v[0], v[1]); reply != "ok" {
+			t.Error(v[0], ": ", reply)
+		}
+	}
+
+	invalid := [][2]string{
+		{protocol.ProfileDisplayName, strings.Repeat("x", constMaxDisplayName+1)},
+		{protocol.ProfileStatus, "two\nlines"},
+		{protocol.ProfileTimezone, "Mars/Olympus"},
+		{protocol.ProfileAvatar, "not base64!"},
+		{protocol.ProfileAvatar, base64.StdEncoding.EncodeToString(make([]byte, constMaxAvatar+1))},
+		{"age", "42"},
+	}
+	for _, v := range invalid {
+		if reply := a.request(protocol.ScmdSetProfile, v[0], v[1]); reply == "ok" {
+			t.Error("Expected error for ", v[0])
+		}
+	}
+
+	reply := b.request(protocol.ScmdGetProfile, "a", "")
+	if !strings.Contains(reply, "display_name: Alice A.\n") || !strings.Contains(reply, "avatar: sha256:") {
+		t.Error("GetProfile: ", reply)
+	}
+	if reply := b.request(protocol.ScmdGetAvatar, "a", ""); reply != base64.StdEncoding.EncodeToString([]byte("png")) {
+		t.Error("GetAvatar: ", reply)
+	}
+
+	// blocked user can't see profile
+	a.request(protocol.ScmdBlock, "b", "")
+	if reply := b.request(protocol.ScmdGetProfile, "a", ""); strings.Contains(reply, "display_name") {
+		t.Error("Expected error for blocked user")
+	}
+}
@@ -0,0 +1,288 @@
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit - token bucket parameters (Rate==0 means unlimited)
+type RateLimit struct {
+	// Tokens added per second
+	Rate float64
+	// Bucket capacity
+	Burst int
+}
+
+// RateLimitScopes - limits applied per session, per user and per source IP
+type RateLimitScopes struct {
+	PerSession RateLimit
+	PerUser    RateLimit
+	PerIP      RateLimit
+}
+
+// RateLimits - rate limits for the requests a client could flood the server with
+type RateLimits struct {
+	// MessageTo requests
+	Message RateLimitScopes
+	// Login requests
+	Login RateLimitScopes
+	// RegisterUser requests
+	Register RateLimitScopes
+
+	// Failed logins (per user or per IP) before temporary lockout (0 - no lockout)
+	MaxFailedLogins int
+	// Lockout duration
+	LockoutDuration Duration
+}
+
+// DefaultRateLimits - default rate limits
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		Message: RateLimitScopes{
+			PerSession: RateLimit{Rate: 5, Burst: 10},
+			PerUser:    RateLimit{Rate: 5, Burst: 10},
+			PerIP:      RateLimit{Rate: 20, Burst: 40},
+		},
+		Login: RateLimitScopes{
+			PerSession: RateLimit{Rate: 1, Burst: 5},
+			PerUser:    RateLimit{Rate: 0.2, Burst: 5},
+			PerIP:      RateLimit{Rate: 1, Burst: 10},
+		},
+		Register: RateLimitScopes{
+			PerSession: RateLimit{Rate: 0.1, Burst: 3},
+			PerIP:      RateLimit{Rate: 0.05, Burst: 5},
+		},
+		MaxFailedLogins: 5,
+		LockoutDuration: Duration(5 * time.Minute),
+	}
+}
+
+// rateAction - kind of rate limited request
+type rateAction string
+
+const (
+	actionMessage  rateAction = "message"
+	actionLogin    rateAction = "login"
+	actionRegister rateAction = "register"
+)
+
+// how often idle buckets are removed
+const constRateLimiterSweepPeriod = time.Minute
+
+// tokenBucket - token bucket state
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// refill - add tokens for the time passed since the last refill
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.Rate)
+		b.last = now
+	}
+}
+
+// wait - time until one token is available
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// loginFailures - failed logins in a row for a user or IP
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// rateLimiter - token bucket rate limiter with failed login lockout
+type rateLimiter struct {
+	limits RateLimits
+
+	// buckets by "action/scope/key"
+	buckets map[string]*tokenBucket
+
+	// failed logins by "user/name" or "ip/address"
+	failures map[string]*loginFailures
+
+	mutex     sync.Mutex
+	lastSweep time.Time
+
+	// clock (replaced in tests)
+	now func() time.Time
+}
+
+// newRateLimiter - rateLimiter constructor
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	rl := new(rateLimiter)
+	rl.limits = limits
+	rl.buckets = make(map[string]*tokenBucket)
+	rl.failures = make(map[string]*loginFailures)
+	rl.now = time.Now
+	return rl
+}
+
+// setLimits - change limits (buckets with other limits are refilled)
+func (rl *rateLimiter) setLimits(limits RateLimits) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.limits = limits
+}
+
+// scopes - limits for the action
+func (rl *rateLimiter) scopes(action rateAction) RateLimitScopes {
+	switch action {
+	case actionMessage:
+		return rl.limits.Message
+	case actionLogin:
+		return rl.limits.Login
+	case actionRegister:
+		return rl.limits.Register
+	}
+	return RateLimitScopes{}
+}
+
+// allow - take a token from session, user and IP buckets of the action.
+// If any bucket is empty no token is taken and the time to wait is returned.
+// Empty keys are not checked.
+func (rl *rateLimiter) allow(action rateAction, session, user, ip string) (bool, time.Duration) {
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := rl.now()
+	rl.sweep(now)
+
+	scopes := rl.scopes(action)
+
+	// collect buckets
+	buckets := []*tokenBucket{}
+	for _, s := range []struct {
+		scope string
+		key   string
+		limit RateLimit
+	}{
+		{"session", session, scopes.PerSession},
+		{"user", user, scopes.PerUser},
+		{"ip", ip, scopes.PerIP},
+	} {
+		if s.key == "" || s.limit.Rate <= 0 {
+			continue
+		}
+		buckets = append(buckets, rl.bucket(string(action)+"/"+s.scope+"/"+s.key, s.limit, now))
+	}
+
+	// check all buckets
+	var retryAfter time.Duration
+	for _, b := range buckets {
+		if wait := b.wait(); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		return false, retryAfter
+	}
+
+	// take tokens
+	for _, b := range buckets {
+		b.tokens--
+	}
+
+	return true, 0
+}
+
+// bucket - find or create bucket
+func (rl *rateLimiter) bucket(key string, limit RateLimit, now time.Time) *tokenBucket {
+	b, ok := rl.buckets[key]
+	if !ok || b.limit != limit {
+		b = &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: now}
+		rl.buckets[key] = b
+	}
+	b.refill(now)
+	return b
+}
+
+// lockedOut - check login lockout for user and IP
+func (rl *rateLimiter) lockedOut(user, ip string) (bool, time.Duration) {
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := rl.now()
+
+	var retryAfter time.Duration
+	for _, key := range []string{"user/" + user, "ip/" + ip} {
+		if f, ok := rl.failures[key]; ok && f.lockedUntil.After(now) {
+			if wait := f.lockedUntil.Sub(now); wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+	}
+
+	return retryAfter > 0, retryAfter
+}
+
+// loginFailed - count failed login; lock user and IP out after MaxFailedLogins
+func (rl *rateLimiter) loginFailed(user, ip string) {
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if rl.limits.MaxFailedLogins <= 0 {
+		return
+	}
+
+	now := rl.now()
+
+	for _, key := range []string{"user/" + user, "ip/" + ip} {
+		f, ok := rl.failures[key]
+		if !ok {
+			f = new(loginFailures)
+			rl.failures[key] = f
+		}
+		f.count++
+		f.last = now
+		if f.count >= rl.limits.MaxFailedLogins {
+			f.count = 0
+			f.lockedUntil = now.Add(time.Duration(rl.limits.LockoutDuration))
+		}
+	}
+}
+
+// loginSucceeded - reset failed logins counter
+func (rl *rateLimiter) loginSucceeded(user, ip string) {
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	delete(rl.failures, "user/"+user)
+	delete(rl.failures, "ip/"+ip)
+}
+
+// sweep - remove full buckets and expired lockouts (so closed sessions don't leak)
+func (rl *rateLimiter) sweep(now time.Time) {
+
+	if now.Sub(rl.lastSweep) < constRateLimiterSweepPeriod {
+		return
+	}
+	rl.lastSweep = now
+
+	for key, b := range rl.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(rl.buckets, key)
+		}
+	}
+
+	for key, f := range rl.failures {
+		if f.lockedUntil.Before(now) && now.Sub(f.last) > time.Duration(rl.limits.LockoutDuration) {
+			delete(rl.failures, key)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	limits := RateLimits{
+		Message: RateLimitScopes{
+			PerSession: RateLimit{Rate: 1, Burst: 2},
+			PerIP:      RateLimit{Rate: 10, Burst: 3},
+		},
+	}
+	rl := newRateLimiter(limits)
+	rl.now = func() time.Time { return now }
+
+	// burst
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.allow(actionMessage, "s1", "a", "ip"); !ok {
+			t.Error("Message rejected: ", i)
+			return
+		}
+	}
+
+	// session bucket is empty
+	ok, retryAfter := rl.allow(actionMessage, "s1", "a", "ip")
+	if ok || retryAfter != time.Second {
+		t.Error("Expected rate limit: ", ok, retryAfter)
+		return
+	}
+
+	// another session from the same IP (IP bucket has 1 token left)
+	if ok, _ := rl.allow(actionMessage, "s2", "b", "ip"); !ok {
+		t.Error("Message rejected")
+		return
+	}
+	if ok, _ := rl.allow(actionMessage, "s2", "b", "ip"); ok {
+		t.Error("Expected IP rate limit")
+		return
+	}
+
+	// refill
+	now = now.Add(time.Second)
+	if ok, _ := rl.allow(actionMessage, "s1", "a", "ip"); !ok {
+		t.Error("Message rejected after refill")
+		return
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	rl := newRateLimiter(RateLimits{MaxFailedLogins: 3, LockoutDuration: Duration(time.Minute)})
+	rl.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if locked, _ := rl.lockedOut("a", "ip"); locked {
+			t.Error("Locked out too early: ", i)
+			return
+		}
+		rl.loginFailed("a", "ip")
+	}
+
+	// locked out
+	locked, retryAfter := rl.lockedOut("a", "ip2")
+	if !locked || retryAfter != time.Minute {
+		t.Error("Expected lockout: ", locked, retryAfter)
+		return
+	}
+
+	// lockout expired
+	now = now.Add(time.Minute)
+	if locked, _ := rl.lockedOut("a", "ip"); locked {
+		t.Error("Lockout not expired")
+		return
+	}
+
+	// successful login resets counter
+	rl.loginFailed("b", "ip3")
+	rl.loginFailed("b", "ip3")
+	rl.loginSucceeded("b", "ip3")
+	rl.loginFailed("b", "ip3")
+	if locked, _ := rl.lockedOut("b", "ip3"); locked {
+		t.Error("Counter not reset")
+		return
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"errors"
+	"slices"
+	"strings"
+)
+
+// Roster actions (LocalDbInterface.UpdateRoster)
+const (
+	RosterRequest = "request"
+	RosterAccept  = "accept"
+	RosterDecline = "decline"
+	RosterRemove  = "remove"
+)
+
+// handleAddContact - AddContact (send contact request)
+func (srv *Server) handleAddContact(s *session, rqst protocol.Request) (string, error) {
+
+	linked, err := srv.localDb.UpdateRoster(s.userName, rqst.Data1, RosterRequest)
+	if err != nil {
+		return "", err
+	}
+
+	// both users have sent requests
+	if linked {
+		srv.notifyUser(rqst.Data1, protocol.NoticeContactAccepted, "User '"+s.userName+"' is your contact now")
+		return "User '" + rqst.Data1 + "' is your contact now", nil
+	}
+
+	// request from blocked user is not shown
+	if p, ok := srv.localDb.GetPrivacy(rqst.Data1); ok && slices.Contains(p.RequestsIn, s.userName) {
+		srv.notifyUser(rqst.Data1, protocol.NoticeContactRequest,
+			"User '"+s.userName+"' wants to add you to contacts (use 'contact' command to accept or decline)")
+	}
+
+	return "ok", nil
+}
+
+// handleAcceptContact - AcceptContact
+func (srv *Server) handleAcceptContact(s *session, rqst protocol.Request) (string, error) {
+
+	if _, err := srv.localDb.UpdateRoster(s.userName, rqst.Data1, RosterAccept); err != nil {
+		return "", err
+	}
+	srv.notifyUser(rqst.Data1, protocol.NoticeContactAccepted, "User '"+s.userName+"' accepted your contact request")
+
+	return "ok", nil
+}
+
+// handleDeclineContact - DeclineContact
+func (srv *Server) handleDeclineContact(s *session, rqst protocol.Request) (string, error) {
+	if _, err := srv.localDb.UpdateRoster(s.userName, rqst.Data1, RosterDecline); err != nil {
+		return "", err
+	}
+	return "ok", nil
+}
+
+// handleRemoveContact - RemoveContact
+func (srv *Server) handleRemoveContact(s *session, rqst protocol.Request) (string, error) {
+	if _, err := srv.localDb.UpdateRoster(s.userName, rqst.Data1, RosterRemove); err != nil {
+		return "", err
+	}
+	return "ok", nil
+}
+
+// handleGetRoster - GetRoster
+func (srv *Server) handleGetRoster(s *session, rqst protocol.Request) (string, error) {
+
+	p, ok := srv.localDb.GetPrivacy(s.userName)
+	if !ok {
+		return "", errors.New("User '" + s.userName + "' does not exist")
+	}
+
+	online := srv.visibleOnlineUsers(s.userName)
+
+	lines := []string{"contacts:"}
+	for _, name := range p.Contacts {
+		presence := "offline"
+		if slices.Contains(online, name) {
+			presence = "online"
+		}
+		lines = append(lines, "  "+name+" ("+presence+")")
+	}
+	lines = append(lines,
+		"incoming requests: "+strings.Join(p.RequestsIn, ","),
+		"outgoing requests: "+strings.Join(p.RequestsOut, ","))
+
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"testing"
+)
+
+func TestRoster(t *testing.T) {
+
+	srv := newTestServer(t, "a", "b", "c")
+	clients := map[string]*testClient{}
+	for _, name := range []string{"a", "b", "c"} {
+		clients[name] = newTestClient(t, srv, name)
+	}
+	request := func(user string, command protocol.CommandToServer, data1 string) string {
+		return clients[user].request(command, data1, "")
+	}
+	roster := func(user string) string {
+		return request(user, protocol.ScmdGetRoster, "")
+	}
+
+	// request and accept
+	if reply := request("a", protocol.ScmdAddContact, "b"); reply != "ok" {
+		t.Fatal(reply)
+	}
+	if reply := request("a", protocol.ScmdAddContact, "b"); reply == "ok" {
+		t.Error("Expected duplicate request error")
+	}
+	if r := roster("b"); r != "contacts:\nincoming requests: a\noutgoing requests: " {
+		t.Error("Roster of 'b': ", r)
+	}
+	if reply := request("b", protocol.ScmdAcceptContact, "a"); reply != "ok" {
+		t.Fatal(reply)
+	}
+	if r := roster("a"); r != "contacts:\n  b (offline)\nincoming requests: \noutgoing requests: " {
+		t.Error("Roster of 'a': ", r)
+	}
+
+	// mutual requests link at once
+	request("a", protocol.ScmdAddContact, "c")
+	if reply := request("c", protocol.ScmdAddContact, "a"); reply != "User 'a' is your contact now" {
+		t.Error("Mutual request: ", reply)
+	}
+
+	// decline
+	request("b", protocol.ScmdAddContact, "c")
+	if reply := request("c", protocol.ScmdDeclineContact, "b"); reply != "ok" {
+		t.Error("Decline: ", reply)
+	}
+	if r := roster("b"); r != "contacts:\n  a (offline)\nincoming requests: \noutgoing requests: " {
+		t.Error("Roster after decline: ", r)
+	}
+
+	// request from blocked user is not shown
+	request("c", protocol.ScmdBlock, "b")
+	request("b", protocol.ScmdAddContact, "c")
+	if r := roster("c"); r != "contacts:\n  a (offline)\nincoming requests: \noutgoing requests: " {
+		t.Error("Roster with blocked user: ", r)
+	}
+
+	// remove is mutual; blocking removes contact
+	if reply := request("b", protocol.ScmdRemoveContact, "a"); reply != "ok" {
+		t.Error("Remove: ", reply)
+	}
+	request("a", protocol.ScmdBlock, "c")
+	if r := roster("a"); r != "contacts:\nincoming requests: \noutgoing requests: " {
+		t.Error("Roster after remove and block: ", r)
+	}
+}
@@ -3,182 +3,399 @@ package server
 import (
 	"GitHub/Messenger-to-learn-golang/protocol"
 	"bufio"
-	"log"
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"math"
 	"net"
-	"strings"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Debug - for Debugging
-var Debug = false //true
-
 // Server - TCP message server
 type Server struct {
-	port    string
+	cfg     Config
 	localDb LocalDbInterface
+	limiter *rateLimiter
+	conns   *connLimiter
+
+	// password policy and authentication backends
+	passwords      *passwordChecker
+	authenticators []Authenticator
+
+	// clock (fixed in tests)
+	now func() time.Time
+
+	logger   *slog.Logger
+	logLevel *slog.LevelVar
+	metrics  *metrics
+	auditLog *auditLog
+
+	// last request id
+	requestID uint64
+
+	// number of running accept loops
+	accepting int32
+
+	// lifecycle (protected by mutex)
+	mutex         sync.Mutex
+	listeners     []net.Listener
+	adminListener net.Listener
+	httpServers   []*http.Server
+	stopping      bool
+
+	// connected clients
+	sessions      map[*session]bool
+	sessionsMutex sync.Mutex
+
+	// loads config for 'reload' admin command (nil - reload is not supported)
+	reloadConfig func() (Config, error)
 }
 
-// NewServer - Server constructor
+// NewServer - Server constructor (default config listening on portNumber)
 func NewServer(portNumber string) *Server {
+	cfg := DefaultConfig()
+	cfg.Listen = []string{portNumber}
+	return NewServerWithConfig(cfg)
+}
+
+// NewServerWithConfig - Server constructor
+func NewServerWithConfig(cfg Config) *Server {
 	server := new(Server)
-	server.port = portNumber
-	server.localDb = new(LocalDb)
+	server.cfg = cfg
+	server.logLevel = new(slog.LevelVar)
+	server.logger = newLogger(cfg.Log, server.logLevel, os.Stderr)
+	server.metrics = newMetrics()
+	server.auditLog = newAuditLog(cfg.Audit)
+
+	fileName := ""
+	if cfg.Storage.Backend == StorageFile {
+		fileName = cfg.Storage.File
+	}
+	localDb := NewLocalDb(fileName, server.logger)
+	localDb.OnSave(server.metrics.observeSave)
+	server.localDb = localDb
+
+	server.limiter = newRateLimiter(cfg.RateLimits)
+	server.conns = newConnLimiter(cfg.ConnectionLimits)
+	server.passwords = newPasswordChecker(cfg.Password)
+	server.authenticators = newAuthenticators(cfg.Auth, localDb)
+	server.now = time.Now
+	server.sessions = make(map[*session]bool)
 	return server
 }
 
+// OnReload - set function loading config for 'reload' admin command
+func (srv *Server) OnReload(fn func() (Config, error)) {
+	srv.reloadConfig = fn
+}
+
 // Run - Server run loop
 func (srv *Server) Run() {
 
-	log.SetFlags( /*log.LstdFlags |*/ log.Lshortfile)
+	key, err := readStorageKey(srv.cfg.Storage)
+	if err != nil {
+		srv.logger.Error("storage key read failed", "err", err)
+		os.Exit(1)
+	}
+	srv.localDb.SetKey(key)
+
+	if err := srv.localDb.Init(); err != nil {
+		srv.logger.Error("storage init failed", "err", err)
+		os.Exit(1)
+	}
+	defer srv.localDb.Close()
+	defer srv.auditLog.close()
+
+	if err := srv.passwords.load(); err != nil {
+		srv.logger.Error("breached passwords file read failed", "err", err)
+		os.Exit(1)
+	}
+
+	// open all listeners before serving any
+	listeners := []net.Listener{}
+	for _, addr := range srv.cfg.Listen {
+		listener, err := srv.listen(addr)
+		if err != nil {
+			srv.logger.Error("listen failed", "addr", addr, "err", err)
+			os.Exit(1)
+		}
+		defer listener.Close()
+		srv.logger.Info("listening", "addr", listener.Addr().String(), "tls", srv.cfg.TLS.CertFile != "")
+		listeners = append(listeners, listener)
+	}
+
+	srv.mutex.Lock()
+	srv.listeners = listeners
+	srv.mutex.Unlock()
+
+	// metrics and health
+	if srv.cfg.HTTP.Listen != "" {
+		if err := srv.startHTTP(srv.cfg.HTTP.Listen, srv.httpMux()); err != nil {
+			srv.logger.Error("HTTP listen failed", "addr", srv.cfg.HTTP.Listen, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	// admin socket
+	if srv.cfg.Admin.Socket != "" {
+		if err := srv.startAdminSocket(srv.cfg.Admin.Socket); err != nil {
+			srv.logger.Error("admin socket failed", "path", srv.cfg.Admin.Socket, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	// profiling
+	if srv.cfg.HTTP.PprofListen != "" {
+		if err := srv.startHTTP(srv.cfg.HTTP.PprofListen, pprofMux()); err != nil {
+			srv.logger.Error("pprof listen failed", "addr", srv.cfg.HTTP.PprofListen, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, listener := range listeners {
+		wg.Add(1)
+		atomic.AddInt32(&srv.accepting, 1)
+		go func(listener net.Listener) {
+			defer wg.Done()
+			defer atomic.AddInt32(&srv.accepting, -1)
+			srv.serve(listener)
+		}(listener)
+	}
+	wg.Wait()
+
+	// stop HTTP endpoints
+	srv.mutex.Lock()
+	httpServers := srv.httpServers
+	srv.mutex.Unlock()
+	for _, httpServer := range httpServers {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		httpServer.Shutdown(ctx)
+		cancel()
+	}
+
+	srv.logger.Info("server stopped")
+}
+
+// Stop - stop accepting connections; Run returns after HTTP endpoints are shut down
+func (srv *Server) Stop() {
+
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+
+	srv.stopping = true
+	for _, listener := range srv.listeners {
+		listener.Close()
+	}
+	if srv.adminListener != nil {
+		srv.adminListener.Close()
+	}
+}
+
+// addSession - register connected client
+func (srv *Server) addSession(s *session) {
+	srv.sessionsMutex.Lock()
+	defer srv.sessionsMutex.Unlock()
+	srv.sessions[s] = true
+}
+
+// removeSession - unregister disconnected client
+func (srv *Server) removeSession(s *session) {
+	srv.sessionsMutex.Lock()
+	defer srv.sessionsMutex.Unlock()
+	delete(srv.sessions, s)
+}
+
+// sessionList - connected clients
+func (srv *Server) sessionList() []*session {
+	srv.sessionsMutex.Lock()
+	defer srv.sessionsMutex.Unlock()
+
+	list := []*session{}
+	for s := range srv.sessions {
+		list = append(list, s)
+	}
+	return list
+}
+
+// isStopping - Stop was called
+func (srv *Server) isStopping() bool {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.stopping
+}
 
-	srv.localDb.Init()
+// listen - open listener (with TLS if configured)
+func (srv *Server) listen(addr string) (net.Listener, error) {
 
-	listener, err := net.Listen("tcp4", srv.port)
+	listener, err := net.Listen(srv.cfg.Network, addr)
 	if err != nil {
-		log.Println("Listen failed!")
-		log.Fatal(err)
-		return
+		return nil, err
 	}
-	defer listener.Close()
+
+	if srv.cfg.TLS.CertFile != "" {
+		tlsConfig, err := srv.tlsConfig()
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	return listener, nil
+}
+
+// serve - accept loop
+func (srv *Server) serve(listener net.Listener) {
+
+	// how long to sleep on temporary accept failure
+	var acceptDelay time.Duration
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Println("Accept failed!")
-			log.Println(err)
+			// retry temporary errors (i.e. too many open files) with backoff
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				acceptDelay = acceptBackoff(acceptDelay)
+				srv.logger.Warn("accept failed", "err", err, "retry_in", acceptDelay)
+				time.Sleep(acceptDelay)
+				continue
+			}
+			if !srv.isStopping() {
+				srv.logger.Error("accept failed", "err", err)
+			}
 			return
 		}
-		go handleConnection(conn, srv.localDb)
+		acceptDelay = 0
+
+		// admission control
+		ip := remoteIP(conn)
+		if r := srv.localDb.GetRestriction(RestrictionIPBan, ip); r != nil {
+			srv.logger.Info("connection rejected", "remote", conn.RemoteAddr().String(), "reason", "banned")
+			go rejectConnection(conn, protocol.NoticeBanned, "Your address is banned "+r.describe())
+			continue
+		}
+		if reason := srv.conns.acquire(ip); reason != "" {
+			srv.logger.Warn("connection rejected", "remote", conn.RemoteAddr().String(), "reason", reason)
+			go rejectConnection(conn, protocol.NoticeServerFull, reason)
+			continue
+		}
+
+		go func() {
+			defer srv.conns.release(ip)
+			srv.handleConnection(conn)
+		}()
 	}
 }
 
+// rejectConnection - tell client why it can't connect and close connection
+func rejectConnection(conn net.Conn, code, reason string) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	sendNotice(conn, code, reason)
+}
+
 // handleConnection
-func handleConnection(conn net.Conn, localDb LocalDbInterface) {
+func (srv *Server) handleConnection(conn net.Conn) {
 
+	tlsConn, _ := conn.(*tls.Conn)
+	conn = &lockedConn{Conn: &countingConn{Conn: conn, metrics: srv.metrics}}
 	defer conn.Close()
 
-	//log.Printf("Serving %s\n", conn.RemoteAddr().String())
+	atomic.AddInt64(&srv.metrics.activeConnections, 1)
+	defer atomic.AddInt64(&srv.metrics.activeConnections, -1)
+
+	s := newSession(conn, srv.logger)
+	s.connLogger.Debug("connected")
+
+	srv.addSession(s)
+	defer srv.removeSession(s)
+
+	// client certificate may log the session in
+	if tlsConn != nil {
+		if err := srv.certificateLogin(s, tlsConn); err != nil {
+			s.connLogger.Info("TLS connection failed", "err", err)
+			return
+		}
+	}
 
-	// user name after login
-	userName := ""
+	reader := bufio.NewReader(conn)
 
 	for {
 
 		// read client request
-		requestStr, err := bufio.NewReader(conn).ReadString('\n')
+		requestStr, err := reader.ReadString('\n')
 
 		// connection lost?
 		if err != nil {
-			if Debug {
-				log.Println("userName: '" + userName)
-				log.Println(err)
-			}
-			if userName != "" {
-				localDb.Logout(userName)
-				userName = ""
+			s.connLogger.Debug("disconnected", "user", s.userName, "err", err)
+			if s.userName != "" {
+				srv.audit(AuditEvent{Event: AuditLogout, User: s.userName, Remote: s.key, Outcome: AuditSuccess, Detail: "disconnected"})
+				srv.localDb.Logout(s.userName)
+				s.setUser("")
 			}
 			return
 		}
 
-		if Debug {
-			log.Print("requestStr: " + requestStr + "\n")
-		}
-
 		// decode to request data
 		var rqst protocol.Request
 		rqst.Decode(requestStr)
 
-		//
-		// Process client request
-		//
-		switch rqst.Command {
-
-		//  CheckUniqueNickName
-		case protocol.ScmdCheckUniqueNickName:
-			if localDb.DoesUserExist(rqst.Data1) {
-				sendReply(conn, "User '"+rqst.Data1+"' already exists")
-
-			} else {
-				sendReply(conn, "ok")
-			}
+		srv.processRequest(s, rqst)
+	}
+}
 
-		//  RegisterUser
-		case protocol.ScmdRegisterUser:
-			if err := localDb.AddUser(rqst.Data1, rqst.Data2, conn); err != nil {
-				sendReply(conn, err.Error())
-			} else {
-				sendReply(conn, "ok")
-			}
+// processRequest - run request handler and send reply
+func (srv *Server) processRequest(s *session, rqst protocol.Request) {
 
-		//  Login
-		case protocol.ScmdLogin:
-			if err := localDb.Login(rqst.Data1, rqst.Data2, conn); err != nil {
-				sendReply(conn, err.Error())
-			} else {
-				userName = rqst.Data1
-				sendReply(conn, "ok")
-			}
+	start := time.Now()
 
-		//  Logout
-		case protocol.ScmdLogout:
-			localDb.Logout(userName)
-			userName = ""
-			sendReply(conn, "ok")
-
-		//  ChangePassword
-		case protocol.ScmdChangePassword:
-			if err := localDb.ChangePassword(userName, rqst.Data1); err != nil {
-				sendReply(conn, err.Error())
-			} else {
-				sendReply(conn, "ok")
-			}
+	s.logger = s.connLogger.With("request_id", atomic.AddUint64(&srv.requestID, 1))
+	if s.userName != "" {
+		s.logger = s.logger.With("user", s.userName)
+	}
+	s.logger.Debug("request", "request", rqst)
 
-		//  GetOnlineUserList
-		case protocol.ScmdGetOnlineUserList:
-			userList := localDb.GetOnlineUserList()
-			if len(userList) > 0 {
-				sendReply(conn, "online users: "+strings.Join(userList, ","))
-			} else {
-				sendReply(conn, "no online users")
-			}
+	handler, ok := requestHandlers[rqst.Command]
+	if !ok {
+		sendReply(s.conn, "Unknown command '"+string(rqst.Command)+"'")
+		srv.metrics.observeRequest("unknown", outcomeError, time.Since(start))
+		return
+	}
 
-		//  MessageTo
-		case protocol.ScmdMessageTo:
+	if err := srv.checkPermission(s, rqst.Command); err != nil {
+		s.logger.Info("permission denied", "command", rqst.Command, "err", err)
+		srv.auditDenied(s, rqst)
+		sendReply(s.conn, err.Error())
+		srv.metrics.observeRequest(rqst.Command, outcomeError, time.Since(start))
+		return
+	}
 
-			// check login status
-			if userName == "" {
-				sendReply(conn, "You are not logged in")
-				continue
-			}
+	user := s.userName
+	reply, err := handler(srv, s, rqst)
+
+	outcome, auditOutcome := outcomeOK, AuditSuccess
+	var rateLimited *rateLimitedError
+	if err == nil {
+		sendReply(s.conn, reply)
+	} else if errors.As(err, &rateLimited) {
+		outcome, auditOutcome = outcomeRateLimited, AuditRateLimited
+		sendRateLimited(s.conn, rateLimited.retryAfter)
+		err = nil
+	} else {
+		outcome, auditOutcome = outcomeError, AuditFailure
+		sendReply(s.conn, err.Error())
+	}
 
-			localDb.RLock()
-			{
-				// get recipient user info
-				name := rqst.Data1
-				userInfo, isFound := localDb.FindUser(name)
-
-				// check recipient connection
-				if !isFound {
-					sendReply(conn, "User '"+name+"' does not exist")
-				} else if userInfo.conn == nil {
-					sendReply(conn, "User '"+name+"' is offline")
-				} else {
-
-					// send message
-					if err := sendMessage(userInfo.conn, userName, rqst.Data2); err != nil {
-						sendReply(conn, err.Error())
-					} else {
-						sendReply(conn, "ok")
-					}
-				}
-			}
-			localDb.RUnlock()
+	srv.auditRequest(s, user, rqst, reply, auditOutcome, err)
 
-		//  Clear (for testing)
-		case protocol.ScmdClear:
-			localDb.Clear()
-			sendReply(conn, "ok")
-		}
-	} // end of for
+	srv.metrics.observeRequest(rqst.Command, outcome, time.Since(start))
 }
 
 // Forward message from one user to another
@@ -186,21 +403,53 @@ func sendReply(conn net.Conn, replyText string) error {
 	msg := protocol.MessageFromServer{Type: protocol.Reply, Data1: replyText, Data2: ""}
 	json := append(msg.Encode(), '\n')
 	_, err := conn.Write(json)
-	if err != nil {
-		log.Fatal(err.Error())
+	return err
+}
+
+// sendRateLimited - reply to a request rejected by rate limiting
+func sendRateLimited(conn net.Conn, retryAfter time.Duration) error {
+	seconds := strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
+	msg := protocol.MessageFromServer{Type: protocol.Reply, Data1: protocol.ReplyRateLimited, Data2: seconds}
+	json := append(msg.Encode(), '\n')
+	_, err := conn.Write(json)
+	return err
+}
+
+// sendNotice - send notice from server (not a reply to request)
+func sendNotice(conn net.Conn, code, text string) error {
+	msg := protocol.MessageFromServer{Type: protocol.Notice, Data1: code, Data2: text}
+	json := append(msg.Encode(), '\n')
+	_, err := conn.Write(json)
+	return err
+}
+
+// sendNoticeTo - send notice to another session's client; a stalled client
+// doesn't block the sender longer than a second (its connection is closed then)
+func sendNoticeTo(conn net.Conn, code, text string) error {
+
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if err := sendNotice(conn, code, text); err != nil {
+		conn.Close()
+		return err
 	}
-	return nil
+
+	return conn.SetWriteDeadline(time.Time{})
+}
+
+// sendLoggedIn - tell client it's logged in without password ('how' - client certificate, API token)
+func sendLoggedIn(conn net.Conn, name, how string) error {
+	msg := protocol.MessageFromServer{Type: protocol.Notice, Data1: protocol.NoticeLoggedIn, Data2: "Logged in as '" + name + "' by " + how, Data3: name}
+	json := append(msg.Encode(), '\n')
+	_, err := conn.Write(json)
+	return err
 }
 
 // Forward message from one user to another
-func sendMessage(conn net.Conn, name, message string) error {
-	msg := protocol.MessageFromServer{Type: protocol.MessageFrom, Data1: name, Data2: message}
+func sendMessage(conn net.Conn, name, displayName, message string) error {
+	msg := protocol.MessageFromServer{Type: protocol.MessageFrom, Data1: name, Data2: message, Data3: displayName}
 	json := append(msg.Encode(), '\n')
 	_, err := conn.Write(json)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	return nil
+	return err
 }
 
 // LocalDbInterface - Interface for local DB implementaion
@@ -208,6 +457,30 @@ type LocalDbInterface interface {
 	// Init - Initiate Local Db
 	Init() error
 
+	// Close - release storage
+	Close() error
+
+	// CheckWritable - check that changes can be saved
+	CheckWritable() error
+
+	// Ready - check that changes can be saved (without file operations)
+	Ready() error
+
+	// Check - check db consistency; returns list of problems
+	Check() []string
+
+	// SetKey - set storage encryption key (before Init; nil - no encryption)
+	SetKey(key []byte)
+
+	// Rekey - save db file encrypted with new key (nil - not encrypted)
+	Rekey(key []byte) error
+
+	// Backup - write consistent snapshot of storage to file; returns number of users
+	Backup(fileName string, encrypt bool) (int, error)
+
+	// Restore - load backup or export file into empty storage ('merge' - add users)
+	Restore(fileName string, merge bool) (int, error)
+
 	// RLock - lock for reading
 	RLock()
 
@@ -220,21 +493,107 @@ type LocalDbInterface interface {
 	// DoesUserExist - check that user exists
 	DoesUserExist(name string) bool
 
-	// AddUser - Add User
-	AddUser(name, password string, conn net.Conn) error
+	// AddUser - Add User (password - bcrypt hash)
+	AddUser(name, passwordHash string, conn net.Conn) error
+
+	// DeleteUser - Delete User (online user is disconnected)
+	DeleteUser(name string) error
+
+	// DeleteLoggedInUser - delete user keeping its connection open
+	DeleteLoggedInUser(name string) error
 
-	// Login - login
-	Login(name, password string, conn net.Conn) error
+	// GetUserList - Get all registered users (sorted)
+	GetUserList() []string
 
 	// Logout - logout
 	Logout(name string)
 
-	// ChangePassword -
-	ChangePassword(name, newPassword string) error
+	// ChangePassword - set password hash; 'history' - number of previous hashes to keep
+	ChangePassword(name, passwordHash string, history int) error
+
+	// GetPasswordHistory - current and previous password hashes (the newest first)
+	GetPasswordHistory(name string) []string
+
+	// ProvisionUser - add user authenticated by external backend (without local password)
+	ProvisionUser(name, source string) error
+
+	// GetAuthSource - authentication backend of user (false if user does not exist)
+	GetAuthSource(name string) (string, bool)
+
+	// GoOnline - login of authenticated user
+	GoOnline(name string, conn net.Conn) error
+
+	// TOTPEnabled - user has two-factor authentication on
+	TOTPEnabled(name string) bool
+
+	// UpdateTOTP - change TOTP settings of user: 'update' gets a copy (nil - none)
+	// and returns new settings (nil - remove); nothing is changed if it fails
+	UpdateTOTP(name string, update func(t *TOTP) (*TOTP, error)) error
+
+	// GetTokens - API tokens of user
+	GetTokens(name string) []APIToken
+
+	// UpdateTokens - change API tokens of user: 'update' gets a copy and returns
+	// new list; nothing is changed if it fails
+	UpdateTokens(name string, update func(tokens []APIToken) ([]APIToken, error)) error
+
+	// FindToken - owner of API token with this hash
+	FindToken(hash string) (string, APIToken, bool)
+
+	// GetPublicKey - public key of user for end-to-end encryption (false if user does not exist)
+	GetPublicKey(name string) (string, bool)
+
+	// SetPublicKey - change public key of user ("" - remove)
+	SetPublicKey(name, key string) error
+
+	// GetRole - user role ("" if user does not exist)
+	GetRole(name string) string
+
+	// SetRole - change user role
+	SetRole(name, role string) error
+
+	// SetRestriction - ban or mute user, or ban IP address (r==nil - remove restriction)
+	SetRestriction(kind, target string, r *Restriction) error
+
+	// GetRestriction - active restriction (nil - none or expired)
+	GetRestriction(kind, target string) *Restriction
+
+	// GetRestrictionList - active restrictions
+	GetRestrictionList() []RestrictionEntry
+
+	// GetPrivacy - contacts, block list and privacy options of the user
+	GetPrivacy(name string) (Privacy, bool)
+
+	// SetPrivacy - change privacy options of the user (lists are not changed)
+	SetPrivacy(name string, p Privacy) error
+
+	// SetBlocked - add or remove member of user's block list
+	SetBlocked(name, member string, blocked bool) error
+
+	// UpdateRoster - send, accept or decline contact request, or remove contact
+	UpdateRoster(name, otherName, action string) (bool, error)
+
+	// GetProfile - user profile
+	GetProfile(name string) (Profile, bool)
+
+	// SetProfile - change user profile
+	SetProfile(name string, p Profile) error
+
+	// RenameUser - change user name (other users' lists are updated too)
+	RenameUser(name, newName string) error
+
+	// CheckUnique - check that name is not taken (the same case-folded name or confusable skeleton)
+	CheckUnique(name string) error
+
+	// ResolveName - registered name of user (exact or case-insensitive match; name itself if not found)
+	ResolveName(name string) string
+
+	// CheckPassword - check user password
+	CheckPassword(name, password string) error
 
-	// GetOnlineUserList - Get Online User List
+	// GetOnlineUserList - Get Online User List (sorted)
 	GetOnlineUserList() []string
 
 	// Clear - Clear Local Db (for testing)
-	Clear()
+	Clear() error
 }
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"bufio"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// constTestPassword - password of users of newTestServer
+const constTestPassword = "secret-password"
+
+// newTestServer - server with memory storage, without login rate limits and
+// with registered users (password constTestPassword)
+func newTestServer(t *testing.T, users ...string) *Server {
+
+	passwordHashCost = bcrypt.MinCost
+	t.Cleanup(func() { passwordHashCost = bcrypt.DefaultCost })
+
+	cfg := DefaultConfig()
+	cfg.Storage.Backend = StorageMemory
+	cfg.RateLimits.Login = RateLimitScopes{}
+
+	srv := NewServerWithConfig(cfg)
+	if err := srv.localDb.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := hashPassword(constTestPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range users {
+		if err := srv.localDb.AddUser(name, hash, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return srv
+}
+
+// testClients - number of test clients (remote address of the next one)
+var testClients uint64
+
+// testClient - session of test server with the client end of its connection
+type testClient struct {
+	*session
+	srv     *Server
+	t       *testing.T
+	replies chan string
+}
+
+// newTestClient - connected session ('user' - already logged in, "" - guest)
+func newTestClient(t *testing.T, srv *Server, user string) *testClient {
+
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	key := "pipe-" + strconv.FormatUint(atomic.AddUint64(&testClients, 1), 10)
+	s := &session{conn: server, key: key, ip: "10.0.0.1", userName: user,
+		started: time.Now(), connLogger: slog.Default(), logger: slog.Default()}
+	c := &testClient{session: s, srv: srv, t: t, replies: make(chan string, 16)}
+
+	// replies are kept, notices and messages are skipped
+	go func() {
+		scanner := bufio.NewScanner(client)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var msg protocol.MessageFromServer
+			msg.Decode(scanner.Text())
+			if msg.Type == protocol.Reply {
+				c.replies <- msg.Data1
+			}
+		}
+	}()
+
+	return c
+}
+
+// request - send request through processRequest (permission check, handler,
+// audit and metrics); returns reply text (error text if it fails)
+func (c *testClient) request(command protocol.CommandToServer, data1, data2 string) string {
+
+	c.srv.processRequest(c.session, protocol.Request{Command: command, Data1: data1, Data2: data2})
+
+	select {
+	case reply := <-c.replies:
+		return reply
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("No reply to ", command)
+		return ""
+	}
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API token settings
+const (
+	constTokenPrefix  = "mt_"
+	constTokenSecret  = 32
+	constMaxTokens    = 20
+	constMaxTokenName = 64
+)
+
+// APIToken - long-lived token for bots and scripts (the token itself is not stored)
+type APIToken struct {
+	// public ID (start of hash) for list and revoke
+	ID   string
+	Name string
+	// SHA-256 of token (hex)
+	Hash    string
+	Scopes  []string
+	Created time.Time
+	// last login (zero - never used)
+	LastUsed time.Time
+}
+
+// tokenScopes - valid scopes
+var tokenScopes = []string{protocol.TokenScopeSend, protocol.TokenScopeRead, protocol.TokenScopeAdmin}
+
+// tokenScopeCommands - commands allowed by scope (admin scope allows moderator
+// and admin commands, see tokenAllows)
+var tokenScopeCommands = map[string][]protocol.CommandToServer{
+	protocol.TokenScopeSend: {protocol.ScmdMessageTo, protocol.ScmdGetOnlineUserList, protocol.ScmdGetPublicKey},
+	protocol.TokenScopeRead: {protocol.ScmdGetOnlineUserList, protocol.ScmdGetRoster, protocol.ScmdGetProfile,
+		protocol.ScmdGetAvatar, protocol.ScmdGetPrivacy, protocol.ScmdGetPublicKey},
+}
+
+// hashToken - stored form of token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIToken - new token (returned in plain text once)
+func newAPIToken(name string, scopes []string, now time.Time) (*APIToken, string, error) {
+
+	secret := make([]byte, constTokenSecret)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	token := constTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	hash := hashToken(token)
+
+	return &APIToken{ID: hash[:12], Name: name, Hash: hash, Scopes: scopes, Created: now.UTC()}, token, nil
+}
+
+// parseTokenScopes - comma separated scopes
+func parseTokenScopes(v string) ([]string, error) {
+
+	scopes := []string{}
+	for _, scope := range splitList(v) {
+		if !slices.Contains(tokenScopes, scope) {
+			return nil, errors.New("Invalid scope '" + scope + "' (use " + strings.Join(tokenScopes, ", ") + ")")
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("No scope (use " + strings.Join(tokenScopes, ", ") + ")")
+	}
+
+	return scopes, nil
+}
+
+// tokenAllows - command is allowed in session logged in with token of these scopes
+func tokenAllows(scopes []string, command protocol.CommandToServer) bool {
+
+	if command == protocol.ScmdLogout {
+		return true
+	}
+
+	for _, scope := range scopes {
+		if slices.Contains(tokenScopeCommands[scope], command) {
+			return true
+		}
+		// commands missing in commandPermissions are admin only
+		if required, ok := commandPermissions[command]; scope == protocol.TokenScopeAdmin && (!ok || required >= permModerator) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// describe - token line for lists
+func (t *APIToken) describe() string {
+	used := "never used"
+	if !t.LastUsed.IsZero() {
+		used = "used " + t.LastUsed.Format(time.RFC3339)
+	}
+	return t.ID + "  " + t.Name + "  [" + strings.Join(t.Scopes, ",") + "]  created " + t.Created.Format(time.RFC3339) + ", " + used
+}
+
+// revokeToken - remove token of user by ID or name; returns token ID
+func revokeToken(db LocalDbInterface, name, idOrName string) (string, error) {
+
+	var id string
+	err := db.UpdateTokens(name, func(tokens []APIToken) ([]APIToken, error) {
+		for i, t := range tokens {
+			if t.ID == idOrName || t.Name == idOrName {
+				id = t.ID
+				return append(tokens[:i], tokens[i+1:]...), nil
+			}
+		}
+		return nil, errors.New("Token '" + idOrName + "' not found")
+	})
+
+	return id, err
+}
+
+// closeRevokedTokenSessions - close sessions of user logged in with revoked tokens
+func (srv *Server) closeRevokedTokenSessions(name string) int {
+
+	valid := map[string]bool{}
+	for _, t := range srv.localDb.GetTokens(name) {
+		valid[t.ID] = true
+	}
+
+	return srv.closeSessions(func(s *session) bool {
+		id, _ := s.token()
+		return id != "" && !valid[id] && s.user() == name
+	}, protocol.NoticeSessionRevoked, "API token is revoked")
+}
+
+// handleCreateToken - CreateToken
+func (srv *Server) handleCreateToken(s *session, rqst protocol.Request) (string, error) {
+
+	name := strings.TrimSpace(rqst.Data1)
+	if name == "" || len(name) > constMaxTokenName {
+		return "", errors.New("Token name must be 1-" + strconv.Itoa(constMaxTokenName) + " characters")
+	}
+	scopes, err := parseTokenScopes(rqst.Data2)
+	if err != nil {
+		return "", err
+	}
+	if slices.Contains(scopes, protocol.TokenScopeAdmin) && rolePermissions[srv.localDb.GetRole(s.userName)] < permModerator {
+		return "", errors.New("Scope 'admin' requires moderator or admin role")
+	}
+
+	var token string
+	err = srv.localDb.UpdateTokens(s.userName, func(tokens []APIToken) ([]APIToken, error) {
+		if len(tokens) >= constMaxTokens {
+			return nil, errors.New("Too many tokens (revoke unused ones)")
+		}
+		for _, t := range tokens {
+			if t.Name == name {
+				return nil, errors.New("Token '" + name + "' already exists")
+			}
+		}
+		t, plain, err := newAPIToken(name, scopes, srv.now())
+		if err != nil {
+			return nil, err
+		}
+		token = plain
+		return append(tokens, *t), nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	s.logger.Info("API token created", "name", s.userName, "token", name, "scopes", scopes)
+	return "API token (shown only once, keep it safe):\n" + token, nil
+}
+
+// handleListTokens - ListTokens
+func (srv *Server) handleListTokens(s *session, rqst protocol.Request) (string, error) {
+
+	tokens := srv.localDb.GetTokens(s.userName)
+	if len(tokens) == 0 {
+		return "No API tokens", nil
+	}
+
+	lines := []string{}
+	for _, t := range tokens {
+		lines = append(lines, t.describe())
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// handleRevokeToken - RevokeToken
+func (srv *Server) handleRevokeToken(s *session, rqst protocol.Request) (string, error) {
+
+	id, err := revokeToken(srv.localDb, s.userName, strings.TrimSpace(rqst.Data1))
+	if err != nil {
+		return "", err
+	}
+
+	srv.closeRevokedTokenSessions(s.userName)
+	s.logger.Info("API token revoked", "name", s.userName, "token", id)
+
+	return "ok", nil
+}
+
+// handleTokenLogin - TokenLogin
+func (srv *Server) handleTokenLogin(s *session, rqst protocol.Request) (string, error) {
+
+	// the current user would stay online without session
+	if s.userName != "" {
+		return "", errors.New("You are already logged in as '" + s.userName + "' (log out first)")
+	}
+
+	if ok, retryAfter := srv.limiter.allow(actionLogin, s.key, "", s.ip); !ok {
+		return "", &rateLimitedError{retryAfter}
+	}
+
+	name, token, ok := srv.localDb.FindToken(hashToken(rqst.Data1))
+	if !ok {
+		s.logger.Info("login failed", "err", "invalid API token")
+		return "", errors.New("Invalid API token")
+	}
+	if r := srv.localDb.GetRestriction(RestrictionBan, name); r != nil {
+		s.logger.Info("login failed", "name", name, "err", "banned")
+		return "", errors.New("You are banned " + r.describe())
+	}
+
+	if err := srv.localDb.GoOnline(name, s.conn); err != nil {
+		return "", err
+	}
+
+	// last use is informational, login doesn't fail without it
+	srv.localDb.UpdateTokens(name, func(tokens []APIToken) ([]APIToken, error) {
+		for i := range tokens {
+			if tokens[i].ID == token.ID {
+				tokens[i].LastUsed = srv.now().UTC()
+			}
+		}
+		return tokens, nil
+	})
+
+	s.logger.Info("logged in", "name", name, "token", token.ID, "scopes", token.Scopes)
+	s.setToken(token.ID, token.Scopes)
+	s.setUser(name)
+
+	// client learns the nickname from notice
+	sendLoggedIn(s.conn, name, "API token '"+token.Name+"'")
+
+	return "ok", nil
+}
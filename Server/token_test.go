@@ -0,0 +1,122 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"strings"
+	"testing"
+)
+
+func TestAPITokens(t *testing.T) {
+
+	srv := newTestServer(t)
+	request := func(c *testClient, command protocol.CommandToServer, data1, data2 string) string {
+		return c.request(command, data1, data2)
+	}
+
+	owner := newTestClient(t, srv, "")
+	request(owner, protocol.ScmdRegisterUser, "bot", "secret-password")
+	if reply := request(owner, protocol.ScmdLogin, "bot", "secret-password"); reply != "ok" {
+		t.Fatal(reply)
+	}
+
+	for _, bad := range []struct{ name, scopes string }{
+		{"", "send"},
+		{"ci", ""},
+		{"ci", "send,write"},
+		{"ci", "admin"},
+	} {
+		if reply := request(owner, protocol.ScmdCreateToken, bad.name, bad.scopes); strings.Contains(reply, constTokenPrefix) {
+			t.Errorf("%q %q: expected error", bad.name, bad.scopes)
+		}
+	}
+
+	reply := request(owner, protocol.ScmdCreateToken, "ci", "send")
+	lines := strings.Split(reply, "\n")
+	token := lines[len(lines)-1]
+	if !strings.HasPrefix(token, constTokenPrefix) {
+		t.Fatal("Invalid token: ", reply)
+	}
+	if reply := request(owner, protocol.ScmdCreateToken, "ci", "read"); strings.Contains(reply, constTokenPrefix) {
+		t.Error("Expected duplicate name error")
+	}
+
+	// the token itself is not stored
+	tokens := srv.localDb.GetTokens("bot")
+	if len(tokens) != 1 || tokens[0].Hash != hashToken(token) || strings.Contains(tokens[0].Hash, token) {
+		t.Fatal("Invalid stored tokens: ", tokens)
+	}
+
+	// one session per user
+	request(owner, protocol.ScmdLogout, "", "")
+
+	// logged in session can't switch user
+	alice := newTestClient(t, srv, "")
+	request(alice, protocol.ScmdRegisterUser, "alice", "secret-password")
+	request(alice, protocol.ScmdLogin, "alice", "secret-password")
+	if reply := request(alice, protocol.ScmdTokenLogin, token, ""); reply != "You are already logged in as 'alice' (log out first)" {
+		t.Error("Expected logged in error: ", reply)
+	}
+	request(alice, protocol.ScmdLogout, "", "")
+	if online := srv.localDb.GetOnlineUserList(); len(online) != 0 {
+		t.Error("User is online after logout: ", online)
+	}
+
+	bot := newTestClient(t, srv, "")
+	if reply := request(bot, protocol.ScmdTokenLogin, token+"x", ""); reply != "Invalid API token" {
+		t.Error("Expected invalid token error: ", reply)
+	}
+	if reply := request(bot, protocol.ScmdTokenLogin, token, ""); reply != "ok" {
+		t.Fatal(reply)
+	}
+	if bot.user() != "bot" {
+		t.Fatal("Not logged in: ", bot.user())
+	}
+	if srv.localDb.GetTokens("bot")[0].LastUsed.IsZero() {
+		t.Error("Last use is not recorded")
+	}
+
+	// scope
+	for command, allowed := range map[protocol.CommandToServer]bool{
+		protocol.ScmdGetOnlineUserList: true,
+		protocol.ScmdMessageTo:         true,
+		protocol.ScmdGetRoster:         false,
+		protocol.ScmdChangePassword:    false,
+		protocol.ScmdCreateToken:       false,
+		protocol.ScmdDeleteAccount:     false,
+		protocol.ScmdLogin:             false,
+		protocol.ScmdKick:              false,
+	} {
+		if err := srv.checkPermission(bot.session, command); (err == nil) != allowed {
+			t.Errorf("%s: %v", command, err)
+		}
+	}
+
+	request(bot, protocol.ScmdLogout, "", "")
+	if reply := request(owner, protocol.ScmdLogin, "bot", "secret-password"); reply != "ok" {
+		t.Fatal(reply)
+	}
+
+	// admin scope gives role commands only
+	srv.localDb.SetRole("bot", protocol.RoleModerator)
+	if reply := request(owner, protocol.ScmdCreateToken, "moderation", "read,admin"); !strings.Contains(reply, constTokenPrefix) {
+		t.Fatal(reply)
+	}
+	if !tokenAllows([]string{protocol.TokenScopeAdmin}, protocol.ScmdBan) || tokenAllows([]string{protocol.TokenScopeAdmin}, protocol.ScmdMessageTo) {
+		t.Error("Invalid admin scope")
+	}
+
+	if reply := request(owner, protocol.ScmdListTokens, "", ""); strings.Count(reply, "\n") != 1 || !strings.Contains(reply, "[read,admin]") {
+		t.Error("Invalid list: ", reply)
+	}
+
+	// revoked token can't log in
+	if reply := request(owner, protocol.ScmdRevokeToken, "ci", ""); reply != "ok" {
+		t.Fatal(reply)
+	}
+	if reply := request(owner, protocol.ScmdRevokeToken, "ci", ""); reply == "ok" {
+		t.Error("Expected not found error")
+	}
+	if reply := request(newTestClient(t, srv, ""), protocol.ScmdTokenLogin, token, ""); reply == "ok" {
+		t.Error("Revoked token works")
+	}
+}
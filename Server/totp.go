@@ -0,0 +1,256 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP settings (RFC 6238 defaults understood by authenticator apps)
+const (
+	constTOTPIssuer  = "Messenger"
+	constTOTPPeriod  = 30
+	constTOTPDigits  = 6
+	constTOTPSkew    = 1 // accepted periods before and after current one
+	constTOTPSecret  = 20
+	constRecoveryNum = 10
+	// time to enter one-time code after password
+	constTOTPLoginTimeout = 5 * time.Minute
+)
+
+// secretEncoding - base32 without padding (as in otpauth URI)
+var secretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTP - time-based one-time password settings of user
+type TOTP struct {
+	// base32 secret
+	Secret string
+	// false until the first code is confirmed
+	Enabled bool
+	// last used time step (a code can't be used twice)
+	LastStep int64 `json:",omitempty"`
+	// SHA-256 of unused recovery codes
+	RecoveryCodes []string `json:",omitempty"`
+}
+
+// totpCode - one-time code of time step (RFC 4226 HOTP)
+func totpCode(secret []byte, step int64) string {
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", constTOTPDigits, value%1000000)
+}
+
+// totpStep - time step of t
+func totpStep(t time.Time) int64 {
+	return t.Unix() / constTOTPPeriod
+}
+
+// hashRecoveryCode - stored form of recovery code
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+// newTOTP - new secret and recovery codes (returned in plain text once)
+func newTOTP() (*TOTP, []string, error) {
+
+	secret := make([]byte, constTOTPSecret)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, nil, err
+	}
+	t := &TOTP{Secret: secretEncoding.EncodeToString(secret)}
+
+	codes := []string{}
+	for i := 0; i < constRecoveryNum; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(secretEncoding.EncodeToString(b))
+		code = code[:4] + "-" + code[4:]
+		codes = append(codes, code)
+		t.RecoveryCodes = append(t.RecoveryCodes, hashRecoveryCode(code))
+	}
+
+	return t, codes, nil
+}
+
+// uri - otpauth URI for authenticator apps
+func (t *TOTP) uri(name string) string {
+	v := url.Values{}
+	v.Set("secret", t.Secret)
+	v.Set("issuer", constTOTPIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(constTOTPDigits))
+	v.Set("period", fmt.Sprint(constTOTPPeriod))
+	return "otpauth://totp/" + url.PathEscape(constTOTPIssuer+":"+name) + "?" + v.Encode()
+}
+
+// verify - check one-time code (or recovery code if allowed); used codes are
+// remembered, so the caller must store t after success
+func (t *TOTP) verify(code string, now time.Time, recovery bool) error {
+
+	code = strings.TrimSpace(code)
+	secret, err := secretEncoding.DecodeString(t.Secret)
+	if err != nil {
+		return errors.New("Invalid TOTP secret")
+	}
+
+	if len(code) == constTOTPDigits {
+		current := totpStep(now)
+		for step := current - constTOTPSkew; step <= current+constTOTPSkew; step++ {
+			if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+				if step <= t.LastStep {
+					return errors.New("The code is already used, wait for the next one")
+				}
+				t.LastStep = step
+				return nil
+			}
+		}
+	}
+
+	if recovery {
+		hash := hashRecoveryCode(code)
+		for i, h := range t.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+				t.RecoveryCodes = append(t.RecoveryCodes[:i:i], t.RecoveryCodes[i+1:]...)
+				return nil
+			}
+		}
+	}
+
+	return errors.New("Invalid one-time code")
+}
+
+// checkTOTP - verify code of user with 2FA on and store used code
+func (srv *Server) checkTOTP(name, code string) error {
+	return srv.localDb.UpdateTOTP(name, func(t *TOTP) (*TOTP, error) {
+		if t == nil || !t.Enabled {
+			return nil, errors.New("Two-factor authentication is off")
+		}
+		return t, t.verify(code, srv.now(), true)
+	})
+}
+
+// handleLoginTOTP - LoginTOTP (second login step)
+func (srv *Server) handleLoginTOTP(s *session, rqst protocol.Request) (string, error) {
+
+	name := s.pendingLogin
+	if name == "" || srv.now().After(s.pendingUntil) {
+		s.pendingLogin = ""
+		return "", errors.New("Log in with password first")
+	}
+
+	if locked, retryAfter := srv.limiter.lockedOut(name, s.ip); locked {
+		return "", &rateLimitedError{retryAfter}
+	}
+	if err := srv.checkTOTP(name, rqst.Data1); err != nil {
+		srv.limiter.loginFailed(name, s.ip)
+		s.logger.Info("login failed", "name", name, "err", err)
+		return "", err
+	}
+
+	if err := srv.localDb.GoOnline(name, s.conn); err != nil {
+		return "", err
+	}
+
+	s.pendingLogin = ""
+	srv.limiter.loginSucceeded(name, s.ip)
+	s.logger.Info("logged in", "name", name, "2fa", true)
+	s.setUser(name)
+
+	return "ok", nil
+}
+
+// handleSetupTOTP - SetupTOTP
+func (srv *Server) handleSetupTOTP(s *session, rqst protocol.Request) (string, error) {
+
+	var codes []string
+	var uri string
+	err := srv.localDb.UpdateTOTP(s.userName, func(t *TOTP) (*TOTP, error) {
+		if t != nil && t.Enabled {
+			return nil, errors.New("Two-factor authentication is already on")
+		}
+		t, list, err := newTOTP()
+		if err != nil {
+			return nil, err
+		}
+		codes, uri = list, t.uri(s.userName)
+		return t, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	lines := []string{
+		"Add this account to authenticator app and confirm with a code:",
+		uri,
+		"Recovery codes (each works once, keep them safe):",
+	}
+	lines = append(lines, codes...)
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// handleConfirmTOTP - ConfirmTOTP
+func (srv *Server) handleConfirmTOTP(s *session, rqst protocol.Request) (string, error) {
+
+	err := srv.localDb.UpdateTOTP(s.userName, func(t *TOTP) (*TOTP, error) {
+		if t == nil {
+			return nil, errors.New("Set up two-factor authentication first")
+		}
+		if t.Enabled {
+			return nil, errors.New("Two-factor authentication is already on")
+		}
+		if err := t.verify(rqst.Data1, srv.now(), false); err != nil {
+			return nil, err
+		}
+		t.Enabled = true
+		return t, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	s.logger.Info("2fa enabled", "name", s.userName)
+	return "ok", nil
+}
+
+// handleDisableTOTP - DisableTOTP
+func (srv *Server) handleDisableTOTP(s *session, rqst protocol.Request) (string, error) {
+
+	if locked, retryAfter := srv.limiter.lockedOut(s.userName, s.ip); locked {
+		return "", &rateLimitedError{retryAfter}
+	}
+	if err := srv.checkTOTP(s.userName, rqst.Data1); err != nil {
+		srv.limiter.loginFailed(s.userName, s.ip)
+		return "", err
+	}
+
+	if err := srv.localDb.UpdateTOTP(s.userName, func(t *TOTP) (*TOTP, error) { return nil, nil }); err != nil {
+		return "", err
+	}
+
+	s.logger.Info("2fa disabled", "name", s.userName)
+	return "ok", nil
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"GitHub/Messenger-to-learn-golang/protocol"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+
+	// RFC 6238 test vectors (SHA1, last 6 of 8 digits)
+	secret := []byte("12345678901234567890")
+	for unix, code := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"} {
+		if c := totpCode(secret, totpStep(time.Unix(unix, 0))); c != code {
+			t.Errorf("%d: expected %s, got %s", unix, code, c)
+		}
+	}
+}
+
+func TestTOTPLogin(t *testing.T) {
+
+	srv := newTestServer(t)
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	srv.now = func() time.Time { return now }
+
+	s := newTestClient(t, srv, "")
+	request := s.request
+
+	request(protocol.ScmdRegisterUser, "a", "secret-password")
+	if reply := request(protocol.ScmdLogin, "a", "secret-password"); reply != "ok" {
+		t.Fatal(reply)
+	}
+
+	// enrollment
+	reply := request(protocol.ScmdSetupTOTP, "", "")
+	lines := strings.Split(reply, "\n")
+	uri, err := url.Parse(lines[1])
+	if err != nil || uri.Scheme != "otpauth" || len(lines) != 3+constRecoveryNum {
+		t.Fatal("Invalid setup reply: ", reply)
+	}
+	secret, _ := secretEncoding.DecodeString(uri.Query().Get("secret"))
+	recovery := lines[3]
+	code := func() string { return totpCode(secret, totpStep(now)) }
+
+	if srv.localDb.TOTPEnabled("a") {
+		t.Error("2FA is on before confirmation")
+	}
+	if reply := request(protocol.ScmdConfirmTOTP, "000000", ""); reply == "ok" && code() != "000000" {
+		t.Error("Expected invalid code error")
+	}
+	if reply := request(protocol.ScmdConfirmTOTP, code(), ""); reply != "ok" {
+		t.Fatal(reply)
+	}
+
+	// login needs the code now
+	request(protocol.ScmdLogout, "", "")
+	if reply := request(protocol.ScmdLogin, "a", "secret-password"); reply != protocol.ReplyTOTPRequired {
+		t.Fatal("Expected code request: ", reply)
+	}
+	if s.user() != "" {
+		t.Error("Logged in without code")
+	}
+	// the code is used by confirmation
+	if reply := request(protocol.ScmdLoginTOTP, code(), ""); reply == "ok" {
+		t.Error("Expected used code error")
+	}
+	now = now.Add(constTOTPPeriod * time.Second)
+	if reply := request(protocol.ScmdLoginTOTP, code(), ""); reply != "ok" || s.user() != "a" {
+		t.Fatal("Login with code failed: ", reply)
+	}
+
+	// recovery code works once
+	request(protocol.ScmdLogout, "", "")
+	for i, expected := range []bool{true, false} {
+		now = now.Add(time.Minute)
+		request(protocol.ScmdLogin, "a", "secret-password")
+		if reply := request(protocol.ScmdLoginTOTP, recovery, ""); (reply == "ok") != expected {
+			t.Errorf("Recovery code use %d: %s", i+1, reply)
+		}
+		request(protocol.ScmdLogout, "", "")
+	}
+
+	// pending login expires
+	request(protocol.ScmdLogin, "a", "secret-password")
+	now = now.Add(constTOTPLoginTimeout + time.Second)
+	if reply := request(protocol.ScmdLoginTOTP, code(), ""); reply == "ok" {
+		t.Error("Expected expired login error")
+	}
+	request(protocol.ScmdLogin, "a", "secret-password")
+	if reply := request(protocol.ScmdLoginTOTP, code(), ""); reply != "ok" {
+		t.Fatal(reply)
+	}
+
+	// disable
+	now = now.Add(constTOTPPeriod * time.Second)
+	if reply := request(protocol.ScmdDisableTOTP, code(), ""); reply != "ok" {
+		t.Fatal(reply)
+	}
+	request(protocol.ScmdLogout, "", "")
+	if reply := request(protocol.ScmdLogin, "a", "secret-password"); reply != "ok" {
+		t.Error("Expected login without code: ", reply)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"GitHub/Messenger-to-learn-golang/client"
+	"log/slog"
 	"os"
 )
 
@@ -14,6 +15,30 @@ func main() {
 	}
 
 	client := client.NewClient(serverAddress)
+
+	// MESSENGER_LOG_LEVEL=debug for verbose output
+	if v := os.Getenv("MESSENGER_LOG_LEVEL"); v != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(v)); err == nil {
+			client.SetLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+		}
+	}
+
+	// client certificate for "tls://" address (login without password)
+	// and CA of server certificate
+	if err := client.SetTLSFiles(os.Getenv("MESSENGER_CLIENT_CERT"), os.Getenv("MESSENGER_CLIENT_KEY"), os.Getenv("MESSENGER_CA_FILE")); err != nil {
+		slog.Error("can't load TLS files", "err", err)
+		os.Exit(1)
+	}
+
+	// MESSENGER_KEY_DIR - end-to-end encryption keys (default - user config directory)
+	if dir := os.Getenv("MESSENGER_KEY_DIR"); dir != "" {
+		client.SetKeyDir(dir)
+	}
+
+	// MESSENGER_TOKEN - log in with API token (bots and scripts)
+	client.SetAPIToken(os.Getenv("MESSENGER_TOKEN"))
+
 	client.Run(serverAddress)
 	return
 }
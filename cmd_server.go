@@ -2,17 +2,95 @@ package main
 
 import (
 	"GitHub/Messenger-to-learn-golang/server"
+	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
 func main() {
 
-	portNum := ":1111"
-	if len(os.Args) > 1 {
-		portNum = os.Args[1]
+	args := os.Args[1:]
+
+	// subcommand ('serve' by default)
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		if strings.Contains(args[0], ":") {
+			// backward compatibility: port number as the only argument
+			args = append([]string{"-listen"}, args...)
+		} else {
+			command = args[0]
+		}
 	}
 
-	srv := server.NewServer(portNum)
+	switch {
+	case command == "serve":
+		if len(args) > 0 && args[0] == "serve" {
+			args = args[1:]
+		}
+		serve(args)
+
+	case command == "admin":
+		os.Exit(server.RunAdminSocketCommand(args[1:], os.Stdout, os.Stderr))
+
+	case command == "audit":
+		os.Exit(server.RunAuditCommand(args[1:], os.Stdout, os.Stderr))
+
+	case server.IsAdminCommand(command):
+		os.Exit(server.RunAdminCommand(args, os.Stdin, os.Stdout, os.Stderr))
+
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown command '"+command+"'")
+		usage()
+		os.Exit(2)
+	}
+}
+
+// serve - run server
+func serve(args []string) {
+
+	cfg, printConfig, err := server.LoadConfig(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if printConfig {
+		os.Stdout.Write(cfg.Encode())
+		return
+	}
+
+	srv := server.NewServerWithConfig(cfg)
+
+	// 'reload' admin command and SIGHUP re-read config file and environment
+	srv.OnReload(func() (server.Config, error) {
+		cfg, _, err := server.LoadConfig(args)
+		return cfg, err
+	})
+
+	// graceful stop on Ctrl+C / SIGTERM
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				srv.Reload()
+				continue
+			}
+			srv.Stop()
+			return
+		}
+	}()
 
 	srv.Run()
 }
+
+// usage - print subcommands
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  serve [flags]                run server (default; '-h' for flags)")
+	server.AdminUsage(os.Stderr)
+	server.AdminSocketUsage(os.Stderr)
+	server.AuditUsage(os.Stderr)
+}
@@ -10,6 +10,8 @@ type MessageFromServer struct {
 	Type  MessageType
 	Data1 string
 	Data2 string
+	// optional (sender display name of MessageFrom)
+	Data3 string `json:",omitempty"`
 }
 
 // ServerReply -
@@ -17,11 +19,36 @@ func (m *MessageFromServer) ServerReply() string {
 	return m.Data1
 }
 
+// RetryAfter - seconds to wait before retrying (for 'RATE_LIMITED' reply)
+func (m *MessageFromServer) RetryAfter() string {
+	return m.Data2
+}
+
+// NoticeCode - notice code (i.e. 'SERVER_FULL')
+func (m *MessageFromServer) NoticeCode() string {
+	return m.Data1
+}
+
+// NoticeText - human readable notice text
+func (m *MessageFromServer) NoticeText() string {
+	return m.Data2
+}
+
+// NoticeNickname - nickname of 'LOGGED_IN' notice
+func (m *MessageFromServer) NoticeNickname() string {
+	return m.Data3
+}
+
 // SenderNickname -
 func (m *MessageFromServer) SenderNickname() string {
 	return m.Data1
 }
 
+// SenderDisplayName - sender display name ("" - not set)
+func (m *MessageFromServer) SenderDisplayName() string {
+	return m.Data3
+}
+
 // MessageText -
 func (m *MessageFromServer) MessageText() string {
 	return m.Data2
@@ -55,4 +82,59 @@ const (
 
 	// MessageFrom -
 	MessageFrom MessageType = "MessageFrom"
+
+	// Notice - notice from server (Data1 - notice code, Data2 - text)
+	Notice MessageType = "Notice"
 )
+
+// Notice codes
+const (
+	// NoticeServerFull - connection rejected by admission control
+	NoticeServerFull = "SERVER_FULL"
+
+	// NoticeKicked - session closed by administrator or moderator
+	NoticeKicked = "KICKED"
+
+	// NoticeBanned - user or address is banned (connection is closed)
+	NoticeBanned = "BANNED"
+
+	// NoticeMuted - user can't send messages
+	NoticeMuted = "MUTED"
+
+	// NoticeUnmuted - user can send messages again
+	NoticeUnmuted = "UNMUTED"
+
+	// NoticeContactRequest - another user wants to add you to contacts
+	NoticeContactRequest = "CONTACT_REQUEST"
+
+	// NoticeContactAccepted - contact request is accepted
+	NoticeContactAccepted = "CONTACT_ACCEPTED"
+
+	// NoticeNicknameChanged - contact has changed nickname
+	NoticeNicknameChanged = "NICKNAME_CHANGED"
+
+	// NoticeSessionRevoked - session is closed after password change
+	NoticeSessionRevoked = "SESSION_REVOKED"
+
+	// NoticeAnnouncement - server-wide announcement
+	NoticeAnnouncement = "ANNOUNCEMENT"
+
+	// NoticeLoggedIn - session is logged in by client certificate or API token (Data3 - nickname)
+	NoticeLoggedIn = "LOGGED_IN"
+
+	// NoticeLoginFailed - login by client certificate failed (connection is closed)
+	NoticeLoginFailed = "LOGIN_FAILED"
+)
+
+// EncryptedPrefix - start of end-to-end encrypted message text:
+// "e2e1:<base64 sender public key>:<base64 nonce and ciphertext>"
+// (X25519, HKDF-SHA256, XChaCha20-Poly1305; the server relays it as is)
+const EncryptedPrefix = "e2e1:"
+
+// ReplyRateLimited - reply to a request rejected by rate limiting
+// (Data2 contains retry-after seconds)
+const ReplyRateLimited = "RATE_LIMITED"
+
+// ReplyTOTPRequired - reply to Login when the password is right and 2FA is on
+// (send ScmdLoginTOTP to finish login)
+const ReplyTOTPRequired = "One-time code required"
@@ -0,0 +1,30 @@
+package protocol
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// ModerationArgs - Data2 of Ban, BanIP and Mute requests: "<duration> <reason>"
+// (duration 0 - forever)
+func ModerationArgs(duration time.Duration, reason string) string {
+	return duration.String() + " " + reason
+}
+
+// ParseModerationArgs - parse Data2 of Ban, BanIP and Mute requests
+func ParseModerationArgs(data string) (time.Duration, string, error) {
+
+	durationStr, reason, _ := strings.Cut(strings.TrimSpace(data), " ")
+
+	if durationStr == "0" || durationStr == "forever" {
+		return 0, strings.TrimSpace(reason), nil
+	}
+
+	duration, err := time.ParseDuration(durationStr)
+	if err != nil || duration < 0 {
+		return 0, "", errors.New("Invalid duration '" + durationStr + "'")
+	}
+
+	return duration, strings.TrimSpace(reason), nil
+}
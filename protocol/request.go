@@ -1,8 +1,11 @@
 package protocol
 
 import (
+	"crypto/md5"
 	"encoding/json"
+	"fmt"
 	"log"
+	"log/slog"
 )
 
 //
@@ -33,6 +36,35 @@ func (r *Request) Decode(jsonStr string) error {
 	return nil
 }
 
+// LogValue - slog.LogValuer; hides passwords
+func (r Request) LogValue() slog.Value {
+
+	data1, data2 := r.Data1, r.Data2
+
+	switch r.Command {
+	case ScmdRegisterUser, ScmdLogin:
+		data2 = constRedacted
+	case ScmdChangePassword:
+		data1, data2 = constRedacted, constRedacted
+	case ScmdDeleteAccount, ScmdLoginTOTP, ScmdConfirmTOTP, ScmdDisableTOTP, ScmdTokenLogin:
+		data1 = constRedacted
+	}
+
+	return slog.GroupValue(
+		slog.String("command", string(r.Command)),
+		slog.String("data1", data1),
+		slog.String("data2", data2))
+}
+
+// HashPassword - password hash sent to server by old clients ("md5:<hex>");
+// server checks it for accounts registered before server-side hashing
+func HashPassword(password []byte) string {
+	return fmt.Sprintf("md5:%x", md5.Sum(password))
+}
+
+// replaces credentials in logs
+const constRedacted = "[REDACTED]"
+
 // CommandToServer - command to server
 type CommandToServer string
 
@@ -49,7 +81,7 @@ const (
 	// ScmdLogout - request to server
 	ScmdLogout CommandToServer = "Logout"
 
-	// ScmdChangePassword - request to server
+	// ScmdChangePassword - request to server (Data1 - new password, Data2 - current password)
 	ScmdChangePassword CommandToServer = "ChangePassword"
 
 	// ScmdGetOnlineUserList - request to server
@@ -58,6 +90,144 @@ const (
 	// ScmdMessageTo - request to server
 	ScmdMessageTo CommandToServer = "MessageTo"
 
-	// ScmdClear - request to server (for testing)
+	// ScmdClear - request to server (admin or test mode only)
 	ScmdClear CommandToServer = "Clear"
+
+	// ScmdSetRole - request to server (admin only; Data1 - user, Data2 - role)
+	ScmdSetRole CommandToServer = "SetRole"
+
+	// ScmdKick - request to server (moderators; Data1 - user, Data2 - reason)
+	ScmdKick CommandToServer = "Kick"
+
+	// ScmdBan - request to server (moderators; Data1 - user, Data2 - ModerationArgs)
+	ScmdBan CommandToServer = "Ban"
+
+	// ScmdUnban - request to server (moderators; Data1 - user)
+	ScmdUnban CommandToServer = "Unban"
+
+	// ScmdBanIP - request to server (moderators; Data1 - IP address, Data2 - ModerationArgs)
+	ScmdBanIP CommandToServer = "BanIP"
+
+	// ScmdUnbanIP - request to server (moderators; Data1 - IP address)
+	ScmdUnbanIP CommandToServer = "UnbanIP"
+
+	// ScmdMute - request to server (moderators; Data1 - user, Data2 - ModerationArgs)
+	ScmdMute CommandToServer = "Mute"
+
+	// ScmdUnmute - request to server (moderators; Data1 - user)
+	ScmdUnmute CommandToServer = "Unmute"
+
+	// ScmdBlock - request to server (Data1 - user)
+	ScmdBlock CommandToServer = "Block"
+
+	// ScmdUnblock - request to server (Data1 - user)
+	ScmdUnblock CommandToServer = "Unblock"
+
+	// ScmdAddContact - request to server: send contact request (Data1 - user)
+	ScmdAddContact CommandToServer = "AddContact"
+
+	// ScmdAcceptContact - request to server: accept contact request (Data1 - user)
+	ScmdAcceptContact CommandToServer = "AcceptContact"
+
+	// ScmdDeclineContact - request to server: decline contact request (Data1 - user)
+	ScmdDeclineContact CommandToServer = "DeclineContact"
+
+	// ScmdRemoveContact - request to server: remove contact or cancel request (Data1 - user)
+	ScmdRemoveContact CommandToServer = "RemoveContact"
+
+	// ScmdGetRoster - request to server (reply - contacts with presence and pending requests)
+	ScmdGetRoster CommandToServer = "GetRoster"
+
+	// ScmdGetPrivacy - request to server (reply - contacts, block list and privacy options)
+	ScmdGetPrivacy CommandToServer = "GetPrivacy"
+
+	// ScmdSetPrivacy - request to server (Data1 - privacy option, Data2 - value)
+	ScmdSetPrivacy CommandToServer = "SetPrivacy"
+
+	// ScmdGetProfile - request to server (Data1 - user; "" - yourself)
+	ScmdGetProfile CommandToServer = "GetProfile"
+
+	// ScmdSetProfile - request to server (Data1 - profile field, Data2 - value; avatar is base64)
+	ScmdSetProfile CommandToServer = "SetProfile"
+
+	// ScmdGetAvatar - request to server (Data1 - user; reply - base64 avatar)
+	ScmdGetAvatar CommandToServer = "GetAvatar"
+
+	// ScmdChangeNickname - request to server (Data1 - new nickname)
+	ScmdChangeNickname CommandToServer = "ChangeNickname"
+
+	// ScmdDeleteAccount - request to server (Data1 - password for confirmation)
+	ScmdDeleteAccount CommandToServer = "DeleteAccount"
+
+	// ScmdLoginTOTP - request to server after ReplyTOTPRequired (Data1 - one-time or recovery code)
+	ScmdLoginTOTP CommandToServer = "LoginTOTP"
+
+	// ScmdSetupTOTP - request to server (reply - otpauth URI and recovery codes; 2FA is on after ScmdConfirmTOTP)
+	ScmdSetupTOTP CommandToServer = "SetupTOTP"
+
+	// ScmdConfirmTOTP - request to server (Data1 - one-time code from authenticator app)
+	ScmdConfirmTOTP CommandToServer = "ConfirmTOTP"
+
+	// ScmdDisableTOTP - request to server (Data1 - one-time or recovery code)
+	ScmdDisableTOTP CommandToServer = "DisableTOTP"
+
+	// ScmdCreateToken - request to server (Data1 - token name, Data2 - scopes, comma separated;
+	// reply - token, shown once)
+	ScmdCreateToken CommandToServer = "CreateToken"
+
+	// ScmdListTokens - request to server (reply - API tokens of the user)
+	ScmdListTokens CommandToServer = "ListTokens"
+
+	// ScmdRevokeToken - request to server (Data1 - token ID or name)
+	ScmdRevokeToken CommandToServer = "RevokeToken"
+
+	// ScmdTokenLogin - request to server: login with API token (Data1 - token)
+	ScmdTokenLogin CommandToServer = "TokenLogin"
+
+	// ScmdSetPublicKey - request to server (Data1 - base64 X25519 public key for
+	// end-to-end encryption; "" - remove)
+	ScmdSetPublicKey CommandToServer = "SetPublicKey"
+
+	// ScmdGetPublicKey - request to server (Data1 - user; reply - base64 public key)
+	ScmdGetPublicKey CommandToServer = "GetPublicKey"
+)
+
+// API token scopes
+const (
+	// TokenScopeSend - send messages and see who is online
+	TokenScopeSend = "send"
+
+	// TokenScopeRead - read online users, roster, profiles and privacy settings
+	TokenScopeRead = "read"
+
+	// TokenScopeAdmin - moderator and admin commands allowed by the user's role
+	TokenScopeAdmin = "admin"
+)
+
+// Profile fields
+const (
+	ProfileDisplayName = "display_name"
+	ProfileStatus      = "status"
+	ProfileBio         = "bio"
+	ProfileTimezone    = "timezone"
+	ProfileAvatar      = "avatar"
+)
+
+// Privacy options
+const (
+	// PrivacyHidePresence - "on": hide from online user list of non-contacts
+	PrivacyHidePresence = "hide_presence"
+
+	// PrivacyContactsOnly - "on": accept messages from contacts only
+	PrivacyContactsOnly = "contacts_only"
+
+	// PrivacyBlockReply - reply to blocked senders ("" - pretend the message is delivered)
+	PrivacyBlockReply = "block_reply"
+)
+
+// User roles
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
 )
@@ -2,17 +2,20 @@ package server_test
 
 import (
 	"GitHub/Messenger-to-learn-golang/server"
-	"log"
+	"log/slog"
 	"testing"
 )
 
 func TestServer(t *testing.T) {
 
-	log.SetFlags( /*log.LstdFlags |*/ log.Lshortfile)
+	cfg := server.DefaultConfig()
+	cfg.Log.Level = slog.LevelDebug
+	// client tests clear the database
+	cfg.TestMode = true
+	// client tests use short passwords
+	cfg.Password.MinLength = 1
 
-	server.Debug = true
-
-	srv := server.NewServer(":1111")
+	srv := server.NewServerWithConfig(cfg)
 
 	srv.Run()
 }